@@ -3,6 +3,7 @@ set -e
 
 PKGS="
     mp4
+    mp4/httpstream
 "
 
 CMDS="
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mp4"
+	"os"
+)
+
+// concat joins MP4s with the same tracks and codec parameters into one.
+func concat(args []string) {
+	flags := commandFlags("concat")
+	output := flags.String("o", "", "output MP4")
+	// Flags may come after the inputs too
+	var inputs []string
+	for flags.Parse(args); flags.NArg() > 0; flags.Parse(args) {
+		inputs = append(inputs, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(inputs) == 0 || *output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var files []*mp4.File
+	for _, input := range inputs {
+		f, err := openFile(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if err = mp4.Concat(files, w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// dash packages an MP4 for MPEG-DASH in a directory: an MPD and a
+// fragmented file for each track.
+func dash(args []string) {
+	flags := commandFlags("dash")
+	input := flags.String("i", "", "input MP4")
+	output := flags.String("o", "", "output directory")
+	duration := flags.Float64("duration", 4, "target segment duration in seconds")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := *output
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	d, err := f.NewDASH(int64(*duration * 1e9))
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = writeString(path.Join(dir, "manifest.mpd"), d.MPD("track%d.mp4"))
+	}
+	for _, r := range d.Representations() {
+		if err != nil {
+			break
+		}
+		err = writeFile(path.Join(dir, fmt.Sprintf("track%d.mp4", r.TrackID())), func(w io.Writer) (os.Error) {
+			_, err := r.WriteTo(w)
+			return err
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// defragment writes a progressive copy of a fragmented MP4, with all of its
+// samples in a single mdat.
+func defragment(args []string) {
+	flags := commandFlags("defragment")
+	input := flags.String("i", "", "input fragmented MP4")
+	output := flags.String("o", "", "output MP4")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	if err = f.Defragment(out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// extract writes one track of an MP4 as a raw H.264, H.265 or AAC stream.
+func extract(args []string) {
+	flags := commandFlags("extract")
+	input := flags.String("i", "", "input MP4")
+	track := flags.Uint("track", 1, "ID of the track to extract")
+	output := flags.String("o", "", "output elementary stream")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if err = f.ExtractTrack(uint32(*track), w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// faststart writes a copy of an MP4 with its moov moved in front of the mdat.
+func faststart(args []string) {
+	flags := commandFlags("faststart")
+	input := flags.String("i", "", "input MP4")
+	output := flags.String("o", "", "output MP4")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	if err = f.Faststart(out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
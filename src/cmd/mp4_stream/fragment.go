@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// fragment writes a fragmented copy of an MP4, suitable for playback with
+// Media Source Extensions.
+func fragment(args []string) {
+	flags := commandFlags("fragment")
+	input := flags.String("i", "", "input MP4")
+	output := flags.String("o", "", "output fragmented MP4")
+	duration := flags.Float64("duration", 2, "target fragment duration in seconds")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	if err = f.Fragment(int64(*duration * 1e9), out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
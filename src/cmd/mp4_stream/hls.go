@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// hls packages an MP4 for HTTP Live Streaming in a directory: a master
+// playlist, a media playlist, and an init segment and numbered fMP4
+// segments or, with -byterange, nothing else: the media playlist addresses
+// the input itself, which must be fragmented, by byte ranges.
+func hls(args []string) {
+	flags := commandFlags("hls")
+	input := flags.String("i", "", "input MP4")
+	output := flags.String("o", "", "output directory")
+	duration := flags.Float64("duration", 6, "target segment duration in seconds")
+	byterange := flags.Bool("byterange", false, "address segments of the fragmented input by byte ranges")
+	uri := flags.String("uri", "", "URI of the input in a -byterange playlist (default its file name)")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := *output
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	h, err := f.NewHLS(int64(*duration * 1e9))
+	var playlist string
+	if err == nil && *byterange {
+		if *uri == "" {
+			*uri = path.Base(*input)
+		}
+		playlist, err = h.ByteRangePlaylist(*uri)
+	} else if err == nil {
+		playlist = h.MediaPlaylist("init.mp4", "segment%d.m4s")
+	}
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = writeString(path.Join(dir, "master.m3u8"), h.MasterPlaylist("media.m3u8"))
+	}
+	if err == nil {
+		err = writeString(path.Join(dir, "media.m3u8"), playlist)
+	}
+	if err == nil && !*byterange {
+		err = writeString(path.Join(dir, "init.mp4"), string(h.Init()))
+		for i, segment := range h.Segments() {
+			if err != nil {
+				break
+			}
+			err = writeFile(path.Join(dir, fmt.Sprintf("segment%d.m4s", i)), func(w io.Writer) (os.Error) {
+				_, err := segment.WriteTo(w)
+				return err
+			})
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// writeFile creates the named file and fills it with write.
+func writeFile(name string, write func(w io.Writer) (os.Error)) (os.Error) {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = write(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeString creates the named file holding s.
+func writeString(name, s string) (os.Error) {
+	return writeFile(name, func(w io.Writer) (os.Error) {
+		_, err := io.WriteString(w, s)
+		return err
+	})
+}
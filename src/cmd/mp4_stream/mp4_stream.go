@@ -5,26 +5,138 @@ import (
 	"fmt"
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var inputFile string
+var outputFile string
+var trackList string
 var f mp4.File
 
 func init() {
 	flag.StringVar(&inputFile, "i", "", "-i input_file.mp4")
+	flag.StringVar(&outputFile, "o", "", "-o output_file.mp4 writes the selected tracks")
+	flag.StringVar(&trackList, "tracks", "", "-tracks 1,3 keeps only the tracks with these IDs")
+	flag.Usage = usage
 	flag.Parse()
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -i input_file.mp4 [-tracks 1,3 -o output_file.mp4]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [-tracks 1,3] command ...\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "       %s %s\n", os.Args[0], command)
+	}
+	flag.PrintDefaults()
+}
+
+// commands are the usage lines of the commands, less the program name.
+var commands = []string{
+	"serve [-root dir] [-addr :8080]",
+	"fragment [-duration seconds] -i input.mp4 -o output.mp4",
+	"defragment -i input.mp4 -o output.mp4",
+	"faststart -i input.mp4 -o output.mp4",
+	"hls [-duration seconds] [-byterange [-uri uri]] -i input.mp4 -o output_dir",
+	"dash [-duration seconds] -i input.mp4 -o output_dir",
+	"extract [-track id] -i input.mp4 -o output.h264",
+	"ts -i input.mp4 -o output.ts",
+	"flv -i input.mp4 -o output.flv",
+	"concat -o output.mp4 input1.mp4 input2.mp4 ...",
+	"split [-every duration] [-max-size size] -i input.mp4 -o part%03d.mp4",
+	"mux [-video input.h264] [-audio input.aac] [-fps rate] -o output.mp4",
+}
+
+// commandFlags returns the flags of the named command, which print its own
+// usage line from commands when they are misused.
+func commandFlags(name string) (*flag.FlagSet) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, command := range commands {
+			if strings.HasPrefix(command, name + " ") {
+				fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], command)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
 func main() {
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "serve":
+			serve(flag.Args()[1:])
+		case "fragment":
+			fragment(flag.Args()[1:])
+		case "defragment":
+			defragment(flag.Args()[1:])
+		case "faststart":
+			faststart(flag.Args()[1:])
+		case "hls":
+			hls(flag.Args()[1:])
+		case "dash":
+			dash(flag.Args()[1:])
+		case "extract":
+			extract(flag.Args()[1:])
+		case "ts":
+			ts(flag.Args()[1:])
+		case "flv":
+			flv(flag.Args()[1:])
+		case "concat":
+			concat(flag.Args()[1:])
+		case "split":
+			split(flag.Args()[1:])
+		case "mux":
+			mux(flag.Args()[1:])
+		default:
+			flag.Usage()
+		}
+		return
+	}
 	if inputFile == "" {
 		flag.Usage()
 		return
 	}
-	f, err := mp4.Open(inputFile)
+	f, err := openFile(inputFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 	defer f.Close()
 
+	if outputFile != "" {
+		out, err := os.Create(outputFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		defer out.Close()
+		// Rebuilding the mdat leaves out the data of dropped tracks
+		if err = f.Defragment(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// openFile opens an MP4, keeping only the tracks given by -tracks.
+func openFile(name string) (*mp4.File, os.Error) {
+	f, err := mp4.Open(name)
+	if err != nil || trackList == "" {
+		return f, err
+	}
+	var track_ids []uint32
+	for _, s := range strings.Split(trackList, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || id <= 0 {
+			f.Close()
+			return nil, os.NewError("Invalid track ID: " + s)
+		}
+		track_ids = append(track_ids, uint32(id))
+	}
+	if err = f.SelectTracks(track_ids); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mp4"
+	"os"
+)
+
+// mux writes raw H.264 and AAC streams into a progressive MP4.
+func mux(args []string) {
+	flags := commandFlags("mux")
+	video := flags.String("video", "", "input H.264 Annex B stream")
+	audio := flags.String("audio", "", "input AAC ADTS stream")
+	output := flags.String("o", "", "output MP4")
+	fps := flags.Float64("fps", 0, "video frame rate, if not given in the stream")
+	flags.Parse(args)
+	if *video == "" && *audio == "" || *output == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	m := new(mp4.Mux)
+	if *video != "" {
+		in, size := openStream(*video)
+		defer in.Close()
+		if err := m.AddH264(in, size, *fps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *audio != "" {
+		in, size := openStream(*audio)
+		defer in.Close()
+		if err := m.AddAAC(in, size); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err = m.WriteTo(w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// openStream opens an elementary stream and returns it with its size.
+func openStream(name string) (*os.File, int64) {
+	in, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return in, fi.Size
+}
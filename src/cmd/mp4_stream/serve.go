@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"mp4/httpstream"
+	"os"
+)
+
+// serve runs an HTTP server for the MP4 files beneath a directory.
+func serve(args []string) {
+	flags := commandFlags("serve")
+	root := flags.String("root", ".", "directory of MP4 files to serve")
+	addr := flags.String("addr", ":8080", "address to listen on")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fmt.Printf("Serving %v on %v\n", *root, *addr)
+	if err := http.ListenAndServe(*addr, httpstream.FileServer(*root)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// split cuts an MP4 into numbered parts by duration or size.
+func split(args []string) {
+	flags := commandFlags("split")
+	input := flags.String("i", "", "input MP4")
+	output := flags.String("o", "", "output file name with a part number, such as part%03d.mp4")
+	every := flags.String("every", "", "longest part duration, ending at the last keyframe within it, such as 90s, 10m or 1h")
+	max_size := flags.String("max-size", "", "largest part size, such as 500MB or 2GB")
+	flags.Parse(args)
+	if *input == "" || *output == "" || flags.NArg() > 0 || *every == "" && *max_size == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	pattern := *output
+	if !strings.Contains(pattern, "%") {
+		fmt.Fprintln(os.Stderr, "The output name needs a part number, such as part%03d.mp4")
+		os.Exit(2)
+	}
+
+	duration, size := int64(0), int64(0)
+	var err os.Error
+	if *every != "" {
+		duration, err = parseDuration(*every)
+	}
+	if err == nil && *max_size != "" {
+		size, err = parseSize(*max_size)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	f, err := openFile(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	parts, err := f.Split(duration, size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for i, part := range parts {
+		out, err := os.Create(fmt.Sprintf(pattern, i + 1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		w := bufio.NewWriter(out)
+		if _, err = part.WriteTo(w); err == nil {
+			err = w.Flush()
+		}
+		out.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// parseDuration parses a number of seconds, or of minutes or hours with an m
+// or h suffix, into nanoseconds.
+func parseDuration(s string) (int64, os.Error) {
+	unit := 1e9
+	switch {
+	case strings.HasSuffix(s, "h"):
+		unit = 3600e9
+	case strings.HasSuffix(s, "m"):
+		unit = 60e9
+	}
+	n, err := strconv.Atof64(strings.TrimRight(s, "hms"))
+	if err != nil || n <= 0 {
+		return 0, os.NewError("Invalid duration: " + s)
+	}
+	return int64(n * unit), nil
+}
+
+// parseSize parses a number of bytes with an optional suffix, as split(1)
+// does: KB, MB and GB are powers of 1000, and K, M and G powers of 1024.
+func parseSize(s string) (int64, os.Error) {
+	units := []struct {
+		suffix string
+		size int64
+	}{
+		{ "KB", 1e3 }, { "MB", 1e6 }, { "GB", 1e9 },
+		{ "K", 1 << 10 }, { "M", 1 << 20 }, { "G", 1 << 30 },
+	}
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = s[:len(s) - len(u.suffix)], u.size
+			break
+		}
+	}
+	n, err := strconv.Atoi64(s)
+	if err != nil || n <= 0 {
+		return 0, os.NewError("Invalid size: " + s)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,560 @@
+package mp4
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// A Clip is a time range of a File laid out as a new, self-contained MP4: a
+// rebuilt ftyp and moov followed by an mdat holding the matching bytes of the
+// original mdat.
+type Clip struct {
+	layout
+}
+
+// A layout is an MP4 built from a File: a head held in memory, ending with
+// an mdat header, followed by ranges of the original file making up the
+// mdat's data. The ranges may come from any io.ReaderAt, such as the raw
+// streams read by a Mux.
+type layout struct {
+	file io.ReaderAt
+	head []byte
+	ranges []dataRange
+}
+
+// A dataRange is a run of bytes in a file.
+type dataRange struct {
+	offset, size int64
+}
+
+// Clip writes the part of f between start and end, given in nanoseconds, to w
+// as a new MP4. See NewClip.
+func (f *File) Clip(start, end int64, w io.Writer) (os.Error) {
+	c, err := f.NewClip(start, end)
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(w)
+	return err
+}
+
+// NewClip prepares a clip of f from start to end, given in nanoseconds. The
+// start is moved back to the closest preceding sync sample so that playback
+// can begin with a keyframe. An end of 0 clips through to the end of f.
+func (f *File) NewClip(start, end int64) (c *Clip, err os.Error) {
+	if start < 0 || (end > 0 && end <= start) {
+		return nil, os.NewError("Invalid clip range")
+	}
+
+	// Snap the start back to a sync sample of the first track that has
+	// samples which are not
+	for _, trak := range f.moov.traks {
+		if trak.allSync() {
+			continue
+		}
+		timescale := trak.mdia.mdhd.timescale
+		i := trak.sampleAt(toTimescale(start, timescale))
+		if i >= len(trak.samples) {
+			return nil, os.NewError("Clip start is beyond the end of the file")
+		}
+		i = trak.syncSampleBefore(i)
+		start = fromTimescale(trak.samples[i].start_time, timescale)
+		break
+	}
+
+	mvhd := *f.moov.mvhd
+	mvhd.duration = 0
+	moov := &MoovBox{ Box: newBox("moov"), mvhd: &mvhd }
+	data_start, data_end := int64(-1), int64(0)
+	for _, trak := range f.moov.traks {
+		timescale := trak.mdia.mdhd.timescale
+		first := trak.sampleAt(toTimescale(start, timescale))
+		last := len(trak.samples)
+		if end > 0 {
+			if t := toTimescale(end, timescale); t > 0 {
+				last = trak.sampleAt(t - 1) + 1
+			}
+			if last > len(trak.samples) {
+				last = len(trak.samples)
+			}
+		}
+		if first > last {
+			first = last
+		}
+
+		clipped := trak.clip(first, last, mvhd.timescale)
+		if clipped.tkhd.duration > mvhd.duration {
+			mvhd.duration = clipped.tkhd.duration
+		}
+		moov.traks = append(moov.traks, clipped)
+
+		for _, offset := range clipped.mdia.minf.stbl.chunkOffsets() {
+			if data_start < 0 || int64(offset) < data_start {
+				data_start = int64(offset)
+			}
+		}
+		for _, sample := range trak.samples[first:last] {
+			if sample_end := int64(sample.offset) + int64(sample.size); sample_end > data_end {
+				data_end = sample_end
+			}
+		}
+	}
+	if data_start < 0 {
+		return nil, os.NewError("Clip contains no samples")
+	}
+
+	// The chunk offsets still point into the original file; move them to
+	// the new mdat
+	offsets := make([][]uint64, len(moov.traks))
+	for i, trak := range moov.traks {
+		offsets[i] = trak.mdia.minf.stbl.chunkOffsets()
+		for j, offset := range offsets[i] {
+			offsets[i][j] = uint64(int64(offset) - data_start)
+		}
+	}
+	c = &Clip{ layout{ file: f, ranges: []dataRange{ { data_start, data_end - data_start } } } }
+	c.layOut(f.ftyp, moov, offsets)
+	return c, nil
+}
+
+// layOut encodes the ftyp, the given moov and the header of an mdat holding
+// the layout's ranges into the head of the layout. See encodeHead.
+func (l *layout) layOut(ftyp *FtypBox, moov *MoovBox, offsets [][]uint64) {
+	data_size := int64(0)
+	for _, r := range l.ranges {
+		data_size += r.size
+	}
+	l.head = encodeHead(ftyp, moov, offsets, data_size)
+}
+
+// encodeHead returns the ftyp, the given moov and the header of an mdat of
+// data_size bytes. offsets holds the chunk offsets of each of the moov's
+// traks relative to the start of the mdat's data. Now that the size of the
+// moov can be known, they are made absolute, switching to co64 if they do
+// not fit in an stco. The size of the moov does not depend on the offsets
+// themselves since entries are fixed width.
+func encodeHead(ftyp_box *FtypBox, moov *MoovBox, offsets [][]uint64, data_size int64) ([]byte) {
+	mdat := makeBoxHeader("mdat", data_size)
+	for i, trak := range moov.traks {
+		trak.mdia.minf.stbl.setChunkOffsets(offsets[i], false)
+	}
+	ftyp := ftyp_box.encode()
+	head_size := int64(len(ftyp) + len(moov.encode()) + len(mdat))
+	large := head_size + data_size > 0xFFFFFFFF
+	if large {
+		for i, trak := range moov.traks {
+			trak.mdia.minf.stbl.setChunkOffsets(offsets[i], true)
+		}
+		head_size = int64(len(ftyp) + len(moov.encode()) + len(mdat))
+	}
+	for i, trak := range moov.traks {
+		for j, offset := range offsets[i] {
+			offsets[i][j] = offset + uint64(head_size)
+		}
+		trak.mdia.minf.stbl.setChunkOffsets(offsets[i], large)
+	}
+
+	head := append(ftyp, moov.encode()...)
+	return append(head, mdat...)
+}
+
+// Size returns the length in bytes of the MP4.
+func (l *layout) Size() (int64) {
+	size := int64(len(l.head))
+	for _, r := range l.ranges {
+		size += r.size
+	}
+	return size
+}
+
+// WriteTo writes the MP4 to w.
+func (l *layout) WriteTo(w io.Writer) (n int64, err os.Error) {
+	m, err := w.Write(l.head)
+	n = int64(m)
+	for _, r := range l.ranges {
+		if err != nil {
+			return n, err
+		}
+		var copied int64
+		copied, err = io.Copy(w, io.NewSectionReader(l.file, r.offset, r.size))
+		n += copied
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt over the MP4, so that it can be served in
+// ranges.
+func (l *layout) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off < int64(len(l.head)) {
+		n = copy(p, l.head[off:])
+	}
+	pos := int64(len(l.head))
+	for _, r := range l.ranges {
+		if n == len(p) {
+			return n, nil
+		}
+		if at := off + int64(n) - pos; at < r.size {
+			m, err := io.NewSectionReader(l.file, r.offset, r.size).ReadAt(p[n:], at)
+			n += m
+			if err != nil && err != os.EOF {
+				return n, err
+			}
+		}
+		pos += r.size
+	}
+	if n < len(p) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+// layouts are read one after the other as a single file.
+type layouts []*layout
+
+// Size returns the total length in bytes of the layouts.
+func (ls layouts) Size() (size int64) {
+	for _, l := range ls {
+		size += l.Size()
+	}
+	return size
+}
+
+// WriteTo writes the layouts to w in order.
+func (ls layouts) WriteTo(w io.Writer) (n int64, err os.Error) {
+	for _, l := range ls {
+		m, err := l.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt over the layouts.
+func (ls layouts) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	pos := int64(0)
+	for _, l := range ls {
+		if n == len(p) {
+			return n, nil
+		}
+		size := l.Size()
+		if at := off + int64(n) - pos; at < size {
+			m, err := l.ReadAt(p[n:], at)
+			n += m
+			if err != nil && err != os.EOF {
+				return n, err
+			}
+		}
+		pos += size
+	}
+	if n < len(p) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+// addSamples appends the data of the given samples to the layout's mdat.
+func (l *layout) addSamples(samples []Sample) {
+	for _, sample := range samples {
+		l.addRange(int64(sample.offset), int64(sample.size))
+	}
+}
+
+// addRange appends size bytes of the original file at offset to the
+// layout's mdat.
+func (l *layout) addRange(offset, size int64) {
+	n := len(l.ranges)
+	if n > 0 && l.ranges[n-1].offset + l.ranges[n-1].size == offset {
+		l.ranges[n-1].size += size
+		return
+	}
+	l.ranges = append(l.ranges, dataRange{ offset, size })
+}
+
+// clip returns a copy of the trak holding only samples first through last-1.
+// Chunk offsets in the copy still refer to the original file.
+func (t *TrakBox) clip(first, last int, movie_timescale uint32) (*TrakBox) {
+	stbl := t.mdia.minf.stbl
+	samples := t.samples[first:last]
+
+	stts := &SttsBox{ Box: newBox("stts") }
+	var ctts *CttsBox
+	if stbl.ctts != nil || t.hasCompositionOffsets() {
+		ctts = &CttsBox{ Box: newBox("ctts") }
+	}
+	stsz := &StszBox{
+		Box: newBox("stsz"),
+		sample_size: stbl.stsz.sample_size,
+		sample_count: uint32(len(samples)),
+	}
+	// Fragments may carry sizes other than the one given in stsz
+	for _, sample := range samples {
+		if sample.size != stsz.sample_size {
+			stsz.sample_size = 0
+			break
+		}
+	}
+	duration := uint64(0)
+	for _, sample := range samples {
+		stts.addSample(sample.duration)
+		if ctts != nil {
+			ctts.addSample(sample.cto)
+			// Negative offsets, as from a version 1 trun, need a version
+			// 1 ctts
+			if int32(sample.cto) < 0 {
+				ctts.version = 1
+			}
+		}
+		if stsz.sample_size == 0 {
+			stsz.entry_size = append(stsz.entry_size, sample.size)
+		}
+		duration += uint64(sample.duration)
+	}
+
+	var stss *StssBox
+	if !t.allSync() {
+		stss = &StssBox{ Box: newBox("stss") }
+		for i, sample := range samples {
+			if sample.sync {
+				stss.sample_number = append(stss.sample_number, uint32(i + 1))
+			}
+		}
+		stss.entry_count = uint32(len(stss.sample_number))
+	}
+
+	// Keep the original chunking, trimming the chunks at either end
+	stsc := &StscBox{ Box: newBox("stsc") }
+	var offsets []uint64
+	from, to := t.chunkRange(first, last)
+	for _, chunk := range t.chunks[from:to] {
+		chunk_first := int(chunk.start_sample) - 1
+		chunk_last := chunk_first + int(chunk.sample_count)
+		if chunk_first < first {
+			chunk_first = first
+		}
+		if chunk_last > last {
+			chunk_last = last
+		}
+		if chunk_first >= chunk_last {
+			continue
+		}
+		offsets = append(offsets, t.samples[chunk_first].offset)
+		stsc.addChunk(uint32(len(offsets)), uint32(chunk_last - chunk_first), chunk.sample_description_index)
+	}
+
+	clipped := t.rebuild(&StblBox{
+		Box: newBox("stbl"),
+		stts: stts,
+		ctts: ctts,
+		stss: stss,
+		stsc: stsc,
+		stsz: stsz,
+	}, duration, movie_timescale)
+	// NewClip moves these to an stco if they fit once the layout is known
+	clipped.mdia.minf.stbl.setChunkOffsets(offsets, true)
+	return clipped
+}
+
+// chunkRange returns the indexes of the first chunk of the trak holding any
+// of samples first through last-1, and of the chunk after the last one that
+// does. They are found by binary searches of the chunks, which are in order
+// of their first samples.
+func (t *TrakBox) chunkRange(first, last int) (from, to int) {
+	from = sort.Search(len(t.chunks), func(i int) bool {
+		return int(t.chunks[i].start_sample) - 1 + int(t.chunks[i].sample_count) > first
+	})
+	to = sort.Search(len(t.chunks), func(i int) bool {
+		return int(t.chunks[i].start_sample) - 1 >= last
+	})
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// rebuild returns a new trak with the headers and sample descriptions of t
+// and the given sample tables, lasting duration in the trak's timescale.
+func (t *TrakBox) rebuild(stbl *StblBox, duration uint64, movie_timescale uint32) (*TrakBox) {
+	stbl.stsd = t.mdia.minf.stbl.stsd
+	mdhd := *t.mdia.mdhd
+	mdhd.duration = duration
+	tkhd := *t.tkhd
+	tkhd.duration = duration * uint64(movie_timescale) / uint64(mdhd.timescale)
+
+	// Replace the edit list with a single edit covering the trak, keeping
+	// the media time of the first non-empty edit
+	var edts *EdtsBox
+	if t.edts != nil && t.edts.elst != nil {
+		media_time := t.mediaTime()
+		edts = &EdtsBox{
+			Box: newBox("edts"),
+			elst: &ElstBox{
+				Box: newBox("elst"),
+				entry_count: 1,
+				segment_duration: []uint64{ tkhd.duration },
+				media_time: []int64{ media_time },
+				media_rate_integer: []uint16{ 1 },
+				media_rate_fraction: []uint16{ 0 },
+			},
+		}
+	}
+
+	return &TrakBox{
+		Box: newBox("trak"),
+		tkhd: &tkhd,
+		edts: edts,
+		mdia: &MdiaBox{
+			Box: newBox("mdia"),
+			mdhd: &mdhd,
+			hdlr: t.mdia.hdlr,
+			minf: &MinfBox{
+				Box: newBox("minf"),
+				vmhd: t.mdia.minf.vmhd,
+				smhd: t.mdia.minf.smhd,
+				dinf: t.mdia.minf.dinf,
+				hdlr: t.mdia.minf.hdlr,
+				stbl: stbl,
+			},
+		},
+	}
+}
+
+// mediaTime returns the media time at which the trak's presentation starts
+// according to its first non-empty edit, usually the composition delay
+// introduced by B-frames, or 0 without an edit list.
+func (t *TrakBox) mediaTime() (int64) {
+	if t.edts == nil || t.edts.elst == nil {
+		return 0
+	}
+	for _, media_time := range t.edts.elst.media_time {
+		if media_time != -1 {
+			return media_time
+		}
+	}
+	return 0
+}
+
+// A timeIndex holds the decode time and first sample of every run of the
+// stts, so that samples can be found by time without walking them all.
+type timeIndex struct {
+	start_times []uint64
+	first_samples []int
+}
+
+// indexTimes indexes the trak's stts runs, unless they do not describe all
+// of its samples, as in fragmented files.
+func (t *TrakBox) indexTimes() {
+	stts := t.mdia.minf.stbl.stts
+	if stts == nil {
+		return
+	}
+	index := new(timeIndex)
+	start, first := uint64(0), 0
+	for i := 0; i < int(stts.entry_count); i++ {
+		index.start_times = append(index.start_times, start)
+		index.first_samples = append(index.first_samples, first)
+		start += uint64(stts.sample_count[i]) * uint64(stts.sample_delta[i])
+		first += int(stts.sample_count[i])
+	}
+	if first == len(t.samples) {
+		t.time_index = index
+	}
+}
+
+// sampleAt returns the index of the sample being decoded at time t, given in
+// the trak's timescale, or len(t.samples) if t is past the last sample. It
+// searches the stts runs, or the samples themselves if they are not indexed.
+func (t *TrakBox) sampleAt(ts uint64) (int) {
+	index := t.time_index
+	if index == nil {
+		return sort.Search(len(t.samples), func(i int) bool {
+			return t.samples[i].start_time + uint64(t.samples[i].duration) > ts
+		})
+	}
+
+	// The last run starting at or before ts
+	run := sort.Search(len(index.start_times), func(i int) bool {
+		return index.start_times[i] > ts
+	}) - 1
+	if run < 0 {
+		return 0
+	}
+	stts := t.mdia.minf.stbl.stts
+	end := index.first_samples[run] + int(stts.sample_count[run])
+	delta := uint64(stts.sample_delta[run])
+	if delta == 0 {
+		// No sample of the run is being decoded at any time
+		return end
+	}
+	if i := uint64(index.first_samples[run]) + (ts - index.start_times[run]) / delta; i < uint64(end) {
+		return int(i)
+	}
+	return end
+}
+
+// syncSampleBefore returns the index of the closest sync sample at or before
+// sample i, or 0 if there is none. It searches the stss, or the samples
+// themselves if their times are not indexed.
+func (t *TrakBox) syncSampleBefore(i int) (int) {
+	if t.time_index != nil {
+		stss := t.mdia.minf.stbl.stss
+		if stss == nil {
+			return i
+		}
+		n := sort.Search(len(stss.sample_number), func(j int) bool {
+			return int(stss.sample_number[j]) > i + 1
+		})
+		if n == 0 {
+			return 0
+		}
+		return int(stss.sample_number[n - 1]) - 1
+	}
+	for ; i > 0; i-- {
+		if t.samples[i].sync {
+			break
+		}
+	}
+	return i
+}
+
+// allSync reports whether every sample of the trak is a sync sample, which
+// its sample tables mark by having no stss. Fragmented traks, whose samples
+// are not all in the tables, have their sample flags checked instead.
+func (t *TrakBox) allSync() (bool) {
+	if t.time_index != nil {
+		return t.mdia.minf.stbl.stss == nil
+	}
+	for _, sample := range t.samples {
+		if !sample.sync {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCompositionOffsets reports whether the samples of the trak have
+// composition time offsets, given by a ctts in its sample tables, or by the
+// samples themselves in fragmented traks.
+func (t *TrakBox) hasCompositionOffsets() (bool) {
+	if t.time_index != nil {
+		return t.mdia.minf.stbl.ctts != nil
+	}
+	for _, sample := range t.samples {
+		if sample.cto != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// toTimescale converts ns nanoseconds to units of the given timescale.
+func toTimescale(ns int64, timescale uint32) (uint64) {
+	return uint64(ns / 1e9) * uint64(timescale) + uint64(ns % 1e9) * uint64(timescale) / 1e9
+}
+
+// fromTimescale converts t units of the given timescale to nanoseconds.
+func fromTimescale(t uint64, timescale uint32) (int64) {
+	return int64(t / uint64(timescale)) * 1e9 + int64(t % uint64(timescale)) * 1e9 / int64(timescale)
+}
@@ -0,0 +1,143 @@
+package mp4
+
+import (
+	"testing"
+)
+
+func TestClipKeepsSamples(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	c, err := f.NewClip(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipped := openWritten(t, c)
+	defer closeTemp(clipped)
+
+	for i, trak := range f.moov.traks {
+		checkSamples(t, clipped.moov.traks[i], trak, 0, len(trak.samples))
+	}
+}
+
+func TestClipSnapsToSyncSample(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	// 1.5s falls between the sync samples at 1s and 2s
+	c, err := f.NewClip(15e8, 25e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipped := openWritten(t, c)
+	defer closeTemp(clipped)
+
+	video, audio := clipped.moov.traks[0], clipped.moov.traks[1]
+	// Video samples being decoded from 1s up to 2.5s
+	checkSamples(t, video, f.moov.traks[0], 25, 38)
+	// Audio samples being decoded from 1s up to 2.5s
+	first := 44100 / fixtureAudioDelta
+	last := 110250 / fixtureAudioDelta + 1
+	checkSamples(t, audio, f.moov.traks[1], first, last - first)
+
+	if video.mdia.mdhd.duration != 38 * fixtureVideoDelta {
+		t.Errorf("Video mdhd duration is %v", video.mdia.mdhd.duration)
+	}
+	if media_time := video.edts.elst.media_time[0]; media_time != 1024 {
+		t.Errorf("Video edit starts at %v, want 1024", media_time)
+	}
+	if clipped.moov.mvhd.duration != 1520 {
+		t.Errorf("Movie duration is %v, want 1520", clipped.moov.mvhd.duration)
+	}
+}
+
+func TestClipInvalidRange(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	if _, err := f.NewClip(2e9, 1e9); err == nil {
+		t.Error("Clip ending before its start succeeded")
+	}
+	if _, err := f.NewClip(10e9, 0); err == nil {
+		t.Error("Clip starting past the end succeeded")
+	}
+}
+
+func TestSampleTableFlags(t *testing.T) {
+	for _, o := range []fixture{ {}, { frag: true } } {
+		f := openFixture(t, o)
+		defer closeTemp(f)
+		video, audio := f.moov.traks[0], f.moov.traks[1]
+		if video.allSync() || !audio.allSync() {
+			t.Errorf("%+v: allSync is %v and %v", o, video.allSync(), audio.allSync())
+		}
+		if !video.hasCompositionOffsets() || audio.hasCompositionOffsets() {
+			t.Errorf("%+v: hasCompositionOffsets is %v and %v", o, video.hasCompositionOffsets(), audio.hasCompositionOffsets())
+		}
+	}
+}
+
+func TestSampleSearch(t *testing.T) {
+	for _, o := range []fixture{ {}, { frag: true } } {
+		f := openFixture(t, o)
+		defer closeTemp(f)
+		for _, trak := range f.moov.traks {
+			timescale := trak.mdia.mdhd.timescale
+			end := trak.samples[len(trak.samples)-1].start_time + uint64(trak.samples[len(trak.samples)-1].duration)
+			for ts := uint64(0); ts <= end + 10; ts += 97 {
+				at, from := len(trak.samples), len(trak.samples)
+				for i := len(trak.samples) - 1; i >= 0; i-- {
+					s := trak.samples[i]
+					if s.start_time <= ts && ts < s.start_time + uint64(s.duration) {
+						at = i
+					}
+					if s.start_time >= ts {
+						from = i
+					}
+				}
+				if got := trak.sampleAt(ts); got != at {
+					t.Errorf("%+v: sampleAt(%v) is %v, want %v", o, ts, got, at)
+				}
+				if got := trak.sampleFrom(ts); got != from {
+					t.Errorf("%+v: sampleFrom(%v) is %v, want %v", o, ts, got, from)
+				}
+				// Times between the timescale's units start the sample after
+				ns := fromTimescale(ts, timescale) + 1
+				if from < len(trak.samples) && trak.samples[from].start_time == ts {
+					from++
+				}
+				if got := trak.samplesFrom(ns); got != from {
+					t.Errorf("%+v: samplesFrom(%v) is %v, want %v", o, ns, got, from)
+				}
+			}
+			for i := 0; i < len(trak.samples); i++ {
+				sync := i
+				for sync > 0 && !trak.samples[sync].sync {
+					sync--
+				}
+				if got := trak.syncSampleBefore(i); got != sync {
+					t.Errorf("%+v: syncSampleBefore(%v) is %v, want %v", o, i, got, sync)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkRange(t *testing.T) {
+	for _, o := range []fixture{ {}, { frag: true } } {
+		f := openFixture(t, o)
+		defer closeTemp(f)
+		for _, trak := range f.moov.traks {
+			n := len(trak.samples)
+			for _, r := range [][2]int{ { 0, n }, { 0, 1 }, { 10, 40 }, { n - 1, n }, { 30, 30 } } {
+				first, last := r[0], r[1]
+				from, to := trak.chunkRange(first, last)
+				for i, chunk := range trak.chunks {
+					start := int(chunk.start_sample) - 1
+					in := start < last && start + int(chunk.sample_count) > first
+					if in != (i >= from && i < to) {
+						t.Errorf("%+v: chunk %v of samples %v+%v is not in [%v, %v) for samples [%v, %v)",
+							o, i, start, chunk.sample_count, from, to, first, last)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Codec returns the RFC 6381 codecs parameter describing the trak's first
+// sample entry, such as "avc1.64001f" or "mp4a.40.2", as used in HLS and
+// DASH manifests and Media Source Extensions.
+func (b *TrakBox) Codec() (string) {
+	switch entry := b.sampleEntry().(type) {
+	case nil:
+		return ""
+	case *VisualSampleEntry:
+		return entry.codec()
+	case *AudioSampleEntry:
+		return entry.codec()
+	}
+	return b.Format()
+}
+
+func (b *VisualSampleEntry) codec() (string) {
+	switch {
+	case b.avcc != nil:
+		return fmt.Sprintf("%s.%02x%02x%02x", b.Name(), b.avcc.profile, b.avcc.profile_compatibility, b.avcc.level)
+	case b.hvcc != nil:
+		return b.Name() + "." + b.hvcc.codec()
+	case b.av1c != nil:
+		return b.av1c.codec()
+	case b.vpcc != nil:
+		return fmt.Sprintf("%s.%02d.%02d.%02d", b.Name(), b.vpcc.profile, b.vpcc.level, b.vpcc.bit_depth)
+	case b.esds != nil:
+		return b.esds.codec(b.Name())
+	}
+	return b.Name()
+}
+
+func (b *AudioSampleEntry) codec() (string) {
+	if b.esds != nil {
+		return b.esds.codec(b.Name())
+	}
+	switch b.Name() {
+	case "Opus":
+		return "opus"
+	case "fLaC":
+		return "flac"
+	}
+	return b.Name()
+}
+
+// AvccBox holds an H.264 AVCDecoderConfigurationRecord.
+type AvccBox struct {
+	*Box
+	configuration_version, profile, profile_compatibility, level uint8
+	length_size int // Size in bytes of the NAL unit lengths in samples
+	sps, pps [][]byte
+	ext []byte // Extra fields of the high profiles
+}
+
+func (b *AvccBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 7 {
+		return os.NewError("avcC box too short")
+	}
+	b.configuration_version = data[0]
+	b.profile = data[1]
+	b.profile_compatibility = data[2]
+	b.level = data[3]
+	b.length_size = int(data[4] & 0x3) + 1
+	i := 6
+	for j := 0; j < int(data[5] & 0x1F); j++ {
+		var nalu []byte
+		if nalu, i, err = readParameterSet(data, i); err != nil {
+			return err
+		}
+		b.sps = append(b.sps, nalu)
+	}
+	if i >= len(data) {
+		return os.NewError("avcC box too short")
+	}
+	n_pps := int(data[i])
+	i++
+	for j := 0; j < n_pps; j++ {
+		var nalu []byte
+		if nalu, i, err = readParameterSet(data, i); err != nil {
+			return err
+		}
+		b.pps = append(b.pps, nalu)
+	}
+	b.ext = data[i:]
+	return nil
+}
+
+func (b *AvccBox) encode() []byte {
+	data := []byte{
+		b.configuration_version, b.profile, b.profile_compatibility, b.level,
+		0xFC | byte(b.length_size - 1), 0xE0 | byte(len(b.sps)),
+	}
+	for _, nalu := range b.sps {
+		data = append(putUint16(data, uint16(len(nalu))), nalu...)
+	}
+	data = append(data, byte(len(b.pps)))
+	for _, nalu := range b.pps {
+		data = append(putUint16(data, uint16(len(nalu))), nalu...)
+	}
+	data = append(data, b.ext...)
+	return makeBox("avcC", data)
+}
+
+// Profile returns the AVC profile_idc.
+func (b *AvccBox) Profile() (int) { return int(b.profile) }
+
+// Level returns the AVC level_idc.
+func (b *AvccBox) Level() (int) { return int(b.level) }
+
+// NALULengthSize returns the size in bytes of the length preceding each NAL
+// unit in a sample.
+func (b *AvccBox) NALULengthSize() (int) { return b.length_size }
+
+// SPS returns the sequence parameter set NAL units.
+func (b *AvccBox) SPS() ([][]byte) { return b.sps }
+
+// PPS returns the picture parameter set NAL units.
+func (b *AvccBox) PPS() ([][]byte) { return b.pps }
+
+// readParameterSet reads a NAL unit preceded by a 16-bit length at data[i:],
+// returning it and the index following it.
+func readParameterSet(data []byte, i int) ([]byte, int, os.Error) {
+	if i + 2 > len(data) {
+		return nil, i, os.NewError("Parameter set truncated")
+	}
+	n := int(binary.BigEndian.Uint16(data[i:i+2]))
+	if i + 2 + n > len(data) {
+		return nil, i, os.NewError("Parameter set truncated")
+	}
+	return data[i+2:i+2+n], i + 2 + n, nil
+}
+
+// HvccBox holds an H.265 HEVCDecoderConfigurationRecord.
+type HvccBox struct {
+	*Box
+	header []byte // The 22 bytes of profile, tier, level and format fields
+	arrays []hvccArray
+	ext []byte
+}
+
+// An hvccArray holds the parameter set NAL units of one type.
+type hvccArray struct {
+	nal_unit_type byte // Including the array_completeness bit
+	nalus [][]byte
+}
+
+func (b *HvccBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 23 {
+		return os.NewError("hvcC box too short")
+	}
+	b.header = data[0:22]
+	n_arrays := int(data[22])
+	i := 23
+	for j := 0; j < n_arrays; j++ {
+		if i + 3 > len(data) {
+			return os.NewError("hvcC box too short")
+		}
+		array := hvccArray{ nal_unit_type: data[i] }
+		n_nalus := int(binary.BigEndian.Uint16(data[i+1:i+3]))
+		i += 3
+		for k := 0; k < n_nalus; k++ {
+			var nalu []byte
+			if nalu, i, err = readParameterSet(data, i); err != nil {
+				return err
+			}
+			array.nalus = append(array.nalus, nalu)
+		}
+		b.arrays = append(b.arrays, array)
+	}
+	b.ext = data[i:]
+	return nil
+}
+
+func (b *HvccBox) encode() []byte {
+	data := append([]byte(nil), b.header...)
+	data = append(data, byte(len(b.arrays)))
+	for _, array := range b.arrays {
+		data = append(data, array.nal_unit_type)
+		data = putUint16(data, uint16(len(array.nalus)))
+		for _, nalu := range array.nalus {
+			data = append(putUint16(data, uint16(len(nalu))), nalu...)
+		}
+	}
+	data = append(data, b.ext...)
+	return makeBox("hvcC", data)
+}
+
+// NALULengthSize returns the size in bytes of the length preceding each NAL
+// unit in a sample.
+func (b *HvccBox) NALULengthSize() (int) { return int(b.header[21] & 0x3) + 1 }
+
+// ParameterSets returns the VPS, SPS, PPS and SEI NAL units in the order
+// they are stored.
+func (b *HvccBox) ParameterSets() (nalus [][]byte) {
+	for _, array := range b.arrays {
+		nalus = append(nalus, array.nalus...)
+	}
+	return nalus
+}
+
+// codec returns the profile, tier and level part of the codecs parameter,
+// following ISO/IEC 14496-15 Annex E.
+func (b *HvccBox) codec() (string) {
+	h := b.header
+	s := ""
+	if space := h[1] >> 6; space > 0 {
+		s = string([]byte{ 'A' + space - 1 })
+	}
+	// The compatibility flags are written in reverse bit order
+	compat, reversed := binary.BigEndian.Uint32(h[2:6]), uint32(0)
+	for i := 0; i < 32; i++ {
+		reversed = reversed << 1 | (compat >> uint(i)) & 1
+	}
+	tier := "L"
+	if h[1] & 0x20 != 0 {
+		tier = "H"
+	}
+	s += fmt.Sprintf("%d.%X.%s%d", h[1] & 0x1F, reversed, tier, h[12])
+	// Trailing zero constraint bytes are omitted
+	constraints := h[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		s += fmt.Sprintf(".%X", c)
+	}
+	return s
+}
+
+// Av1cBox holds an AV1CodecConfigurationRecord.
+type Av1cBox struct {
+	*Box
+	data []byte
+}
+
+func (b *Av1cBox) parse() (err os.Error) {
+	b.data = b.ReadBoxData()
+	if len(b.data) < 4 {
+		return os.NewError("av1C box too short")
+	}
+	return nil
+}
+
+func (b *Av1cBox) encode() []byte {
+	return makeBox("av1C", b.data)
+}
+
+// Profile returns the AV1 seq_profile.
+func (b *Av1cBox) Profile() (int) { return int(b.data[1] >> 5) }
+
+// Level returns the AV1 seq_level_idx_0.
+func (b *Av1cBox) Level() (int) { return int(b.data[1] & 0x1F) }
+
+// BitDepth returns the bit depth of the video.
+func (b *Av1cBox) BitDepth() (int) {
+	switch {
+	case b.data[2] & 0x40 == 0:
+		return 8
+	case b.data[2] & 0x20 == 0:
+		return 10
+	}
+	return 12
+}
+
+// ConfigOBUs returns the sequence header and metadata OBUs, if any.
+func (b *Av1cBox) ConfigOBUs() ([]byte) { return b.data[4:] }
+
+func (b *Av1cBox) codec() (string) {
+	tier := "M"
+	if b.data[2] & 0x80 != 0 {
+		tier = "H"
+	}
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", b.Profile(), b.Level(), tier, b.BitDepth())
+}
+
+// VpccBox holds a VPCodecConfigurationRecord.
+type VpccBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	profile, level, bit_depth uint8
+	data []byte
+}
+
+func (b *VpccBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 7 {
+		return os.NewError("vpcC box too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.data = data[4:]
+	b.profile = b.data[0]
+	b.level = b.data[1]
+	b.bit_depth = b.data[2] >> 4
+	return nil
+}
+
+func (b *VpccBox) encode() []byte {
+	return makeFullBox("vpcC", b.version, b.flags, b.data)
+}
+
+// Profile returns the VP9 profile.
+func (b *VpccBox) Profile() (int) { return int(b.profile) }
+
+// Level returns the VP9 level.
+func (b *VpccBox) Level() (int) { return int(b.level) }
+
+// BitDepth returns the bit depth of the video.
+func (b *VpccBox) BitDepth() (int) { return int(b.bit_depth) }
+
+// MPEG-4 descriptor tags found in esds
+const (
+	ES_DESCRIPTOR_TAG = 0x03
+	DECODER_CONFIG_DESCRIPTOR_TAG = 0x04
+	DECODER_SPECIFIC_INFO_TAG = 0x05
+	SL_CONFIG_DESCRIPTOR_TAG = 0x06
+)
+
+// EsdsBox holds an MPEG-4 ES_Descriptor and the DecoderConfigDescriptor
+// within it.
+type EsdsBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	descriptor []byte // The ES_Descriptor as stored
+	es_id uint16
+	object_type_indication, stream_type uint8
+	buffer_size_db, max_bitrate, avg_bitrate uint32
+	decoder_specific_info []byte
+}
+
+func (b *EsdsBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 4 {
+		return os.NewError("esds box too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.descriptor = data[4:]
+
+	tag, es, _, err := readDescriptor(b.descriptor)
+	if err != nil {
+		return err
+	}
+	if tag != ES_DESCRIPTOR_TAG || len(es) < 3 {
+		return os.NewError("esds box does not hold an ES_Descriptor")
+	}
+	b.es_id = binary.BigEndian.Uint16(es[0:2])
+	es_flags := es[2]
+	es = es[3:]
+	if es_flags & 0x80 != 0 && len(es) >= 2 {
+		// Skip dependsOn_ES_ID
+		es = es[2:]
+	}
+	if es_flags & 0x40 != 0 && len(es) >= 1 && len(es) >= 1 + int(es[0]) {
+		// Skip the URL
+		es = es[1+int(es[0]):]
+	}
+	if es_flags & 0x20 != 0 && len(es) >= 2 {
+		// Skip OCR_ES_Id
+		es = es[2:]
+	}
+	for len(es) > 0 {
+		var payload []byte
+		tag, payload, es, err = readDescriptor(es)
+		if err != nil {
+			return err
+		}
+		if tag == DECODER_CONFIG_DESCRIPTOR_TAG {
+			if err = b.parseDecoderConfig(payload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *EsdsBox) parseDecoderConfig(data []byte) (err os.Error) {
+	if len(data) < 13 {
+		return os.NewError("DecoderConfigDescriptor too short")
+	}
+	b.object_type_indication = data[0]
+	b.stream_type = data[1] >> 2
+	b.buffer_size_db = uint32(data[2]) << 16 | uint32(data[3]) << 8 | uint32(data[4])
+	b.max_bitrate = binary.BigEndian.Uint32(data[5:9])
+	b.avg_bitrate = binary.BigEndian.Uint32(data[9:13])
+	for rest := data[13:]; len(rest) > 0; {
+		var tag byte
+		var payload []byte
+		tag, payload, rest, err = readDescriptor(rest)
+		if err != nil {
+			return err
+		}
+		if tag == DECODER_SPECIFIC_INFO_TAG {
+			b.decoder_specific_info = payload
+		}
+	}
+	return nil
+}
+
+func (b *EsdsBox) encode() []byte {
+	return makeFullBox("esds", b.version, b.flags, b.descriptor)
+}
+
+// ObjectTypeIndication returns the MPEG-4 object type, such as 0x40 for
+// MPEG-4 audio (AAC).
+func (b *EsdsBox) ObjectTypeIndication() (int) { return int(b.object_type_indication) }
+
+// MaxBitrate returns the peak bitrate of the stream in bits per second.
+func (b *EsdsBox) MaxBitrate() (int) { return int(b.max_bitrate) }
+
+// AvgBitrate returns the average bitrate of the stream in bits per second.
+func (b *EsdsBox) AvgBitrate() (int) { return int(b.avg_bitrate) }
+
+// DecoderSpecificInfo returns the decoder configuration, which for AAC is
+// the AudioSpecificConfig.
+func (b *EsdsBox) DecoderSpecificInfo() ([]byte) { return b.decoder_specific_info }
+
+// codec returns the codecs parameter for a sample entry of the given
+// format holding this esds.
+func (b *EsdsBox) codec(format string) (string) {
+	s := fmt.Sprintf("%s.%02X", format, b.object_type_indication)
+	dsi := b.decoder_specific_info
+	switch b.object_type_indication {
+	case 0x40:
+		// MPEG-4 audio: add the audio object type
+		if config, err := parseAudioSpecificConfig(dsi); err == nil {
+			s += fmt.Sprintf(".%d", config.object_type)
+		}
+	case 0x20:
+		// MPEG-4 visual: add the profile and level from the
+		// visual_object_sequence_start_code header
+		if len(dsi) > 4 && dsi[0] == 0 && dsi[1] == 0 && dsi[2] == 1 && dsi[3] == 0xB0 {
+			s += fmt.Sprintf(".%d", dsi[4])
+		}
+	}
+	return s
+}
+
+// readDescriptor reads the MPEG-4 descriptor at the start of data, returning
+// its tag, its payload and the data following it.
+func readDescriptor(data []byte) (tag byte, payload, rest []byte, err os.Error) {
+	if len(data) < 2 {
+		return 0, nil, nil, os.NewError("Descriptor truncated")
+	}
+	tag = data[0]
+	// The size is stored 7 bits per byte in up to 4 bytes, with the high
+	// bit set on all but the last
+	size, i := 0, 1
+	for {
+		if i >= len(data) || i > 4 {
+			return 0, nil, nil, os.NewError("Invalid descriptor size")
+		}
+		c := data[i]
+		i++
+		size = size << 7 | int(c & 0x7F)
+		if c & 0x80 == 0 {
+			break
+		}
+	}
+	if i + size > len(data) {
+		return 0, nil, nil, os.NewError("Descriptor truncated")
+	}
+	return tag, data[i:i+size], data[i+size:], nil
+}
+
+// makeDescriptor prepends an MPEG-4 descriptor tag and size to payload, the
+// reverse of readDescriptor.
+func makeDescriptor(tag byte, payload []byte) ([]byte) {
+	size := []byte{ byte(len(payload) & 0x7F) }
+	for n := len(payload) >> 7; n > 0; n >>= 7 {
+		size = append([]byte{ byte(n & 0x7F) | 0x80 }, size...)
+	}
+	return append(append([]byte{ tag }, size...), payload...)
+}
+
+// Sample rates of the AAC sampling frequency indexes
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// audioSpecificConfig holds the leading fields of an MPEG-4 audio
+// AudioSpecificConfig.
+type audioSpecificConfig struct {
+	object_type, sampling_index, sample_rate, channels int
+}
+
+func parseAudioSpecificConfig(data []byte) (c audioSpecificConfig, err os.Error) {
+	r := &bitReader{ data: data }
+	c.object_type = int(r.read(5))
+	if c.object_type == 31 {
+		c.object_type = 32 + int(r.read(6))
+	}
+	c.sampling_index = int(r.read(4))
+	if c.sampling_index == 0xF {
+		c.sample_rate = int(r.read(24))
+	} else if c.sampling_index < len(aacSampleRates) {
+		c.sample_rate = aacSampleRates[c.sampling_index]
+	}
+	c.channels = int(r.read(4))
+	if r.err != nil {
+		return c, os.NewError("AudioSpecificConfig truncated")
+	}
+	return c, nil
+}
+
+// A bitReader reads big-endian bit fields from a byte slice. Reading past the
+// end sets err and returns zeros.
+type bitReader struct {
+	data []byte
+	pos int // In bits
+	err os.Error
+}
+
+func (r *bitReader) read(n int) (v uint32) {
+	for i := 0; i < n; i++ {
+		if r.pos >= 8 * len(r.data) {
+			r.err = os.EOF
+			return 0
+		}
+		v = v << 1 | uint32(r.data[r.pos / 8] >> uint(7 - r.pos % 8)) & 1
+		r.pos++
+	}
+	return v
+}
+
+// readUE reads an unsigned Exp-Golomb code, as used in H.264 and H.265
+// headers.
+func (r *bitReader) readUE() (uint32) {
+	zeros := 0
+	for r.read(1) == 0 {
+		if r.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = os.NewError("Invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return 1 << uint(zeros) - 1 + r.read(zeros)
+}
+
+// readSE reads a signed Exp-Golomb code.
+func (r *bitReader) readSE() (int32) {
+	v := r.readUE()
+	if v & 1 == 1 {
+		return int32(v / 2) + 1
+	}
+	return -int32(v / 2)
+}
@@ -0,0 +1,105 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	// Main profile, level 3.1
+	testHvcc = tbox("hvcC", []byte{ 1, 0x01, 0x60, 0, 0, 0, 0xB0, 0, 0, 0, 0, 0, 93,
+		0xF0, 0, 0xFC, 0xFD, 0xF8, 0xF8, 0, 0, 0x0F },
+		[]byte{ 1, 0x20 | 0x80 }, tu16(1), tu16(4), []byte{ 0x40, 0x01, 0x0c, 0x01 })
+	// Main profile, level 3.0, 8 bits
+	testAv1c = tbox("av1C", []byte{ 0x81, 0x04, 0x0C, 0 })
+	// Profile 0, level 3.1, 8 bits
+	testVpcc = tfull("vpcC", 1, 0, []byte{ 0, 31, 0x80, 1, 1, 1, 0, 0 })
+)
+
+var codecTests = []struct {
+	video, audio []byte
+	video_codec, audio_codec string
+}{
+	{ nil, nil, "avc1.64001f", "mp4a.40.2" },
+	{ visualEntry("hvc1", testHvcc), nil, "hvc1.1.6.L93.B0", "mp4a.40.2" },
+	{ visualEntry("av01", testAv1c), tbox("Opus", make([]byte, 6), tu16(1), make([]byte, 8), tu16(2), tu16(16), tu32(0), tu32(48000 << 16)),
+		"av01.0.04M.08", "opus" },
+	{ visualEntry("vp09", testVpcc), nil, "vp09.00.31.08", "mp4a.40.2" },
+}
+
+func TestCodecs(t *testing.T) {
+	for _, test := range codecTests {
+		data := fixture{ video_entry: test.video, audio_entry: test.audio }.build()
+		f := openBytes(t, data)
+		defer closeTemp(f)
+		if codec := f.moov.traks[0].Codec(); codec != test.video_codec {
+			t.Errorf("Video codec is %q, want %q", codec, test.video_codec)
+		}
+		if codec := f.moov.traks[1].Codec(); codec != test.audio_codec {
+			t.Errorf("Audio codec is %q, want %q", codec, test.audio_codec)
+		}
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%v: writing changed the bytes", test.video_codec)
+		}
+	}
+}
+
+func TestConfigurationRecords(t *testing.T) {
+	f := openBytes(t, fixture{ video_entry: visualEntry("hvc1", testHvcc) }.build())
+	defer closeTemp(f)
+	hvcc := f.moov.traks[0].sampleEntry().(*VisualSampleEntry).HEVCConfig()
+	if hvcc.NALULengthSize() != 4 || len(hvcc.ParameterSets()) != 1 {
+		t.Errorf("hvcC is %+v", hvcc)
+	}
+
+	f = openFixture(t, fixture{})
+	defer closeTemp(f)
+	avcc := f.moov.traks[0].sampleEntry().(*VisualSampleEntry).AVCConfig()
+	if avcc.Profile() != 100 || avcc.Level() != 31 || avcc.NALULengthSize() != 4 {
+		t.Errorf("avcC is %+v", avcc)
+	}
+	if len(avcc.SPS()) != 1 || !bytes.Equal(avcc.SPS()[0], fixtureSPS) || len(avcc.PPS()) != 1 || !bytes.Equal(avcc.PPS()[0], fixturePPS) {
+		t.Errorf("avcC parameter sets are %x %x", avcc.SPS(), avcc.PPS())
+	}
+	esds := f.moov.traks[1].sampleEntry().(*AudioSampleEntry).ESDescriptor()
+	if esds.ObjectTypeIndication() != 0x40 || esds.AvgBitrate() != 128000 || !bytes.Equal(esds.DecoderSpecificInfo(), fixtureASC) {
+		t.Errorf("esds is %+v", esds)
+	}
+}
+
+func TestAudioSpecificConfig(t *testing.T) {
+	c, err := parseAudioSpecificConfig(fixtureASC)
+	if err != nil || c.object_type != 2 || c.sample_rate != 44100 || c.channels != 2 {
+		t.Errorf("AudioSpecificConfig is %+v, %v", c, err)
+	}
+	// HE-AAC signalled with an escaped object type
+	c, err = parseAudioSpecificConfig([]byte{ 0xF8, 0x0C, 0x20 })
+	if err != nil || c.object_type != 32 || c.sample_rate != 24000 {
+		t.Errorf("Escaped AudioSpecificConfig is %+v, %v", c, err)
+	}
+	if _, err = parseAudioSpecificConfig([]byte{ 0x12 }); err == nil {
+		t.Error("Truncated AudioSpecificConfig parsed")
+	}
+}
+
+func TestDescriptors(t *testing.T) {
+	for _, n := range []int{ 0, 5, 127, 128, 300, 20000 } {
+		payload := make([]byte, n)
+		d := makeDescriptor(4, payload)
+		tag, got, rest, err := readDescriptor(append(d, 0xAA))
+		if err != nil || tag != 4 || len(got) != n || !bytes.Equal(rest, []byte{ 0xAA }) {
+			t.Errorf("Descriptor of %v bytes read as %v, %v bytes, %x, %v", n, tag, len(got), rest, err)
+		}
+	}
+	// Some encoders pad sizes to 4 bytes
+	if _, got, _, err := readDescriptor([]byte{ 5, 0x80, 0x80, 0x80, 2, 0x12, 0x10 }); err != nil || !bytes.Equal(got, fixtureASC) {
+		t.Errorf("Padded descriptor read as %x, %v", got, err)
+	}
+	if _, _, _, err := readDescriptor([]byte{ 5, 10, 0 }); err == nil {
+		t.Error("Truncated descriptor read")
+	}
+}
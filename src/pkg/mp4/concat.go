@@ -0,0 +1,151 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A Concatenation is several Files joined one after the other into a single
+// progressive MP4: a moov with the traks of the first file, holding the
+// samples of every file in turn, followed by an mdat gathering their data.
+type Concatenation struct {
+	layouts
+}
+
+// Concat writes files to w one after the other as a single MP4. See
+// NewConcat.
+func Concat(files []*File, w io.Writer) (os.Error) {
+	c, err := NewConcat(files)
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(w)
+	return err
+}
+
+// NewConcat prepares the concatenation of files, such as the pieces of a
+// recording. Every file must have the same traks as the first, matched by
+// track ID, with the same timescales and sample descriptions, so that one
+// stsd describes the samples of all of them. The samples of each file start
+// where the previous file ends according to its mdhd, and the chunks of each
+// file are kept in the order of their data.
+func NewConcat(files []*File) (c *Concatenation, err os.Error) {
+	if len(files) == 0 {
+		return nil, os.NewError("No files to concatenate")
+	}
+	first := files[0]
+	mvhd := *first.moov.mvhd
+	mvhd.duration = 0
+	moov := &MoovBox{ Box: newBox("moov"), mvhd: &mvhd, udta: first.moov.udta }
+
+	// Merged copies of the first file's traks, holding the samples and
+	// chunks of every file. Sample offsets still refer to their own files.
+	merged := make([]*TrakBox, len(first.moov.traks))
+	ends := make([]uint64, len(merged)) // End of each trak so far, by mdhd
+	for i, trak := range first.moov.traks {
+		t := *trak
+		t.samples, t.chunks, t.time_index = nil, nil, nil
+		merged[i] = &t
+	}
+
+	c = new(Concatenation)
+	offsets := make([][]uint64, len(merged))
+	data_size := int64(0)
+	for n, f := range files {
+		if len(f.moov.traks) != len(merged) {
+			return nil, os.NewError(fmt.Sprintf("File %v has %v tracks instead of %v", n + 1, len(f.moov.traks), len(merged)))
+		}
+		var chunks []*chunkData
+		for i, t := range merged {
+			trak := f.moov.trak(t.tkhd.track_id)
+			if err = checkConcatenable(t, trak); err != nil {
+				return nil, os.NewError(fmt.Sprintf("File %v: %v", n + 1, err))
+			}
+
+			// Stretch the last sample so far to meet the end given by the
+			// mdhd, which may hold more than the sample durations
+			start := ends[i]
+			if count := len(t.samples); count > 0 {
+				last := &t.samples[count - 1]
+				if end := last.start_time + uint64(last.duration); end < start {
+					last.duration += uint32(start - end)
+				} else
+				{
+					start = end
+				}
+			}
+			first_sample := len(t.samples)
+			for _, sample := range trak.samples {
+				sample.start_time += start
+				t.samples = append(t.samples, sample)
+			}
+			duration := trak.mdia.mdhd.duration
+			if count := len(trak.samples); count > 0 {
+				last := trak.samples[count - 1]
+				if end := last.start_time + uint64(last.duration); end > duration {
+					duration = end
+				}
+			}
+			ends[i] = start + duration
+
+			// Chunks without samples are dropped by clip
+			for _, chunk := range trak.chunks {
+				if chunk.sample_count == 0 {
+					continue
+				}
+				chunk.start_sample += uint32(first_sample)
+				t.chunks = append(t.chunks, chunk)
+				size := int64(0)
+				for _, sample := range t.samples[chunk.start_sample - 1:chunk.start_sample - 1 + chunk.sample_count] {
+					size += int64(sample.size)
+				}
+				chunks = append(chunks, &chunkData{ trak: i, index: len(t.chunks) - 1, offset: int64(chunk.offset), size: size })
+			}
+			offsets[i] = append(offsets[i], make([]uint64, len(t.chunks) - len(offsets[i]))...)
+		}
+
+		sort.Sort(chunksByOffset(chunks))
+		l := &layout{ file: f }
+		for _, chunk := range chunks {
+			offsets[chunk.trak][chunk.index] = uint64(data_size)
+			l.addRange(chunk.offset, chunk.size)
+			data_size += chunk.size
+		}
+		c.layouts = append(c.layouts, l)
+	}
+	if data_size == 0 {
+		return nil, os.NewError("Files contain no samples")
+	}
+
+	for _, t := range merged {
+		flat := t.clip(0, len(t.samples), mvhd.timescale)
+		if flat.tkhd.duration > mvhd.duration {
+			mvhd.duration = flat.tkhd.duration
+		}
+		moov.traks = append(moov.traks, flat)
+	}
+	head := &layout{ head: encodeHead(first.ftyp, moov, offsets, data_size) }
+	c.layouts = append(layouts{ head }, c.layouts...)
+	return c, nil
+}
+
+// checkConcatenable returns an error unless the samples of other can follow
+// those of t in the same trak.
+func checkConcatenable(t, other *TrakBox) (os.Error) {
+	id := t.tkhd.track_id
+	if other == nil {
+		return os.NewError(fmt.Sprintf("No track with ID %v", id))
+	}
+	if other.mdia.hdlr.handler_type != t.mdia.hdlr.handler_type {
+		return os.NewError(fmt.Sprintf("Track %v is %v rather than %v", id, other.mdia.hdlr.handler_type, t.mdia.hdlr.handler_type))
+	}
+	if other.mdia.mdhd.timescale != t.mdia.mdhd.timescale {
+		return os.NewError(fmt.Sprintf("Track %v has timescale %v rather than %v", id, other.mdia.mdhd.timescale, t.mdia.mdhd.timescale))
+	}
+	if string(other.mdia.minf.stbl.stsd.encode()) != string(t.mdia.minf.stbl.stsd.encode()) {
+		return os.NewError(fmt.Sprintf("Track %v has different codec parameters", id))
+	}
+	return nil
+}
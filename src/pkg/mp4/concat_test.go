@@ -0,0 +1,78 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConcat(t *testing.T) {
+	first := openFixture(t, fixture{})
+	defer closeTemp(first)
+	second := openFixture(t, fixture{ co64: true, moov_last: true })
+	defer closeTemp(second)
+	// The audio mdhd lasts longer than its samples, so the second file's
+	// audio starts after a gap
+	gap := uint64(1000)
+	first.moov.traks[1].mdia.mdhd.duration += gap
+
+	buf := new(bytes.Buffer)
+	if err := Concat([]*File{ first, second }, buf); err != nil {
+		t.Fatal(err)
+	}
+	f := openBytes(t, buf.Bytes())
+	defer closeTemp(f)
+	if len(f.moov.traks) != 2 {
+		t.Fatalf("%v traks", len(f.moov.traks))
+	}
+	for i, trak := range f.moov.traks {
+		want := first.moov.traks[i]
+		n := len(want.samples)
+		if len(trak.samples) != 2 * n {
+			t.Fatalf("Track %v has %v samples, want %v", i + 1, len(trak.samples), 2 * n)
+		}
+		head, tail := *trak, *trak
+		head.samples, tail.samples = trak.samples[:n-1], trak.samples[n:]
+		checkSamples(t, &head, want, 0, n - 1)
+		checkSamples(t, &tail, second.moov.traks[i], 0, n)
+
+		// The second file starts where the first ends by its mdhd, the last
+		// sample before it stretched to meet it
+		end := want.mdia.mdhd.duration
+		if start := tail.samples[0].start_time; start != end {
+			t.Errorf("Track %v: second file starts at %v, want %v", i + 1, start, end)
+		}
+		last := trak.samples[n-1]
+		if last.size != want.samples[n-1].size || last.start_time + uint64(last.duration) != end {
+			t.Errorf("Track %v: first file ends at %v", i + 1, last.start_time + uint64(last.duration))
+		}
+		if trak.mdia.mdhd.duration != 2 * end - gap * uint64(i) {
+			t.Errorf("Track %v lasts %v", i + 1, trak.mdia.mdhd.duration)
+		}
+	}
+	if f.Duration() < 2 * first.Duration() {
+		t.Errorf("Concatenation lasts %v, each file %v", f.Duration(), first.Duration())
+	}
+}
+
+func TestConcatMismatch(t *testing.T) {
+	first := openFixture(t, fixture{})
+	defer closeTemp(first)
+	if _, err := NewConcat(nil); err == nil {
+		t.Error("Concatenated no files")
+	}
+	changes := []func(f *File){
+		func(f *File) { f.SelectTracks([]uint32{ 1 }) },
+		func(f *File) { f.moov.traks[1].tkhd.track_id = 3 },
+		func(f *File) { f.moov.traks[1].mdia.hdlr.handler_type = "text" },
+		func(f *File) { f.moov.traks[0].mdia.mdhd.timescale = 25 },
+		func(f *File) { f.moov.traks[0].sampleEntry().(*VisualSampleEntry).width = 1280 },
+	}
+	for i, change := range changes {
+		second := openFixture(t, fixture{})
+		change(second)
+		if _, err := NewConcat([]*File{ first, second }); err == nil {
+			t.Errorf("Concatenated a file with change %v", i)
+		}
+		closeTemp(second)
+	}
+}
@@ -0,0 +1,266 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"os"
+)
+
+// A DASH presentation of a File for the on-demand profile: every trak in a
+// fragmented file of its own, indexed by a sidx, and an MPD describing them.
+type DASH struct {
+	file *File
+	representations []*Representation
+	longest int64 // Duration of the longest fragment
+}
+
+// A Representation is the fragmented file holding one trak of a DASH
+// presentation: an init segment, a sidx indexing the fragments, and the
+// fragments.
+type Representation struct {
+	layouts
+	trak *TrakBox
+	init_size, index_size int64
+	bandwidth int64
+}
+
+// NewDASH cuts every trak of f into fragments of about the given duration
+// in nanoseconds. The fragments of all traks start at the same times.
+func (f *File) NewDASH(duration int64) (d *DASH, err os.Error) {
+	d = &DASH{ file: f }
+	for _, trak := range f.moov.traks {
+		fragments, err := f.fragments([]*TrakBox{ trak }, duration)
+		if err != nil {
+			return nil, err
+		}
+		if len(fragments) == 0 {
+			continue
+		}
+		init := f.initSegment([]*TrakBox{ trak })
+		index, err := trak.sidx(fragments)
+		if err != nil {
+			return nil, err
+		}
+		sidx := index.encode()
+		r := &Representation{
+			layouts: layouts{ &layout{ file: f, head: append(init, sidx...) } },
+			trak: trak,
+			init_size: int64(len(init)),
+			index_size: int64(len(sidx)),
+		}
+		for _, fragment := range fragments {
+			r.layouts = append(r.layouts, &fragment.layout)
+			if fragment.duration > d.longest {
+				d.longest = fragment.duration
+			}
+			if fragment.duration > 0 {
+				if b := fragment.Size() * 8 * 1e9 / fragment.duration; b > r.bandwidth {
+					r.bandwidth = b
+				}
+			}
+		}
+		d.representations = append(d.representations, r)
+	}
+	if len(d.representations) == 0 {
+		return nil, os.NewError("File contains no samples")
+	}
+	return d, nil
+}
+
+// Representations returns the representations, one for each trak with
+// samples.
+func (d *DASH) Representations() ([]*Representation) {
+	return d.representations
+}
+
+// TrackID returns the ID of the trak held by the representation.
+func (r *Representation) TrackID() (uint32) {
+	return r.trak.tkhd.track_id
+}
+
+// MPD returns the media presentation description. The file of each
+// representation is at the URI made by formatting uri_pattern with its
+// track ID, e.g. "track%d.mp4".
+func (d *DASH) MPD(uri_pattern string) (string) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintf(buf, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-on-demand:2011" type="static" mediaPresentationDuration="%v" minBufferTime="%v">`+"\n",
+		mpdDuration(d.file.Duration()), mpdDuration(d.longest))
+	fmt.Fprintln(buf, `  <Period start="PT0S">`)
+	for _, r := range d.representations {
+		trak := r.trak
+		mime_type := "application/mp4"
+		switch trak.HandlerType() {
+		case "vide":
+			mime_type = "video/mp4"
+		case "soun":
+			mime_type = "audio/mp4"
+		}
+		fmt.Fprintf(buf, `    <AdaptationSet mimeType="%v" segmentAlignment="true" startWithSAP="1">`+"\n", mime_type)
+		fmt.Fprintf(buf, `      <Representation id="%v" bandwidth="%v"`, r.TrackID(), r.bandwidth)
+		if codec := trak.Codec(); codec != "" {
+			fmt.Fprintf(buf, ` codecs="%v"`, html.EscapeString(codec))
+		}
+		var audio *AudioSampleEntry
+		switch entry := trak.sampleEntry().(type) {
+		case *VisualSampleEntry:
+			fmt.Fprintf(buf, ` width="%v" height="%v"`, trak.Width(), trak.Height())
+			if len(trak.samples) > 0 && trak.samples[0].duration > 0 {
+				fmt.Fprintf(buf, ` frameRate="%v/%v"`, trak.mdia.mdhd.timescale, trak.samples[0].duration)
+			}
+		case *AudioSampleEntry:
+			audio = entry
+			fmt.Fprintf(buf, ` audioSamplingRate="%v"`, entry.SampleRate())
+		}
+		fmt.Fprintln(buf, ">")
+		if audio != nil {
+			fmt.Fprintf(buf, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%v"/>`+"\n", audio.ChannelCount())
+		}
+		fmt.Fprintf(buf, "        <BaseURL>%v</BaseURL>\n", html.EscapeString(fmt.Sprintf(uri_pattern, r.TrackID())))
+		fmt.Fprintf(buf, `        <SegmentBase indexRange="%v-%v">`+"\n", r.init_size, r.init_size + r.index_size - 1)
+		fmt.Fprintf(buf, `          <Initialization range="0-%v"/>`+"\n", r.init_size - 1)
+		fmt.Fprintln(buf, "        </SegmentBase>")
+		fmt.Fprintln(buf, "      </Representation>")
+		fmt.Fprintln(buf, "    </AdaptationSet>")
+	}
+	fmt.Fprintln(buf, "  </Period>")
+	fmt.Fprintln(buf, "</MPD>")
+	return buf.String()
+}
+
+// mpdDuration formats ns nanoseconds as an xs:duration.
+func mpdDuration(ns int64) (string) {
+	return fmt.Sprintf("PT%.3fS", float64(ns) / 1e9)
+}
+
+// sidx returns a segment index of the given fragments of the trak, to be
+// placed just before the first of them. Fragments must be smaller than 2GB,
+// the most a sidx can reference.
+func (t *TrakBox) sidx(fragments []*Fragment) (*SidxBox, os.Error) {
+	sidx := &SidxBox{
+		Box: newBox("sidx"),
+		reference_id: t.tkhd.track_id,
+		timescale: t.mdia.mdhd.timescale,
+	}
+	earliest := int64(0)
+	for i, fragment := range fragments {
+		if fragment.Size() >= 1 << 31 {
+			return nil, os.NewError(fmt.Sprintf("Fragment %v of track %v is too large to index: %v bytes", i, t.tkhd.track_id, fragment.Size()))
+		}
+		duration := uint64(0)
+		for j, traf := range fragment.moof.trafs {
+			decode_time := traf.tfdt.base_media_decode_time
+			for _, trun := range traf.truns {
+				for k, d := range trun.sample_duration {
+					// The earliest presentation time is that of the
+					// first sample to be shown. Offsets are signed in
+					// version 1 truns.
+					pt := int64(decode_time)
+					if len(trun.sample_cto) > 0 {
+						pt += int64(int32(trun.sample_cto[k]))
+					}
+					if i == 0 && ((j == 0 && k == 0) || pt < earliest) {
+						earliest = pt
+					}
+					decode_time += uint64(d)
+					duration += uint64(d)
+				}
+			}
+		}
+		sidx.reference_type = append(sidx.reference_type, 0)
+		sidx.referenced_size = append(sidx.referenced_size, uint32(fragment.Size()))
+		sidx.subsegment_duration = append(sidx.subsegment_duration, uint32(duration))
+		sidx.starts_with_sap = append(sidx.starts_with_sap, true)
+		sidx.sap_type = append(sidx.sap_type, 1)
+		sidx.sap_delta_time = append(sidx.sap_delta_time, 0)
+	}
+	sidx.reference_count = uint16(len(fragments))
+
+	// Presentation starts at the media time of the edit list, which skips
+	// the composition delay
+	if earliest -= t.mediaTime(); earliest > 0 {
+		sidx.earliest_presentation_time = uint64(earliest)
+	}
+	return sidx, nil
+}
+
+type SidxBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	reference_id, timescale uint32
+	earliest_presentation_time, first_offset uint64
+	reference_count uint16
+	reference_type []uint8 // 1 for a reference to another sidx
+	referenced_size []uint32
+	subsegment_duration []uint32
+	starts_with_sap []bool
+	sap_type []uint8
+	sap_delta_time []uint32
+}
+
+func (b *SidxBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 12 {
+		return os.NewError("sidx box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.reference_id = binary.BigEndian.Uint32(data[4:8])
+	b.timescale = binary.BigEndian.Uint32(data[8:12])
+	if b.version == 1 {
+		if len(data) < 32 {
+			return os.NewError("sidx box is too short")
+		}
+		b.earliest_presentation_time = binary.BigEndian.Uint64(data[12:20])
+		b.first_offset = binary.BigEndian.Uint64(data[20:28])
+		data = data[28:]
+	} else
+	{
+		if len(data) < 24 {
+			return os.NewError("sidx box is too short")
+		}
+		b.earliest_presentation_time = uint64(binary.BigEndian.Uint32(data[12:16]))
+		b.first_offset = uint64(binary.BigEndian.Uint32(data[16:20]))
+		data = data[20:]
+	}
+	// Skip 2 bytes for reserved space (uint16)
+	b.reference_count = binary.BigEndian.Uint16(data[2:4])
+	data = data[4:]
+	if len(data) < 12 * int(b.reference_count) {
+		return os.NewError("sidx box is too short")
+	}
+	for i := 0; i < int(b.reference_count); i++ {
+		reference := binary.BigEndian.Uint32(data[12*i:12*i+4])
+		sap := binary.BigEndian.Uint32(data[12*i+8:12*i+12])
+		b.reference_type = append(b.reference_type, uint8(reference >> 31))
+		b.referenced_size = append(b.referenced_size, reference & 0x7FFFFFFF)
+		b.subsegment_duration = append(b.subsegment_duration, binary.BigEndian.Uint32(data[12*i+4:12*i+8]))
+		b.starts_with_sap = append(b.starts_with_sap, sap >> 31 == 1)
+		b.sap_type = append(b.sap_type, uint8(sap >> 28) & 0x7)
+		b.sap_delta_time = append(b.sap_delta_time, sap & 0x0FFFFFFF)
+	}
+	return nil
+}
+
+func (b *SidxBox) encode() []byte {
+	version := headerVersion(b.version, b.earliest_presentation_time, b.first_offset)
+	data := putUint32(nil, b.reference_id)
+	data = putUint32(data, b.timescale)
+	data = putTime(data, b.earliest_presentation_time, version)
+	data = putTime(data, b.first_offset, version)
+	data = putUint16(data, 0)
+	data = putUint16(data, b.reference_count)
+	for i := 0; i < int(b.reference_count); i++ {
+		data = putUint32(data, uint32(b.reference_type[i]) << 31 | b.referenced_size[i])
+		data = putUint32(data, b.subsegment_duration[i])
+		sap := uint32(b.sap_type[i]) << 28 | b.sap_delta_time[i]
+		if b.starts_with_sap[i] {
+			sap |= 1 << 31
+		}
+		data = putUint32(data, sap)
+	}
+	return makeFullBox("sidx", version, b.flags, data)
+}
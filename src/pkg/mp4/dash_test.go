@@ -0,0 +1,111 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDASHRepresentations(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	d, err := f.NewDASH(1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Representations()) != 2 {
+		t.Fatalf("%v representations, want 2", len(d.Representations()))
+	}
+	for i, r := range d.Representations() {
+		rep := openWritten(t, r)
+		defer closeTemp(rep)
+		if rep.size != r.Size() || len(rep.sidxs) != 1 || len(rep.moov.traks) != 1 {
+			t.Fatalf("Representation %v has %v sidx and %v traks", i, len(rep.sidxs), len(rep.moov.traks))
+		}
+		checkSamples(t, rep.moov.traks[0], f.moov.traks[i], 0, len(f.moov.traks[i].samples))
+
+		// The sidx indexes every fragment that follows it
+		sidx := rep.sidxs[0]
+		if sidx.reference_count != 3 || sidx.reference_id != r.TrackID() || sidx.timescale != f.moov.traks[i].mdia.mdhd.timescale {
+			t.Errorf("sidx is %+v", sidx)
+		}
+		offset := sidx.Start() + sidx.Size()
+		for j, size := range sidx.referenced_size {
+			if offset != rep.moofs[j].Start() {
+				t.Errorf("Reference %v is at %v rather than at its moof", j, offset)
+			}
+			offset += int64(size)
+		}
+		if offset != rep.size {
+			t.Errorf("References end at %v of %v bytes", offset, rep.size)
+		}
+		if r.init_size != sidx.Start() {
+			t.Errorf("Init segment is %v bytes, sidx starts at %v", r.init_size, sidx.Start())
+		}
+		if !bytes.Equal(sidx.encode(), rep.ReadBytesAt(sidx.Size(), sidx.Start())) {
+			t.Error("sidx encodes to different bytes")
+		}
+	}
+
+	mpd := d.MPD("track%d.mp4")
+	for _, want := range []string{
+		`mediaPresentationDuration="PT3.000S"`,
+		`codecs="avc1.64001f" width="640" height="360" frameRate="12800/512"`,
+		`codecs="mp4a.40.2" audioSamplingRate="44100"`,
+		"<BaseURL>track1.mp4</BaseURL>",
+		fmt.Sprintf(`<SegmentBase indexRange="%v-%v">`, d.Representations()[1].init_size, d.Representations()[1].init_size + d.Representations()[1].index_size - 1),
+	} {
+		if !strings.Contains(mpd, want) {
+			t.Errorf("MPD lacks %v:\n%v", want, mpd)
+		}
+	}
+}
+
+func TestSidxEditList(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	video := f.moov.traks[0]
+	// The first sample is presented at 512
+	for _, test := range []struct{ media_time int64; ept uint64 }{ { 0, 512 }, { 256, 256 }, { 512, 0 }, { 1024, 0 } } {
+		video.edts.elst.media_time[0] = test.media_time
+		fragments, err := f.fragments([]*TrakBox{ video }, 1e9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sidx, err := video.sidx(fragments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ept := sidx.earliest_presentation_time; ept != test.ept {
+			t.Errorf("Edit at %v: earliest presentation time %v, want %v", test.media_time, ept, test.ept)
+		}
+	}
+}
+
+func TestSidxNegativeOffsets(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	video := f.moov.traks[0]
+	video.edts.elst.media_time[0] = 0
+	// The first sample is presented before its decoding time
+	negative := int32(-256)
+	video.samples[0].cto = uint32(negative)
+	fragments, err := f.fragments([]*TrakBox{ video }, 1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidx, err := video.sidx(fragments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ept := sidx.earliest_presentation_time; ept != 0 {
+		t.Errorf("Earliest presentation time is %v, want 0", ept)
+	}
+
+	// Fragments of 2GB or more do not fit
+	fragments[1].ranges = append(fragments[1].ranges, dataRange{ 0, 1 << 31 })
+	if _, err = video.sidx(fragments); err == nil {
+		t.Error("Indexed a fragment of over 2GB")
+	}
+}
@@ -0,0 +1,85 @@
+package mp4
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// Defragment writes f to w as a progressive MP4 with a single mdat. See
+// NewDefragment.
+func (f *File) Defragment(w io.Writer) (os.Error) {
+	c, err := f.NewDefragment()
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(w)
+	return err
+}
+
+// NewDefragment prepares a progressive copy of f, typically a fragmented
+// file. The samples of every trak, wherever they came from, are described by
+// full sample tables in the moov and their data is gathered into one mdat,
+// keeping the original chunks and their interleaving. Progressive files can
+// be flattened too, which drops anything in their mdat that is not sample
+// data.
+func (f *File) NewDefragment() (c *Clip, err os.Error) {
+	mvhd := *f.moov.mvhd
+	mvhd.duration = 0
+	moov := &MoovBox{ Box: newBox("moov"), mvhd: &mvhd, udta: f.moov.udta }
+
+	// Collect the chunks of every trak in the order of their data
+	var chunks []*chunkData
+	for i, trak := range f.moov.traks {
+		flat := trak.clip(0, len(trak.samples), mvhd.timescale)
+		if flat.tkhd.duration > mvhd.duration {
+			mvhd.duration = flat.tkhd.duration
+		}
+		moov.traks = append(moov.traks, flat)
+
+		// Chunks without samples are dropped by clip
+		n := 0
+		for _, chunk := range trak.chunks {
+			if chunk.sample_count == 0 {
+				continue
+			}
+			first := int(chunk.start_sample) - 1
+			size := int64(0)
+			for _, sample := range trak.samples[first:first + int(chunk.sample_count)] {
+				size += int64(sample.size)
+			}
+			chunks = append(chunks, &chunkData{ trak: i, index: n, offset: int64(chunk.offset), size: size })
+			n++
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, os.NewError("File contains no samples")
+	}
+	sort.Sort(chunksByOffset(chunks))
+
+	c = &Clip{ layout{ file: f } }
+	offsets := make([][]uint64, len(moov.traks))
+	for i, trak := range moov.traks {
+		offsets[i] = trak.mdia.minf.stbl.chunkOffsets()
+	}
+	data_size := int64(0)
+	for _, chunk := range chunks {
+		offsets[chunk.trak][chunk.index] = uint64(data_size)
+		c.addRange(chunk.offset, chunk.size)
+		data_size += chunk.size
+	}
+	c.layOut(f.ftyp, moov, offsets)
+	return c, nil
+}
+
+// chunkData locates the data of a chunk of one of a file's traks.
+type chunkData struct {
+	trak, index int // Index of the trak, and of the chunk within the trak
+	offset, size int64
+}
+
+type chunksByOffset []*chunkData
+
+func (c chunksByOffset) Len() int { return len(c) }
+func (c chunksByOffset) Less(i, j int) bool { return c[i].offset < c[j].offset }
+func (c chunksByOffset) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
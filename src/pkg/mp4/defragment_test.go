@@ -0,0 +1,100 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDefragmentRoundTrip(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	f := openFixture(t, fixture{ frag: true })
+	defer closeTemp(f)
+
+	var buf bytes.Buffer
+	if err := f.Defragment(&buf); err != nil {
+		t.Fatal(err)
+	}
+	flat := openBytes(t, buf.Bytes())
+	defer closeTemp(flat)
+	if len(flat.moofs) != 0 || flat.moov.mvex != nil {
+		t.Error("Defragmented file is still fragmented")
+	}
+	for i, trak := range plain.moov.traks {
+		checkSamples(t, flat.moov.traks[i], trak, 0, len(trak.samples))
+		if got, want := len(flat.moov.traks[i].chunks), len(trak.chunks); got != want {
+			t.Errorf("Track %v has %v chunks, want %v", i, got, want)
+		}
+	}
+	if flat.moov.mvhd.duration != 3000 {
+		t.Errorf("Movie duration is %v", flat.moov.mvhd.duration)
+	}
+
+	// Flattening the progressive original lays out the same file
+	var plain_buf bytes.Buffer
+	if err := plain.Defragment(&plain_buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain_buf.Bytes(), buf.Bytes()) {
+		t.Error("Defragmenting differs from flattening the original")
+	}
+}
+
+func TestFragmentDefragment(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	var fragmented bytes.Buffer
+	if err := f.Fragment(1e9, &fragmented); err != nil {
+		t.Fatal(err)
+	}
+	frag := openBytes(t, fragmented.Bytes())
+	defer closeTemp(frag)
+	c, err := frag.NewDefragment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := openWritten(t, c)
+	defer closeTemp(flat)
+	for i, trak := range f.moov.traks {
+		checkSamples(t, flat.moov.traks[i], trak, 0, len(trak.samples))
+	}
+}
+
+func TestDefragmentNegativeCompositionOffsets(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	negative := int32(-512)
+	f.moov.traks[0].samples[1].cto = uint32(negative)
+	var fragmented bytes.Buffer
+	if err := f.Fragment(1e9, &fragmented); err != nil {
+		t.Fatal(err)
+	}
+	frag := openBytes(t, fragmented.Bytes())
+	defer closeTemp(frag)
+
+	var buf bytes.Buffer
+	if err := frag.Defragment(&buf); err != nil {
+		t.Fatal(err)
+	}
+	flat := openBytes(t, buf.Bytes())
+	defer closeTemp(flat)
+	video := flat.moov.traks[0]
+	if ctts := video.mdia.minf.stbl.ctts; ctts == nil || ctts.version != 1 {
+		t.Fatal("ctts with a negative offset is not version 1")
+	}
+	checkSamples(t, video, f.moov.traks[0], 0, len(f.moov.traks[0].samples))
+	if cto := int32(video.samples[1].cto); cto != negative {
+		t.Errorf("Offset is %v, want %v", cto, negative)
+	}
+
+	// A clip after the negative offset keeps a version 0 ctts
+	c, err := f.NewClip(1e9, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipped := openWritten(t, c)
+	defer closeTemp(clipped)
+	if ctts := clipped.moov.traks[0].mdia.minf.stbl.ctts; ctts == nil || ctts.version != 0 {
+		t.Error("ctts without negative offsets is not version 0")
+	}
+}
@@ -0,0 +1,190 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ANNEXB_START_CODE precedes every NAL unit in an Annex B byte stream.
+var ANNEXB_START_CODE = []byte{ 0, 0, 0, 1 }
+
+// H.264 and H.265 NAL unit types
+const (
+	AVC_NAL_IDR = 5
+	AVC_NAL_SPS = 7
+	HEVC_NAL_IRAP_FIRST = 16 // BLA, IDR and CRA pictures
+	HEVC_NAL_IRAP_LAST = 23
+	HEVC_NAL_VPS = 32
+)
+
+// ADTS_HEADER_SIZE is the size of an ADTS header without CRC.
+const ADTS_HEADER_SIZE = 7
+
+// ExtractTrack writes the samples of the trak with the given track ID to w
+// as a raw elementary stream. H.264 and H.265 video becomes an Annex B byte
+// stream, with the parameter sets from the avcC or hvcC repeated before
+// every IDR picture. AAC audio becomes a stream of ADTS frames.
+func (f *File) ExtractTrack(track_id uint32, w io.Writer) (os.Error) {
+	trak := f.moov.trak(track_id)
+	if trak == nil {
+		return os.NewError(fmt.Sprintf("No track with ID %v", track_id))
+	}
+
+	convert, err := trak.elementaryStream()
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range trak.samples {
+		data := f.ReadBytesAt(int64(sample.size), int64(sample.offset))
+		if data == nil {
+			return os.NewError("Sample data could not be read")
+		}
+		data, err = convert(data)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elementaryStream returns a function converting the trak's samples to the
+// elementary stream written by ExtractTrack.
+func (t *TrakBox) elementaryStream() (func(sample []byte) ([]byte, os.Error), os.Error) {
+	var convert func(sample []byte) ([]byte, os.Error)
+	switch entry := t.sampleEntry().(type) {
+	case *VisualSampleEntry:
+		if avcc := entry.AVCConfig(); avcc != nil {
+			params := append(append([][]byte(nil), avcc.SPS()...), avcc.PPS()...)
+			convert = func(sample []byte) ([]byte, os.Error) {
+				return toAnnexB(sample, avcc.NALULengthSize(), params, isAVCKeyframe)
+			}
+		} else if hvcc := entry.HEVCConfig(); hvcc != nil {
+			params := hvcc.ParameterSets()
+			convert = func(sample []byte) ([]byte, os.Error) {
+				return toAnnexB(sample, hvcc.NALULengthSize(), params, isHEVCKeyframe)
+			}
+		}
+	case *AudioSampleEntry:
+		if esds := entry.ESDescriptor(); esds != nil {
+			header, err := adtsHeader(esds)
+			if err != nil {
+				return nil, err
+			}
+			convert = func(sample []byte) ([]byte, os.Error) {
+				return toADTS(header, sample)
+			}
+		}
+	}
+	if convert == nil {
+		return nil, os.NewError(fmt.Sprintf("Cannot convert %v samples to an elementary stream", t.Format()))
+	}
+	return convert, nil
+}
+
+// toAnnexB converts a sample of NAL units, each preceded by its length in
+// length_size bytes, to start code prefixed NAL units. The parameter sets
+// are inserted before the first keyframe NAL unit unless the sample carries
+// its own.
+func toAnnexB(sample []byte, length_size int, params [][]byte, keyframe func(nalu []byte) (bool, bool)) ([]byte, os.Error) {
+	var nalus [][]byte
+	has_params := false
+	for i := 0; i < len(sample); {
+		if i + length_size > len(sample) {
+			return nil, os.NewError("Truncated NAL unit length")
+		}
+		n := 0
+		for _, b := range sample[i:i+length_size] {
+			n = n << 8 | int(b)
+		}
+		i += length_size
+		if n > len(sample) - i {
+			return nil, os.NewError("NAL unit extends past the end of its sample")
+		}
+		nalus = append(nalus, sample[i:i+n])
+		if _, is_params := keyframe(sample[i:i+n]); is_params {
+			has_params = true
+		}
+		i += n
+	}
+
+	out := make([]byte, 0, len(sample) + 64)
+	for _, nalu := range nalus {
+		if is_keyframe, _ := keyframe(nalu); is_keyframe && !has_params {
+			for _, param := range params {
+				out = append(append(out, ANNEXB_START_CODE...), param...)
+			}
+			has_params = true
+		}
+		out = append(append(out, ANNEXB_START_CODE...), nalu...)
+	}
+	return out, nil
+}
+
+// isAVCKeyframe reports whether an H.264 NAL unit is a slice of an IDR
+// picture, and whether it is a sequence parameter set.
+func isAVCKeyframe(nalu []byte) (bool, bool) {
+	if len(nalu) == 0 {
+		return false, false
+	}
+	t := nalu[0] & 0x1F
+	return t == AVC_NAL_IDR, t == AVC_NAL_SPS
+}
+
+// isHEVCKeyframe reports whether an H.265 NAL unit is a slice of an IRAP
+// picture, and whether it is a video parameter set.
+func isHEVCKeyframe(nalu []byte) (bool, bool) {
+	if len(nalu) == 0 {
+		return false, false
+	}
+	t := nalu[0] >> 1 & 0x3F
+	return t >= HEVC_NAL_IRAP_FIRST && t <= HEVC_NAL_IRAP_LAST, t == HEVC_NAL_VPS
+}
+
+// adtsHeader returns the ADTS header for the AAC stream described by esds,
+// with the frame length left as 0.
+func adtsHeader(esds *EsdsBox) ([]byte, os.Error) {
+	if esds.object_type_indication != 0x40 {
+		return nil, os.NewError(fmt.Sprintf("Cannot write object type 0x%02x as ADTS", esds.object_type_indication))
+	}
+	c, err := parseAudioSpecificConfig(esds.DecoderSpecificInfo())
+	if err != nil {
+		return nil, err
+	}
+	// The two bit profile only covers AAC Main, LC, SSR and LTP
+	if c.object_type < 1 || c.object_type > 4 {
+		return nil, os.NewError(fmt.Sprintf("Cannot write audio object type %v as ADTS", c.object_type))
+	}
+	if c.sampling_index == 0xF {
+		return nil, os.NewError("Cannot write an explicit sample rate as ADTS")
+	}
+	profile := byte(c.object_type - 1)
+	channels := byte(c.channels)
+	return []byte{
+		0xFF,
+		0xF1, // MPEG-4, layer 0, no CRC
+		profile << 6 | byte(c.sampling_index) << 2 | channels >> 2,
+		channels << 6,
+		0,
+		0x1F, // Buffer fullness 0x7FF: variable bitrate
+		0xFC,
+	}, nil
+}
+
+// toADTS prefixes an AAC frame with header, filled in with its length.
+func toADTS(header, frame []byte) ([]byte, os.Error) {
+	n := ADTS_HEADER_SIZE + len(frame)
+	if n >= 1 << 13 {
+		return nil, os.NewError("AAC frame too large for ADTS")
+	}
+	out := make([]byte, ADTS_HEADER_SIZE, n)
+	copy(out, header)
+	out[3] |= byte(n >> 11)
+	out[4] = byte(n >> 3)
+	out[5] |= byte(n << 5)
+	return append(out, frame...), nil
+}
@@ -0,0 +1,142 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtractH264(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	buf := new(bytes.Buffer)
+	if err := f.ExtractTrack(1, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Length prefixes become start codes, with the parameter sets ahead of
+	// every IDR picture
+	var want []byte
+	for i := 0; i < fixtureVideoSamples; i++ {
+		if videoSync(i) {
+			want = append(append(want, 0, 0, 0, 1), fixtureSPS...)
+			want = append(append(want, 0, 0, 0, 1), fixturePPS...)
+		}
+		want = append(append(want, 0, 0, 0, 1), videoSample(i)[4:]...)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Annex B stream of %v bytes, want %v", buf.Len(), len(want))
+	}
+}
+
+func TestExtractAAC(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	buf := new(bytes.Buffer)
+	if err := f.ExtractTrack(2, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// AAC LC at 44.1 kHz in stereo, the frame length counting the header
+	var want []byte
+	for i := 0; i < fixtureAudioSamples; i++ {
+		frame := audioSample(i)
+		n := ADTS_HEADER_SIZE + len(frame)
+		want = append(want, 0xFF, 0xF1, 0x50, 0x80 | byte(n >> 11), byte(n >> 3), byte(n << 5) | 0x1F, 0xFC)
+		want = append(want, frame...)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("ADTS stream of %v bytes, want %v", buf.Len(), len(want))
+	}
+
+	if f.ExtractTrack(3, buf) == nil {
+		t.Error("Extracted a missing track")
+	}
+}
+
+func TestToAnnexB(t *testing.T) {
+	params := [][]byte{ { 0x67, 1 }, { 0x68, 2 } }
+	tests := []struct {
+		sample []byte
+		length_size int
+		want []byte
+	}{
+		// A slice, then an IDR slice which gets the parameter sets
+		{ []byte{ 0, 2, 0x41, 9, 0, 1, 0x65 }, 2, []byte{ 0, 0, 0, 1, 0x41, 9, 0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2, 0, 0, 0, 1, 0x65 } },
+		// An IDR picture carrying its own SPS
+		{ []byte{ 1, 0x67, 1, 0x65 }, 1, []byte{ 0, 0, 0, 1, 0x67, 0, 0, 0, 1, 0x65 } },
+		{ []byte{}, 4, []byte{} },
+	}
+	for _, test := range tests {
+		got, err := toAnnexB(test.sample, test.length_size, params, isAVCKeyframe)
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("toAnnexB(% x) = % x, %v, want % x", test.sample, got, err, test.want)
+		}
+	}
+	for _, sample := range [][]byte{ { 0, 0, 0 }, { 0, 0, 0, 5, 0x41 } } {
+		if _, err := toAnnexB(sample, 4, params, isAVCKeyframe); err == nil {
+			t.Errorf("toAnnexB(% x) succeeded", sample)
+		}
+	}
+}
+
+func TestHEVCKeyframe(t *testing.T) {
+	tests := []struct {
+		nalu []byte
+		keyframe, params bool
+	}{
+		{ []byte{ 0x26, 0x01 }, true, false }, // IDR_W_RADL
+		{ []byte{ 0x2A, 0x01 }, true, false }, // CRA
+		{ []byte{ 0x02, 0x01 }, false, false }, // TRAIL_R
+		{ []byte{ 0x40, 0x01 }, false, true }, // VPS
+		{ []byte{}, false, false },
+	}
+	for _, test := range tests {
+		if keyframe, params := isHEVCKeyframe(test.nalu); keyframe != test.keyframe || params != test.params {
+			t.Errorf("isHEVCKeyframe(% x) = %v, %v", test.nalu, keyframe, params)
+		}
+	}
+}
+
+func TestADTSHeader(t *testing.T) {
+	esds := &EsdsBox{ object_type_indication: 0x40 }
+	for _, test := range []struct {
+		asc []byte
+		header []byte
+	}{
+		{ []byte{ 0x12, 0x10 }, []byte{ 0xFF, 0xF1, 0x50, 0x80, 0, 0x1F, 0xFC } }, // LC, 44.1 kHz, stereo
+		{ []byte{ 0x11, 0x88 }, []byte{ 0xFF, 0xF1, 0x4C, 0x40, 0, 0x1F, 0xFC } }, // LC, 48 kHz, mono
+	} {
+		esds.decoder_specific_info = test.asc
+		if header, err := adtsHeader(esds); err != nil || !bytes.Equal(header, test.header) {
+			t.Errorf("adtsHeader(% x) = % x, %v, want % x", test.asc, header, err, test.header)
+		}
+	}
+
+	// HE-AAC signalled explicitly, and MP3
+	esds.decoder_specific_info = []byte{ 0x2B, 0x92, 0x08, 0x00 }
+	if _, err := adtsHeader(esds); err == nil {
+		t.Error("Wrote HE-AAC as ADTS")
+	}
+	esds.object_type_indication = 0x6B
+	if _, err := adtsHeader(esds); err == nil {
+		t.Error("Wrote MP3 as ADTS")
+	}
+}
+
+func TestToADTS(t *testing.T) {
+	header := []byte{ 0xFF, 0xF1, 0x50, 0x80, 0, 0x1F, 0xFC }
+	frame, err := toADTS(header, make([]byte, 1000))
+	if err != nil || len(frame) != 1007 {
+		t.Fatalf("toADTS gave %v bytes, %v", len(frame), err)
+	}
+	// 1007 is 0b11_1110_1111
+	if !bytes.Equal(frame[:7], []byte{ 0xFF, 0xF1, 0x50, 0x80, 0x7D, 0xFF, 0xFC }) {
+		t.Errorf("ADTS header is % x", frame[:7])
+	}
+	if header[4] != 0 || header[5] != 0x1F {
+		t.Error("toADTS changed its header")
+	}
+	if _, err = toADTS(header, make([]byte, 1 << 13)); err == nil {
+		t.Error("toADTS accepted a frame too large")
+	}
+}
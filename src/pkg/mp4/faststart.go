@@ -0,0 +1,107 @@
+package mp4
+
+import (
+	"io"
+	"os"
+)
+
+// Faststart writes f to w with its moov moved in front of the mdat, so that
+// playback can begin before the whole file has been downloaded. The chunk
+// offsets are shifted to match and every other box, including the mdat, is
+// copied through unchanged. Files whose moov already comes first are written
+// as they are.
+func (f *File) Faststart(w io.Writer) (os.Error) {
+	if f.mdat == nil || f.moov.Start() < f.mdat.Start() {
+		_, err := f.WriteTo(w)
+		return err
+	}
+	if len(f.moofs) > 0 {
+		return os.NewError("Cannot move the moov of a fragmented file")
+	}
+
+	// Put the moov just before the first mdat
+	var boxes []BoxInt
+	for _, box := range f.boxes {
+		if box == BoxInt(f.moov) {
+			continue
+		}
+		if box == BoxInt(f.mdat) {
+			boxes = append(boxes, f.moov)
+		}
+		boxes = append(boxes, box)
+	}
+
+	// The new offsets are written into the moov for the duration of the
+	// write; the File itself keeps describing the original layout
+	original := make([][]uint64, len(f.moov.traks))
+	was_large := make([]bool, len(f.moov.traks))
+	large := false
+	for i, trak := range f.moov.traks {
+		original[i] = trak.mdia.minf.stbl.chunkOffsets()
+		was_large[i] = trak.mdia.minf.stbl.co64 != nil
+		large = large || was_large[i]
+	}
+	defer func() {
+		for i, trak := range f.moov.traks {
+			trak.mdia.minf.stbl.setChunkOffsets(original[i], was_large[i])
+		}
+	}()
+
+	for {
+		// The size of the moov only depends on the width of the offsets
+		for i, trak := range f.moov.traks {
+			trak.mdia.minf.stbl.setChunkOffsets(original[i], large)
+		}
+		moov_size := int64(len(f.moov.encode()))
+
+		// Map the start of each box to its new place
+		starts := make(map[int64]int64)
+		pos := int64(0)
+		for _, box := range boxes {
+			if box == BoxInt(f.moov) {
+				pos += moov_size
+				continue
+			}
+			starts[box.Start()] = pos
+			pos += box.Size()
+		}
+
+		fits := true
+		offsets := make([][]uint64, len(original))
+		for i := range original {
+			for _, offset := range original[i] {
+				moved, err := f.movedOffset(offset, starts)
+				if err != nil {
+					return err
+				}
+				fits = fits && moved <= 0xFFFFFFFF
+				offsets[i] = append(offsets[i], moved)
+			}
+		}
+		if !fits && !large {
+			large = true
+			continue
+		}
+		for i, trak := range f.moov.traks {
+			trak.mdia.minf.stbl.setChunkOffsets(offsets[i], large)
+		}
+		break
+	}
+	_, err := f.writeBoxes(w, boxes)
+	return err
+}
+
+// movedOffset returns where offset will be once the top-level boxes of f are
+// moved to the new starts given for their original ones.
+func (f *File) movedOffset(offset uint64, starts map[int64]int64) (uint64, os.Error) {
+	for _, box := range f.boxes {
+		start := box.Start()
+		if int64(offset) >= start && int64(offset) < start + box.Size() {
+			if new_start, ok := starts[start]; ok {
+				return uint64(int64(offset) - start + new_start), nil
+			}
+			break
+		}
+	}
+	return 0, os.NewError("Chunk offset outside of any mdat")
+}
@@ -0,0 +1,63 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFaststart(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	data := fixture{ moov_last: true }.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+
+	var buf bytes.Buffer
+	if err := f.Faststart(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(data) {
+		t.Errorf("Faststart wrote %v bytes, want %v", buf.Len(), len(data))
+	}
+	fast := openBytes(t, buf.Bytes())
+	defer closeTemp(fast)
+	if fast.moov.Start() > fast.mdat.Start() {
+		t.Error("moov is still after the mdat")
+	}
+	for i, trak := range plain.moov.traks {
+		checkSamples(t, fast.moov.traks[i], trak, 0, len(trak.samples))
+	}
+	// The File still describes the original layout
+	for i, trak := range plain.moov.traks {
+		checkSamples(t, f.moov.traks[i], trak, 0, len(trak.samples))
+	}
+
+	// Files that already start with their moov are left as they are
+	buf.Reset()
+	if err := fast.Faststart(&buf); err != nil {
+		t.Fatal(err)
+	}
+	written := fast.ReadBytesAt(int64(buf.Len()), 0)
+	if !bytes.Equal(buf.Bytes(), written) {
+		t.Error("Faststart changed a file whose moov comes first")
+	}
+}
+
+func TestFaststartCo64(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	f := openFixture(t, fixture{ moov_last: true, co64: true })
+	defer closeTemp(f)
+	var buf bytes.Buffer
+	if err := f.Faststart(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fast := openBytes(t, buf.Bytes())
+	defer closeTemp(fast)
+	for i, trak := range plain.moov.traks {
+		if fast.moov.traks[i].mdia.minf.stbl.co64 == nil {
+			t.Error("co64 was not kept")
+		}
+		checkSamples(t, fast.moov.traks[i], trak, 0, len(trak.samples))
+	}
+}
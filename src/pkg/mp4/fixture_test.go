@@ -0,0 +1,467 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// The fixture is a synthetic MP4 built byte by byte, independently of the
+// box encoders under test: 3 seconds of H.264 video at 25 frames per second,
+// with a sync sample every second and composition offsets, and AAC audio at
+// 44100 Hz, interleaved in chunks of 5 video and 11 audio samples.
+const (
+	fixtureVideoTimescale = 12800
+	fixtureAudioTimescale = 44100
+	fixtureVideoSamples = 75
+	fixtureAudioSamples = 129
+	fixtureVideoDelta = 512
+	fixtureAudioDelta = 1024
+	fixtureVideoChunk = 5
+	fixtureAudioChunk = 11
+)
+
+var (
+	fixtureSPS = []byte{ 0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10 }
+	fixturePPS = []byte{ 0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0 }
+	fixtureASC = []byte{ 0x12, 0x10 }
+)
+
+// A fixture selects the layout of a synthetic MP4.
+type fixture struct {
+	large_mdat bool // Give the mdat a 64-bit largesize
+	open_mdat bool // Give the mdat a size of 0, extending to the end of the file
+	co64 bool // Store chunk offsets in co64 rather than stco
+	v1 bool // Write version 1 headers with 64-bit times
+	video_entry []byte // Sample entry of the video track, if not avc1
+	audio_entry []byte // Sample entry of the audio track, if not mp4a
+	frag bool // Fragment the samples in a moof and mdat per chunk
+	moov_last bool // Put the moov after the mdat
+}
+
+func tu16(v uint16) []byte {
+	return []byte{ byte(v >> 8), byte(v) }
+}
+
+func tu32(v uint32) []byte {
+	return []byte{ byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v) }
+}
+
+func tu64(v uint64) []byte {
+	return append(tu32(uint32(v >> 32)), tu32(uint32(v))...)
+}
+
+func tbox(name string, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	return bytes.Join([][]byte{ tu32(uint32(8 + len(payload))), []byte(name), payload }, nil)
+}
+
+func tfull(name string, version uint8, flags uint32, data ...[]byte) []byte {
+	header := []byte{ version, byte(flags >> 16), byte(flags >> 8), byte(flags) }
+	return tbox(name, append([][]byte{ header }, data...)...)
+}
+
+// videoSample returns the data of video sample i: one length-prefixed NAL
+// unit, an IDR slice for sync samples.
+func videoSample(i int) []byte {
+	nal := []byte{ 0x41 }
+	if videoSync(i) {
+		nal[0] = 0x65
+	}
+	for j := 0; j < 50 + i % 5 * 10; j++ {
+		nal = append(nal, byte(i * 7 + j))
+	}
+	return append(tu32(uint32(len(nal))), nal...)
+}
+
+func videoSync(i int) bool {
+	return i % 25 == 0
+}
+
+func videoCTO(i int) uint32 {
+	if i % 3 == 0 {
+		return 512
+	}
+	return 1024
+}
+
+// audioSample returns the data of audio sample i, a raw AAC frame.
+func audioSample(i int) []byte {
+	return append([]byte{ 0x21, byte(i) }, make([]byte, 20 + i % 7)...)
+}
+
+// chunked returns count samples made by sample, grouped per chunks.
+func chunked(count, per int, sample func(int) []byte) (chunks [][][]byte) {
+	for i := 0; i < count; i++ {
+		if i % per == 0 {
+			chunks = append(chunks, nil)
+		}
+		chunks[len(chunks) - 1] = append(chunks[len(chunks) - 1], sample(i))
+	}
+	return chunks
+}
+
+// build returns the bytes of the MP4.
+func (o fixture) build() []byte {
+	ftyp := tbox("ftyp", []byte("isom"), tu32(0x200), []byte("isomiso2avc1mp41"))
+	free := tbox("free", make([]byte, 16))
+	video := chunked(fixtureVideoSamples, fixtureVideoChunk, videoSample)
+	audio := chunked(fixtureAudioSamples, fixtureAudioChunk, audioSample)
+
+	if o.frag {
+		return o.fragmented(ftyp, video, audio)
+	}
+
+	if o.moov_last {
+		moov, mdat := o.movie(uint64(len(ftyp) + len(free)), video, audio)
+		return bytes.Join([][]byte{ ftyp, free, mdat, moov }, nil)
+	}
+
+	// The size of the moov does not depend on the chunk offsets
+	moov, _ := o.movie(0, video, audio)
+	moov, mdat := o.movie(uint64(len(ftyp) + len(moov) + len(free)), video, audio)
+	return bytes.Join([][]byte{ ftyp, moov, free, mdat }, nil)
+}
+
+// movie returns a moov for the given chunks of video and audio samples, and
+// an mdat holding them at mdat_offset in the file.
+func (o fixture) movie(mdat_offset uint64, video, audio [][][]byte) (moov, mdat []byte) {
+	var payload []byte
+	var video_offsets, audio_offsets []uint64
+	offset := mdat_offset + uint64(len(o.mdatHeader(0)))
+	for k := 0; k < len(video) || k < len(audio); k++ {
+		if k < len(video) {
+			video_offsets = append(video_offsets, offset)
+			data := bytes.Join(video[k], nil)
+			payload = append(payload, data...)
+			offset += uint64(len(data))
+		}
+		if k < len(audio) {
+			audio_offsets = append(audio_offsets, offset)
+			data := bytes.Join(audio[k], nil)
+			payload = append(payload, data...)
+			offset += uint64(len(data))
+		}
+	}
+
+	avcc := tbox("avcC", []byte{ 1, 0x64, 0, 0x1f, 0xff, 0xe1 }, tu16(uint16(len(fixtureSPS))), fixtureSPS,
+		[]byte{ 1 }, tu16(uint16(len(fixturePPS))), fixturePPS)
+	avc1 := visualEntry("avc1", avcc)
+	if o.video_entry != nil {
+		avc1 = o.video_entry
+	}
+	esds := tfull("esds", 0, 0,
+		[]byte{ 3, 25 }, tu16(2), []byte{ 0 },
+		[]byte{ 4, 17, 0x40, 0x15, 0, 0, 0 }, tu32(128000), tu32(128000),
+		[]byte{ 5, byte(len(fixtureASC)) }, fixtureASC,
+		[]byte{ 6, 1, 2 })
+	mp4a := tbox("mp4a", make([]byte, 6), tu16(1), make([]byte, 8), tu16(2), tu16(16), tu16(0), tu16(0),
+		tu32(fixtureAudioTimescale << 16), esds)
+	if o.audio_entry != nil {
+		mp4a = o.audio_entry
+	}
+
+	video_count, audio_count := 0, 0
+	for _, chunk := range video {
+		video_count += len(chunk)
+	}
+	for _, chunk := range audio {
+		audio_count += len(chunk)
+	}
+	var sync []int
+	var ctts []uint32
+	for i := 0; i < video_count; i++ {
+		if videoSync(i) {
+			sync = append(sync, i + 1)
+		}
+		ctts = append(ctts, videoCTO(i))
+	}
+
+	vmhd := tfull("vmhd", 0, 1, make([]byte, 8))
+	smhd := tfull("smhd", 0, 0, make([]byte, 4))
+	video_trak := o.trak(1, fixtureVideoTimescale, uint64(fixtureVideoDelta * video_count), "vide", vmhd,
+		o.stbl(avc1, fixtureVideoDelta, video, video_offsets, sync, ctts), 640, 360, 0)
+	audio_trak := o.trak(2, fixtureAudioTimescale, uint64(fixtureAudioDelta * audio_count), "soun", smhd,
+		o.stbl(mp4a, fixtureAudioDelta, audio, audio_offsets, nil, nil), 0, 0, 0x100)
+
+	mvhd := tfull("mvhd", o.version(), 0, o.time(0), o.time(0), tu32(1000), o.time(3000), tu32(0x10000), tu16(0x100),
+		make([]byte, 10), fixtureMatrix(), make([]byte, 24), tu32(3))
+	udta := tbox("udta", tfull("meta", 0, 0,
+		tfull("hdlr", 0, 0, tu32(0), []byte("mdirappl"), make([]byte, 9)),
+		tbox("ilst")))
+	if o.frag {
+		trex := func(id uint32) []byte {
+			return tfull("trex", 0, 0, tu32(id), tu32(1), tu32(0), tu32(0), tu32(0x10000))
+		}
+		moov = tbox("moov", mvhd, video_trak, audio_trak, tbox("mvex", trex(1), trex(2)), udta)
+		return moov, nil
+	}
+	moov = tbox("moov", mvhd, video_trak, audio_trak, udta)
+	return moov, append(o.mdatHeader(len(payload)), payload...)
+}
+
+// fragmented returns an fMP4 with empty sample tables in the moov, followed
+// by a moof and mdat for each chunk of video and the audio chunk alongside.
+func (o fixture) fragmented(ftyp []byte, video, audio [][][]byte) []byte {
+	moov, _ := o.movie(0, nil, nil)
+	out := append(ftyp, moov...)
+	video_time, audio_time := uint64(0), uint64(0)
+	first_video := 0
+	for k, video_chunk := range video {
+		var audio_chunk [][]byte
+		if k < len(audio) {
+			audio_chunk = audio[k]
+		}
+		// The data offsets do not change the size of the moof
+		moof := o.moof(k, first_video, video_chunk, audio_chunk, video_time, audio_time, 0)
+		moof = o.moof(k, first_video, video_chunk, audio_chunk, video_time, audio_time, len(moof) + 8)
+		mdat := tbox("mdat", bytes.Join(video_chunk, nil), bytes.Join(audio_chunk, nil))
+		out = bytes.Join([][]byte{ out, moof, mdat }, nil)
+		video_time += uint64(fixtureVideoDelta * len(video_chunk))
+		audio_time += uint64(fixtureAudioDelta * len(audio_chunk))
+		first_video += len(video_chunk)
+	}
+	return out
+}
+
+// moof returns movie fragment k holding the given video samples, starting
+// with sample first_video, and audio samples, whose data starts at
+// data_offset from the moof.
+func (o fixture) moof(k, first_video int, video, audio [][]byte, video_time, audio_time uint64, data_offset int) []byte {
+	traf := func(id uint32, samples [][]byte, time uint64, delta uint32, offset int, flags func(int) uint32, cto func(int) uint32) []byte {
+		trun_flags := uint32(TRUN_DATA_OFFSET | TRUN_SAMPLE_DURATION | TRUN_SAMPLE_SIZE | TRUN_SAMPLE_FLAGS)
+		if cto != nil {
+			trun_flags |= TRUN_SAMPLE_CTO
+		}
+		trun := [][]byte{ tu32(uint32(len(samples))), tu32(uint32(offset)) }
+		for i, sample := range samples {
+			trun = append(trun, tu32(delta), tu32(uint32(len(sample))), tu32(flags(i)))
+			if cto != nil {
+				trun = append(trun, tu32(cto(i)))
+			}
+		}
+		return tbox("traf", tfull("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF, tu32(id)),
+			tfull("tfdt", 1, 0, tu64(time)),
+			tfull("trun", 0, trun_flags, trun...))
+	}
+
+	video_data := 0
+	for _, sample := range video {
+		video_data += len(sample)
+	}
+	moof := [][]byte{ tfull("mfhd", 0, 0, tu32(uint32(k + 1))) }
+	moof = append(moof, traf(1, video, video_time, fixtureVideoDelta, data_offset,
+		func(i int) uint32 {
+			if videoSync(first_video + i) {
+				return 0
+			}
+			return SAMPLE_IS_NON_SYNC
+		},
+		func(i int) uint32 { return videoCTO(first_video + i) }))
+	if len(audio) > 0 {
+		moof = append(moof, traf(2, audio, audio_time, fixtureAudioDelta, data_offset + video_data,
+			func(i int) uint32 { return 0 }, nil))
+	}
+	return tbox("moof", moof...)
+}
+
+// mdatHeader returns the header of an mdat holding n bytes.
+func (o fixture) mdatHeader(n int) []byte {
+	switch {
+	case o.large_mdat:
+		return bytes.Join([][]byte{ tu32(1), []byte("mdat"), tu64(uint64(16 + n)) }, nil)
+	case o.open_mdat:
+		return append(tu32(0), "mdat"...)
+	}
+	return append(tu32(uint32(8 + n)), "mdat"...)
+}
+
+// visualEntry returns a 640x360 visual sample entry holding the given
+// configuration boxes.
+func visualEntry(name string, configs ...[]byte) []byte {
+	return tbox(name, make([]byte, 6), tu16(1), make([]byte, 16), tu16(640), tu16(360),
+		tu32(0x480000), tu32(0x480000), tu32(0), tu16(1), make([]byte, 32), tu16(24), tu16(0xffff),
+		bytes.Join(configs, nil))
+}
+
+func fixtureMatrix() []byte {
+	return bytes.Join([][]byte{ tu32(0x10000), tu32(0), tu32(0), tu32(0), tu32(0x10000), tu32(0), tu32(0), tu32(0), tu32(0x40000000) }, nil)
+}
+
+// stbl returns a sample table for the given chunks of samples lasting delta
+// each, with an stss listing the 1-based sync sample numbers if any and a
+// ctts if offsets are given.
+func (o fixture) stbl(entry []byte, delta uint32, chunks [][][]byte, offsets []uint64, sync []int, ctos []uint32) []byte {
+	var sizes []uint32
+	for _, chunk := range chunks {
+		for _, sample := range chunk {
+			sizes = append(sizes, uint32(len(sample)))
+		}
+	}
+
+	table := [][]byte{ tfull("stsd", 0, 0, tu32(1), entry) }
+	if len(sizes) > 0 {
+		table = append(table, tfull("stts", 0, 0, tu32(1), tu32(uint32(len(sizes))), tu32(delta)))
+	} else
+	{
+		table = append(table, tfull("stts", 0, 0, tu32(0)))
+	}
+	if ctos != nil {
+		ctts := [][]byte{ tu32(uint32(len(ctos))) }
+		for _, cto := range ctos {
+			ctts = append(ctts, tu32(1), tu32(cto))
+		}
+		table = append(table, tfull("ctts", 0, 0, ctts...))
+	}
+	if sync != nil {
+		stss := [][]byte{ tu32(uint32(len(sync))) }
+		for _, n := range sync {
+			stss = append(stss, tu32(uint32(n)))
+		}
+		table = append(table, tfull("stss", 0, 0, stss...))
+	}
+
+	var stsc [][]byte
+	last := -1
+	for i, chunk := range chunks {
+		if len(chunk) != last {
+			stsc = append(stsc, tu32(uint32(i + 1)), tu32(uint32(len(chunk))), tu32(1))
+			last = len(chunk)
+		}
+	}
+	table = append(table, tfull("stsc", 0, 0, append([][]byte{ tu32(uint32(len(stsc) / 3)) }, stsc...)...))
+
+	stsz := [][]byte{ tu32(0), tu32(uint32(len(sizes))) }
+	for _, size := range sizes {
+		stsz = append(stsz, tu32(size))
+	}
+	table = append(table, tfull("stsz", 0, 0, stsz...))
+
+	stco := [][]byte{ tu32(uint32(len(offsets))) }
+	for _, offset := range offsets {
+		if o.co64 {
+			stco = append(stco, tu64(offset))
+		} else
+		{
+			stco = append(stco, tu32(uint32(offset)))
+		}
+	}
+	if o.co64 {
+		table = append(table, tfull("co64", 0, 0, stco...))
+	} else
+	{
+		table = append(table, tfull("stco", 0, 0, stco...))
+	}
+	return tbox("stbl", table...)
+}
+
+// trak returns a trak lasting duration in timescale, with an edit list
+// skipping the composition delay of the video.
+func (o fixture) trak(id uint32, timescale uint32, duration uint64, handler string, mhd, stbl []byte, width, height uint32, volume uint16) []byte {
+	movie_duration := duration * 1000 / uint64(timescale)
+	media_time := uint64(0)
+	if id == 1 {
+		media_time = 1024
+	}
+	tkhd := tfull("tkhd", o.version(), 3, o.time(0), o.time(0), tu32(id), tu32(0), o.time(movie_duration),
+		make([]byte, 8), tu16(0), tu16(0), tu16(volume), tu16(0), fixtureMatrix(), tu32(width << 16), tu32(height << 16))
+	edts := tbox("edts", tfull("elst", o.version(), 0, tu32(1), o.time(movie_duration), o.time(media_time), tu16(1), tu16(0)))
+	mdhd := tfull("mdhd", o.version(), 0, o.time(0), o.time(0), tu32(timescale), o.time(duration), tu16(0x55c4), tu16(0))
+	hdlr := tfull("hdlr", 0, 0, tu32(0), []byte(handler), make([]byte, 12), []byte("Handler\x00"))
+	dinf := tbox("dinf", tfull("dref", 0, 0, tu32(1), tfull("url ", 0, 1)))
+	return tbox("trak", tkhd, edts, tbox("mdia", mdhd, hdlr, tbox("minf", mhd, dinf, stbl)))
+}
+
+// version returns the version of the headers with times.
+func (o fixture) version() uint8 {
+	if o.v1 {
+		return 1
+	}
+	return 0
+}
+
+// time returns a time field of the headers.
+func (o fixture) time(v uint64) []byte {
+	if o.v1 {
+		return tu64(v)
+	}
+	return tu32(uint32(v))
+}
+
+// rawBox writes a box to a temporary file and returns it unparsed. Close
+// it with closeTemp(b.File()).
+func rawBox(t *testing.T, data []byte) (*Box) {
+	tmp, err := ioutil.TempFile("", "mp4_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		t.Fatal(err)
+	}
+	f := &File{ File: tmp, size: int64(len(data)) }
+	size, name, header_size := f.ReadBoxAt(0)
+	return &Box{ name: name, size: size, start: 0, header_size: header_size, file: f }
+}
+
+// openBytes writes data to a temporary file and opens it.
+func openBytes(t *testing.T, data []byte) (*File) {
+	return openWritten(t, bytes.NewBuffer(data))
+}
+
+// openWritten writes w to a temporary file and opens it.
+func openWritten(t *testing.T, w io.WriterTo) (*File) {
+	tmp, err := ioutil.TempFile("", "mp4_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.WriteTo(tmp)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		t.Fatal(err)
+	}
+	f, err := Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		t.Fatal(err)
+	}
+	return f
+}
+
+// openFixture builds and opens a fixture.
+func openFixture(t *testing.T, o fixture) (*File) {
+	return openBytes(t, o.build())
+}
+
+// closeTemp closes and removes a file opened by openWritten.
+func closeTemp(f *File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// checkSamples fails unless samples first through first+count-1 of want
+// match those of got from its first sample: same sizes, durations, offsets
+// from the first decode time, composition offsets, sync flags and data.
+func checkSamples(t *testing.T, got, want *TrakBox, first, count int) {
+	id := want.tkhd.track_id
+	if len(got.samples) != count {
+		t.Fatalf("Track %v has %v samples, want %v", id, len(got.samples), count)
+	}
+	for i := 0; i < count; i++ {
+		g, w := got.samples[i], want.samples[first + i]
+		g_time := g.start_time - got.samples[0].start_time
+		w_time := w.start_time - want.samples[first].start_time
+		if g.size != w.size || g.duration != w.duration || g.cto != w.cto || g.sync != w.sync || g_time != w_time {
+			t.Fatalf("Track %v sample %v is %+v, want %+v", id, i, g, w)
+		}
+		g_data := got.file.ReadBytesAt(int64(g.size), int64(g.offset))
+		w_data := want.file.ReadBytesAt(int64(w.size), int64(w.offset))
+		if !bytes.Equal(g_data, w_data) {
+			t.Fatalf("Track %v sample %v has different data", id, i)
+		}
+	}
+}
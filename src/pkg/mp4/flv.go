@@ -0,0 +1,274 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// FLV tag types
+const (
+	FLV_TAG_AUDIO = 8
+	FLV_TAG_VIDEO = 9
+	FLV_TAG_SCRIPT = 18
+)
+
+// FLV_TAG_HEADER_SIZE is the size of the header in front of every FLV tag.
+const FLV_TAG_HEADER_SIZE = 11
+
+// Codec IDs in FLV tags and onMetaData
+const (
+	FLV_CODEC_AVC = 7
+	FLV_CODEC_AAC = 10
+)
+
+// An FLV is a File remuxed as Flash Video for legacy players: an onMetaData
+// tag indexing the keyframes, the AVC and AAC sequence headers, then a tag
+// for every sample of the first H.264 and the first AAC trak, interleaved by
+// decode time. The sample data is read from the original file.
+type FLV struct {
+	layouts
+	flags byte // Audio and video present, as in the FLV header
+	sequence_headers []byte // The AVC and AAC sequence header tags
+	tag_offsets []int64 // Offset of the tag in each layout after the first
+	keyframe_times []float64 // In seconds
+	keyframe_positions []int64
+}
+
+// WriteFLV writes f to w as an FLV. See NewFLV.
+func (f *File) WriteFLV(w io.Writer) (os.Error) {
+	v, err := f.NewFLV()
+	if err != nil {
+		return err
+	}
+	_, err = v.WriteTo(w)
+	return err
+}
+
+// NewFLV prepares an FLV of f. It fails if f has neither H.264 video nor AAC
+// audio.
+func (f *File) NewFLV() (v *FLV, err os.Error) {
+	var video, audio *TrakBox
+	var avcc *AvccBox
+	var esds *EsdsBox
+	for _, trak := range f.moov.traks {
+		switch entry := trak.sampleEntry().(type) {
+		case *VisualSampleEntry:
+			if video == nil && entry.AVCConfig() != nil {
+				video, avcc = trak, entry.AVCConfig()
+			}
+		case *AudioSampleEntry:
+			if audio == nil && entry.ESDescriptor() != nil && entry.ESDescriptor().object_type_indication == 0x40 {
+				audio, esds = trak, entry.ESDescriptor()
+			}
+		}
+	}
+	if video == nil && audio == nil {
+		return nil, os.NewError("File contains neither H.264 video nor AAC audio")
+	}
+
+	v = new(FLV)
+	if video != nil {
+		v.flags |= 0x01
+		record := avcc.encode()[BOX_HEADER_SIZE:]
+		v.sequence_headers = appendTag(v.sequence_headers, FLV_TAG_VIDEO, 0, append([]byte{ 0x10 | FLV_CODEC_AVC, 0, 0, 0, 0 }, record...))
+	}
+	if audio != nil {
+		v.flags |= 0x04
+		v.sequence_headers = appendTag(v.sequence_headers, FLV_TAG_AUDIO, 0, append([]byte{ FLV_CODEC_AAC << 4 | 0xF, 0 }, esds.DecoderSpecificInfo()...))
+	}
+
+	// Lay out the sample tags in decode order. Each tag's PreviousTagSize
+	// leads the layout of the next.
+	pos, previous_size := int64(0), []byte(nil)
+	next := map[*TrakBox]int{}
+	for {
+		var trak *TrakBox
+		var dts int64
+		for _, t := range []*TrakBox{ video, audio } {
+			if t == nil || next[t] >= len(t.samples) {
+				continue
+			}
+			if d := fromTimescale(t.samples[next[t]].start_time, t.mdia.mdhd.timescale); trak == nil || d < dts {
+				trak, dts = t, d
+			}
+		}
+		if trak == nil {
+			break
+		}
+		sample := trak.samples[next[trak]]
+		next[trak]++
+
+		var tag_type byte
+		var body []byte
+		if trak == video {
+			tag_type = FLV_TAG_VIDEO
+			frame_type := byte(2)
+			if sample.sync {
+				frame_type = 1
+				v.keyframe_times = append(v.keyframe_times, float64(dts) / 1e9)
+				v.keyframe_positions = append(v.keyframe_positions, pos + int64(len(previous_size)))
+			}
+			cts := int64(int32(sample.cto)) * 1000 / int64(trak.mdia.mdhd.timescale)
+			body = []byte{ frame_type << 4 | FLV_CODEC_AVC, 1, byte(cts >> 16), byte(cts >> 8), byte(cts) }
+		} else
+		{
+			tag_type = FLV_TAG_AUDIO
+			body = []byte{ FLV_CODEC_AAC << 4 | 0xF, 1 }
+		}
+		size := len(body) + int(sample.size)
+		head := append(previous_size, tagHeader(tag_type, size, dts / 1e6)...)
+		l := &layout{ file: f, head: append(head, body...) }
+		l.addSamples([]Sample{ sample })
+		v.layouts = append(v.layouts, l)
+		v.tag_offsets = append(v.tag_offsets, pos + int64(len(previous_size)))
+		pos += l.Size()
+		previous_size = putUint32(nil, uint32(FLV_TAG_HEADER_SIZE + size))
+	}
+	if previous_size != nil {
+		v.layouts = append(v.layouts, &layout{ file: f, head: previous_size })
+		pos += int64(len(previous_size))
+	}
+
+	// The metadata is the same size whatever the positions and file size
+	// it holds, so it is built once to measure it and again to fill it in.
+	metadata := v.metadata(f, video, audio, 0, 0)
+	header_size := int64(len(v.header()) + len(metadata) + len(v.sequence_headers))
+	metadata = v.metadata(f, video, audio, header_size, header_size + pos)
+	for i := range v.tag_offsets {
+		v.tag_offsets[i] += header_size
+	}
+	head := append(append(v.header(), metadata...), v.sequence_headers...)
+	v.layouts = append(layouts{ &layout{ file: f, head: head } }, v.layouts...)
+	return v, nil
+}
+
+// header returns the FLV header and the PreviousTagSize of 0 after it.
+func (v *FLV) header() ([]byte) {
+	return []byte{ 'F', 'L', 'V', 1, v.flags, 0, 0, 0, 9, 0, 0, 0, 0 }
+}
+
+// metadata returns the onMetaData script tag, with keyframe positions moved
+// by offset and the given total file size.
+func (v *FLV) metadata(f *File, video, audio *TrakBox, offset, file_size int64) ([]byte) {
+	data := amfString(nil, "onMetaData")
+	count := 3
+	if video != nil {
+		count += 3
+	}
+	if audio != nil {
+		count += 3
+	}
+	data = append(data, 0x08) // ECMA array
+	data = putUint32(data, uint32(count))
+	data = amfProperty(data, "duration")
+	data = amfNumber(data, float64(f.Duration()) / 1e9)
+	data = amfProperty(data, "filesize")
+	data = amfNumber(data, float64(file_size))
+	if video != nil {
+		data = amfProperty(data, "width")
+		data = amfNumber(data, float64(video.Width()))
+		data = amfProperty(data, "height")
+		data = amfNumber(data, float64(video.Height()))
+		data = amfProperty(data, "videocodecid")
+		data = amfNumber(data, FLV_CODEC_AVC)
+	}
+	if audio != nil {
+		entry := audio.sampleEntry().(*AudioSampleEntry)
+		data = amfProperty(data, "audiosamplerate")
+		data = amfNumber(data, float64(entry.SampleRate()))
+		data = amfProperty(data, "stereo")
+		data = append(data, 0x01) // Boolean
+		if entry.ChannelCount() > 1 {
+			data = append(data, 1)
+		} else
+		{
+			data = append(data, 0)
+		}
+		data = amfProperty(data, "audiocodecid")
+		data = amfNumber(data, FLV_CODEC_AAC)
+	}
+
+	// keyframes is an object of two strict arrays
+	data = amfProperty(data, "keyframes")
+	data = append(data, 0x03)
+	data = amfProperty(data, "times")
+	data = append(data, 0x0A)
+	data = putUint32(data, uint32(len(v.keyframe_times)))
+	for _, t := range v.keyframe_times {
+		data = amfNumber(data, t)
+	}
+	data = amfProperty(data, "filepositions")
+	data = append(data, 0x0A)
+	data = putUint32(data, uint32(len(v.keyframe_positions)))
+	for _, position := range v.keyframe_positions {
+		data = amfNumber(data, float64(offset + position))
+	}
+	data = append(data, 0, 0, 0x09) // End of the keyframes object
+	data = append(data, 0, 0, 0x09) // End of the array
+	return appendTag(nil, FLV_TAG_SCRIPT, 0, data)
+}
+
+// From returns the FLV as served to a pseudo-streaming player asking for it
+// from the given byte offset, which must be the start of a tag, such as one
+// of the keyframe positions in onMetaData: an FLV header and the sequence
+// headers, which decoders need before any sample, with no metadata, followed
+// by the tags from offset on.
+func (v *FLV) From(offset int64) (*FLV, os.Error) {
+	for i, tag_offset := range v.tag_offsets {
+		if tag_offset != offset {
+			continue
+		}
+		// Leave out the PreviousTagSize at the head of the tag's layout
+		l := v.layouts[i+1]
+		skip := 0
+		if i > 0 {
+			skip = 4
+		}
+		r := &FLV{ flags: v.flags, sequence_headers: v.sequence_headers }
+		r.layouts = layouts{ &layout{ file: l.file, head: append(r.header(), r.sequence_headers...) } }
+		r.layouts = append(r.layouts, &layout{ file: l.file, head: l.head[skip:], ranges: l.ranges })
+		r.layouts = append(r.layouts, v.layouts[i+2:]...)
+		return r, nil
+	}
+	return nil, os.NewError(fmt.Sprintf("No FLV tag starts at offset %v", offset))
+}
+
+// appendTag appends an FLV tag and the PreviousTagSize following it.
+func appendTag(data []byte, tag_type byte, timestamp int64, body []byte) ([]byte) {
+	data = append(data, tagHeader(tag_type, len(body), timestamp)...)
+	data = append(data, body...)
+	return putUint32(data, uint32(FLV_TAG_HEADER_SIZE + len(body)))
+}
+
+// tagHeader returns the header of an FLV tag with size bytes of data and the
+// given timestamp in milliseconds.
+func tagHeader(tag_type byte, size int, timestamp int64) ([]byte) {
+	return []byte{
+		tag_type,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(timestamp >> 24), // Extended timestamp
+		0, 0, 0, // Stream ID
+	}
+}
+
+// amfString appends an AMF0 string value.
+func amfString(data []byte, s string) ([]byte) {
+	return amfProperty(append(data, 0x02), s)
+}
+
+// amfProperty appends the name of an AMF0 object property.
+func amfProperty(data []byte, name string) ([]byte) {
+	data = putUint16(data, uint16(len(name)))
+	return append(data, name...)
+}
+
+// amfNumber appends an AMF0 number value.
+func amfNumber(data []byte, n float64) ([]byte) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(n))
+	return append(append(data, 0x00), b...)
+}
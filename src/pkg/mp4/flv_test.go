@@ -0,0 +1,171 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// flvTag is an FLV tag split into its parts.
+type flvTag struct {
+	offset int64
+	tag_type byte
+	timestamp int64
+	body []byte
+}
+
+// flvTags checks the header and PreviousTagSizes of an FLV and splits it
+// into tags.
+func flvTags(t *testing.T, data []byte) (tags []flvTag) {
+	if len(data) < 13 || string(data[:3]) != "FLV" || !bytes.Equal(data[9:13], []byte{ 0, 0, 0, 0 }) {
+		t.Fatalf("Invalid FLV header % x", data[:13])
+	}
+	for pos := 13; pos < len(data); {
+		if pos + FLV_TAG_HEADER_SIZE > len(data) {
+			t.Fatalf("Truncated tag at %v", pos)
+		}
+		h := data[pos:]
+		size := int(h[1]) << 16 | int(h[2]) << 8 | int(h[3])
+		end := pos + FLV_TAG_HEADER_SIZE + size
+		if end + 4 > len(data) {
+			t.Fatalf("Tag at %v runs past the end", pos)
+		}
+		if previous := int(binary.BigEndian.Uint32(data[end:end+4])); previous != FLV_TAG_HEADER_SIZE + size {
+			t.Fatalf("PreviousTagSize %v after a tag of %v bytes", previous, FLV_TAG_HEADER_SIZE + size)
+		}
+		tags = append(tags, flvTag{
+			offset: int64(pos),
+			tag_type: h[0],
+			timestamp: int64(h[7]) << 24 | int64(h[4]) << 16 | int64(h[5]) << 8 | int64(h[6]),
+			body: data[pos+FLV_TAG_HEADER_SIZE:end],
+		})
+		pos = end + 4
+	}
+	return tags
+}
+
+func TestFLV(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	v, err := f.NewFLV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err = v.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != v.Size() {
+		t.Errorf("Wrote %v bytes of %v", buf.Len(), v.Size())
+	}
+	if flags := buf.Bytes()[4]; flags != 0x05 {
+		t.Errorf("Header flags %x, want audio and video", flags)
+	}
+	tags := flvTags(t, buf.Bytes())
+	if len(tags) != 3 + fixtureVideoSamples + fixtureAudioSamples {
+		t.Fatalf("%v tags", len(tags))
+	}
+
+	// The metadata, then the sequence headers
+	if tags[0].tag_type != FLV_TAG_SCRIPT || !bytes.HasPrefix(tags[0].body, []byte("\x02\x00\x0AonMetaData")) {
+		t.Errorf("First tag is %+v", tags[0])
+	}
+	avcc := f.moov.traks[0].sampleEntry().(*VisualSampleEntry).AVCConfig().encode()[BOX_HEADER_SIZE:]
+	if tags[1].tag_type != FLV_TAG_VIDEO || !bytes.Equal(tags[1].body, append([]byte{ 0x17, 0, 0, 0, 0 }, avcc...)) {
+		t.Errorf("AVC sequence header is % x", tags[1].body)
+	}
+	if tags[2].tag_type != FLV_TAG_AUDIO || !bytes.Equal(tags[2].body, append([]byte{ 0xAF, 0 }, fixtureASC...)) {
+		t.Errorf("AAC sequence header is % x", tags[2].body)
+	}
+
+	// The samples, in decode order, with the composition offsets in
+	// milliseconds
+	video, audio := 0, 0
+	last := int64(0)
+	for _, tag := range tags[3:] {
+		if tag.timestamp < last {
+			t.Fatalf("Tag at %v goes back in time", tag.offset)
+		}
+		last = tag.timestamp
+		switch tag.tag_type {
+		case FLV_TAG_VIDEO:
+			cto := int(videoCTO(video)) * 1000 / fixtureVideoTimescale
+			frame := byte(0x27)
+			if videoSync(video) {
+				frame = 0x17
+			}
+			want := append([]byte{ frame, 1, byte(cto >> 16), byte(cto >> 8), byte(cto) }, videoSample(video)...)
+			if !bytes.Equal(tag.body, want) {
+				t.Errorf("Video tag %v is % x", video, tag.body[:5])
+			}
+			if ts := int64(video * fixtureVideoDelta * 1000 / fixtureVideoTimescale); tag.timestamp != ts {
+				t.Errorf("Video tag %v at %vms, want %v", video, tag.timestamp, ts)
+			}
+			video++
+		case FLV_TAG_AUDIO:
+			if !bytes.Equal(tag.body, append([]byte{ 0xAF, 1 }, audioSample(audio)...)) {
+				t.Errorf("Audio tag %v is % x", audio, tag.body)
+			}
+			audio++
+		default:
+			t.Errorf("Tag of type %v at %v", tag.tag_type, tag.offset)
+		}
+	}
+	if video != fixtureVideoSamples || audio != fixtureAudioSamples {
+		t.Errorf("%v video and %v audio tags", video, audio)
+	}
+
+	// The metadata indexes the keyframes
+	for i, position := range v.keyframe_positions {
+		position += tags[3].offset
+		found := false
+		for _, tag := range tags {
+			found = found || tag.offset == position && tag.tag_type == FLV_TAG_VIDEO && tag.body[0] == 0x17 && tag.body[1] == 1
+		}
+		if !found {
+			t.Errorf("Keyframe %v is at %v, which is no keyframe tag", i, position)
+		}
+	}
+}
+
+func TestFLVFrom(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	v, err := f.NewFLV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := new(bytes.Buffer)
+	if _, err = v.WriteTo(full); err != nil {
+		t.Fatal(err)
+	}
+	tags := flvTags(t, full.Bytes())
+	header := full.Bytes()[:13]
+	sequence_headers := full.Bytes()[tags[1].offset:tags[3].offset]
+
+	// From the first sample or a later keyframe, the sequence headers come
+	// first, then the rest of the file
+	for _, offset := range []int64{ tags[3].offset, v.keyframe_positions[1] + tags[3].offset } {
+		from, err := v.From(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if _, err = from.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append(append([]byte(nil), header...), sequence_headers...), full.Bytes()[offset:]...)
+		if !bytes.Equal(buf.Bytes(), want) || from.Size() != int64(len(want)) {
+			t.Errorf("From(%v) gave %v bytes, want %v", offset, buf.Len(), len(want))
+		}
+		if tags := flvTags(t, buf.Bytes()); tags[0].tag_type != FLV_TAG_VIDEO || tags[0].body[1] != 0 || tags[0].timestamp != 0 || tags[1].tag_type != FLV_TAG_AUDIO || tags[1].body[1] != 0 {
+			t.Errorf("From(%v) does not start with the sequence headers", offset)
+		}
+	}
+
+	for _, offset := range []int64{ 0, tags[3].offset + 1, int64(full.Len()) } {
+		if _, err := v.From(offset); err == nil {
+			t.Errorf("From(%v) succeeded", offset)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Sample flags written to trun for sync and non-sync samples
+const (
+	SYNC_SAMPLE_FLAGS = 0x02000000 // sample_depends_on = 2 (does not depend on others)
+	NON_SYNC_SAMPLE_FLAGS = 0x01010000 // sample_depends_on = 1, sample_is_non_sync_sample
+)
+
+// A Fragment is a movie fragment cut from a File: a moof followed by an mdat
+// holding the fragment's samples, copied from the original file.
+type Fragment struct {
+	layout // The head holds the moof and the mdat header
+	moof *MoofBox
+	start, duration int64
+}
+
+// Fragment writes f to w as a fragmented MP4: the init segment followed by
+// fragments of about the given duration in nanoseconds. See Fragments.
+func (f *File) Fragment(duration int64, w io.Writer) (os.Error) {
+	fragments, err := f.Fragments(duration)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(f.InitSegment()); err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		if _, err = fragment.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitSegment returns the ftyp and moov that start a fragmented version of
+// f. The moov describes the traks and their sample descriptions but holds
+// no samples; an mvex announces that they follow in fragments.
+func (f *File) InitSegment() ([]byte) {
+	return f.initSegment(f.moov.traks)
+}
+
+// initSegment returns an init segment for the given traks of f.
+func (f *File) initSegment(traks []*TrakBox) ([]byte) {
+	// Fragments mux every trak into one moof, so they are not CMAF and
+	// cmfc is not claimed
+	ftyp := *f.ftyp
+	ftyp.compatible_brands = append([]string(nil), f.ftyp.compatible_brands...)
+	found := false
+	for _, b := range ftyp.compatible_brands {
+		found = found || b == "iso6"
+	}
+	if !found {
+		ftyp.compatible_brands = append(ftyp.compatible_brands, "iso6")
+	}
+
+	mvhd := *f.moov.mvhd
+	mvhd.duration = 0
+	moov := &MoovBox{
+		Box: newBox("moov"),
+		mvhd: &mvhd,
+		mvex: &MvexBox{ Box: newBox("mvex") },
+		udta: f.moov.udta,
+	}
+	for _, trak := range traks {
+		stbl := &StblBox{
+			Box: newBox("stbl"),
+			stts: &SttsBox{ Box: newBox("stts") },
+			stsc: &StscBox{ Box: newBox("stsc") },
+			stsz: &StszBox{ Box: newBox("stsz") },
+		}
+		stbl.setChunkOffsets(nil, false)
+		moov.traks = append(moov.traks, trak.rebuild(stbl, 0, mvhd.timescale))
+		moov.mvex.trexs = append(moov.mvex.trexs, &TrexBox{
+			Box: newBox("trex"),
+			track_id: trak.tkhd.track_id,
+			default_sample_description_index: 1,
+		})
+	}
+	return append(ftyp.encode(), moov.encode()...)
+}
+
+// Fragments cuts f into movie fragments of at least duration nanoseconds
+// each, except for the last. Fragments start at sync samples of the first
+// trak that has samples which are not, usually the video.
+func (f *File) Fragments(duration int64) (fragments []*Fragment, err os.Error) {
+	return f.fragments(f.moov.traks, duration)
+}
+
+// fragments cuts the given traks of f into fragments. The fragments start at
+// the same times whichever traks are chosen.
+func (f *File) fragments(traks []*TrakBox, duration int64) (fragments []*Fragment, err os.Error) {
+	if duration <= 0 {
+		return nil, os.NewError("Invalid fragment duration")
+	}
+	if len(f.moov.traks) == 0 {
+		return nil, os.NewError("File has no traks")
+	}
+
+	// Pick the start time of each fragment
+	ref := f.moov.traks[0]
+	for _, trak := range f.moov.traks {
+		if !trak.allSync() {
+			ref = trak
+			break
+		}
+	}
+	bounds := []int64{ 0 }
+	for _, sample := range ref.samples {
+		t := fromTimescale(sample.start_time, ref.mdia.mdhd.timescale)
+		if sample.sync && t - bounds[len(bounds)-1] >= duration {
+			bounds = append(bounds, t)
+		}
+	}
+	end := int64(0)
+	for _, trak := range f.moov.traks {
+		if d := trak.Duration(); d > end {
+			end = d
+		}
+	}
+	bounds = append(bounds, end)
+
+	// Cut every trak at those times
+	first := make([]int, len(traks))
+	for i := 1; i < len(bounds); i++ {
+		fragment := &Fragment{
+			layout: layout{ file: f },
+			start: bounds[i-1],
+			duration: bounds[i] - bounds[i-1],
+		}
+		moof := &MoofBox{
+			Box: newBox("moof"),
+			mfhd: &MfhdBox{ Box: newBox("mfhd"), sequence_number: uint32(len(fragments) + 1) },
+		}
+		for j, trak := range traks {
+			last := len(trak.samples)
+			if i < len(bounds) - 1 {
+				last = trak.sampleFrom(toTimescale(bounds[i], trak.mdia.mdhd.timescale))
+			}
+			moof.trafs = append(moof.trafs, trak.fragment(first[j], last)...)
+			fragment.addSamples(trak.samples[first[j]:last])
+			first[j] = last
+		}
+		if len(moof.trafs) == 0 {
+			// None of the traks has samples here
+			continue
+		}
+		if err = fragment.build(moof); err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// build lays out the fragment's moof and mdat, pointing each trun at its
+// samples within the mdat. It fails if a trun's data lies beyond the reach
+// of its 32-bit data offset.
+func (fragment *Fragment) build(moof *MoofBox) (os.Error) {
+	// Data offsets are relative to the start of the moof, whose size does
+	// not depend on their values
+	data_size := int64(0)
+	for _, traf := range moof.trafs {
+		for _, trun := range traf.truns {
+			for _, size := range trun.sample_size {
+				data_size += int64(size)
+			}
+		}
+	}
+	mdat := makeBoxHeader("mdat", data_size)
+	offset := int64(len(moof.encode()) + len(mdat))
+	for _, traf := range moof.trafs {
+		for _, trun := range traf.truns {
+			if offset > 0x7FFFFFFF {
+				return os.NewError(fmt.Sprintf("Fragment at %vs is too large for trun data offsets", float64(fragment.start) / 1e9))
+			}
+			trun.data_offset = int32(offset)
+			for _, size := range trun.sample_size {
+				offset += int64(size)
+			}
+		}
+	}
+	fragment.moof = moof
+	fragment.head = append(moof.encode(), mdat...)
+	return nil
+}
+
+// fragment returns the trafs holding samples first through last-1 of the
+// trak, one for each run of samples sharing a sample description. Each is
+// based at the start of its moof.
+func (t *TrakBox) fragment(first, last int) (trafs []*TrafBox) {
+	sdis := t.sampleDescriptionIndexes()
+	cto := t.hasCompositionOffsets()
+	for i := first; i < last; {
+		flags := uint32(TFHD_DEFAULT_BASE_IS_MOOF)
+		if sdis[i] != 1 {
+			flags |= TFHD_SAMPLE_DESCRIPTION_INDEX
+		}
+		trun_flags := uint32(TRUN_DATA_OFFSET | TRUN_SAMPLE_DURATION | TRUN_SAMPLE_SIZE | TRUN_SAMPLE_FLAGS)
+		if cto {
+			trun_flags |= TRUN_SAMPLE_CTO
+		}
+		traf := &TrafBox{
+			Box: newBox("traf"),
+			tfhd: &TfhdBox{
+				Box: newBox("tfhd"),
+				flags: flagBytes(flags),
+				track_id: t.tkhd.track_id,
+				sample_description_index: sdis[i],
+			},
+			tfdt: &TfdtBox{
+				Box: newBox("tfdt"),
+				version: 1,
+				base_media_decode_time: t.samples[i].start_time,
+			},
+		}
+		trun := &TrunBox{ Box: newBox("trun"), flags: flagBytes(trun_flags) }
+		for j := i; j < last && sdis[j] == sdis[i]; j++ {
+			sample := t.samples[j]
+			trun.sample_duration = append(trun.sample_duration, sample.duration)
+			trun.sample_size = append(trun.sample_size, sample.size)
+			if sample.sync {
+				trun.sample_flags = append(trun.sample_flags, SYNC_SAMPLE_FLAGS)
+			} else
+			{
+				trun.sample_flags = append(trun.sample_flags, NON_SYNC_SAMPLE_FLAGS)
+			}
+			if cto {
+				trun.sample_cto = append(trun.sample_cto, sample.cto)
+				// Negative offsets, as from a version 1 ctts, need a
+				// version 1 trun
+				if int32(sample.cto) < 0 {
+					trun.version = 1
+				}
+			}
+			trun.sample_count++
+		}
+		traf.truns = []*TrunBox{ trun }
+		trafs = append(trafs, traf)
+		i += int(trun.sample_count)
+	}
+	return trafs
+}
+
+// sampleDescriptionIndexes returns the sample description index of each
+// sample of the trak.
+func (t *TrakBox) sampleDescriptionIndexes() ([]uint32) {
+	sdis := make([]uint32, len(t.samples))
+	for _, chunk := range t.chunks {
+		for i := 0; i < int(chunk.sample_count); i++ {
+			if n := int(chunk.start_sample) - 1 + i; n < len(sdis) {
+				sdis[n] = chunk.sample_description_index
+			}
+		}
+	}
+	return sdis
+}
+
+// sampleFrom returns the index of the first sample decoded at or after time
+// ts, given in the trak's timescale, or len(t.samples) if there is none: the
+// sample being decoded at ts, as found by sampleAt, or the one after it.
+func (t *TrakBox) sampleFrom(ts uint64) (int) {
+	i := t.sampleAt(ts)
+	if i < len(t.samples) && t.samples[i].start_time < ts {
+		i++
+	}
+	return i
+}
+
+// StartTime returns the time at which the fragment starts, in nanoseconds.
+func (fragment *Fragment) StartTime() (int64) {
+	return fragment.start
+}
+
+// Duration returns the length of the fragment in nanoseconds.
+func (fragment *Fragment) Duration() (int64) {
+	return fragment.duration
+}
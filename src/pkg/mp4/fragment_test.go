@@ -0,0 +1,70 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	var buf bytes.Buffer
+	if err := f.Fragment(1e9, &buf); err != nil {
+		t.Fatal(err)
+	}
+	fragmented := openBytes(t, buf.Bytes())
+	defer closeTemp(fragmented)
+
+	if len(fragmented.moofs) != 3 {
+		t.Errorf("%v fragments, want 3", len(fragmented.moofs))
+	}
+	for i, moof := range fragmented.moofs {
+		if len(moof.trafs) != 2 || moof.mfhd.sequence_number != uint32(i + 1) {
+			t.Errorf("Fragment %v has %v trafs and sequence number %v", i, len(moof.trafs), moof.mfhd.sequence_number)
+		}
+	}
+	for i, trak := range f.moov.traks {
+		checkSamples(t, fragmented.moov.traks[i], trak, 0, len(trak.samples))
+	}
+	brands := fragmented.ftyp.compatible_brands
+	iso6 := false
+	for _, brand := range brands {
+		iso6 = iso6 || brand == "iso6"
+		if brand == "cmfc" {
+			t.Error("Fragments muxing several traks claim cmfc")
+		}
+	}
+	if !iso6 {
+		t.Errorf("Compatible brands are %v", brands)
+	}
+}
+
+func TestFragmentNegativeCompositionOffsets(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	negative := int32(-512)
+	f.moov.traks[0].samples[1].cto = uint32(negative)
+
+	fragments, err := f.Fragments(1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trun := fragments[0].moof.trafs[0].truns[0]; trun.version != 1 {
+		t.Error("trun with a negative offset is not version 1")
+	}
+	if trun := fragments[1].moof.trafs[0].truns[0]; trun.version != 0 {
+		t.Error("trun without negative offsets is not version 0")
+	}
+}
+
+func TestFragmentDataOffsetOverflow(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	// The sizes are only used to lay out the moof
+	for i := range f.moov.traks[0].samples {
+		f.moov.traks[0].samples[i].size = 1 << 30
+	}
+	if _, err := f.Fragments(10e9); err == nil {
+		t.Error("Fragment with data past 2 GiB built")
+	}
+}
@@ -0,0 +1,210 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// HLS_VERSION is the protocol version of the playlists, the first to allow
+// fMP4 segments.
+const HLS_VERSION = 7
+
+// An HLS presentation of a File: the file cut into fMP4 segments at sync
+// samples, as described by Fragments, with the playlists that list them.
+type HLS struct {
+	file *File
+	init []byte
+	segments []*Fragment
+	duration int64 // Target segment duration in nanoseconds
+}
+
+// NewHLS cuts f into segments of about the given duration in nanoseconds.
+func (f *File) NewHLS(duration int64) (h *HLS, err os.Error) {
+	h = &HLS{ file: f, init: f.InitSegment(), duration: duration }
+	h.segments, err = f.Fragments(duration)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Init returns the init segment, the ftyp and moov that segments need to
+// be decoded.
+func (h *HLS) Init() ([]byte) {
+	return h.init
+}
+
+// Segments returns the media segments in order.
+func (h *HLS) Segments() ([]*Fragment) {
+	return h.segments
+}
+
+// MasterPlaylist returns a master playlist with a single variant, the
+// media playlist at the given URI.
+func (h *HLS) MasterPlaylist(media_uri string) (string) {
+	// The peak bandwidth is that of the densest segment
+	bandwidth, total_size, total_duration := int64(0), int64(0), int64(0)
+	for _, segment := range h.segments {
+		if segment.Duration() > 0 {
+			if b := segment.Size() * 8 * 1e9 / segment.Duration(); b > bandwidth {
+				bandwidth = b
+			}
+		}
+		total_size += segment.Size()
+		total_duration += segment.Duration()
+	}
+
+	var codecs []string
+	resolution := ""
+	for _, trak := range h.file.Traks() {
+		// Players skip variants listing codecs they do not know, such as
+		// those of timed text, so only video and audio are listed
+		handler := trak.HandlerType()
+		if codec := trak.Codec(); codec != "" && (handler == "vide" || handler == "soun") {
+			codecs = append(codecs, codec)
+		}
+		if trak.HandlerType() == "vide" && resolution == "" {
+			resolution = fmt.Sprintf(",RESOLUTION=%vx%v", trak.Width(), trak.Height())
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "#EXTM3U")
+	fmt.Fprintf(buf, "#EXT-X-VERSION:%v\n", HLS_VERSION)
+	fmt.Fprintln(buf, "#EXT-X-INDEPENDENT-SEGMENTS")
+	fmt.Fprintf(buf, "#EXT-X-STREAM-INF:BANDWIDTH=%v", bandwidth)
+	if total_duration > 0 {
+		fmt.Fprintf(buf, ",AVERAGE-BANDWIDTH=%v", total_size * 8 * 1e9 / total_duration)
+	}
+	if len(codecs) > 0 {
+		fmt.Fprintf(buf, ",CODECS=\"%v\"", strings.Join(codecs, ","))
+	}
+	fmt.Fprintf(buf, "%v\n", resolution)
+	fmt.Fprintln(buf, media_uri)
+	return buf.String()
+}
+
+// MediaPlaylist returns a media playlist of separate segment files: the
+// init segment at init_uri and segment i (counting from 0) at the URI made
+// by formatting segment_pattern with i, e.g. "segment%d.m4s".
+func (h *HLS) MediaPlaylist(init_uri, segment_pattern string) (string) {
+	var durations []int64
+	for _, segment := range h.segments {
+		durations = append(durations, segment.Duration())
+	}
+	buf := playlistHeader(durations)
+	fmt.Fprintf(buf, "#EXT-X-MAP:URI=\"%v\"\n", init_uri)
+	for i, segment := range h.segments {
+		fmt.Fprintf(buf, "#EXTINF:%.3f,\n", float64(segment.Duration()) / 1e9)
+		fmt.Fprintln(buf, fmt.Sprintf(segment_pattern, i))
+	}
+	fmt.Fprintln(buf, "#EXT-X-ENDLIST")
+	return buf.String()
+}
+
+// ByteRangePlaylist returns a media playlist addressing the file itself at
+// uri by byte ranges, with no segments written. The file must be fragmented:
+// the init segment is the range ending with its moov, and each segment is a
+// run of its moof and mdat pairs, starting at a moof that begins with a sync
+// sample and lasting about the duration given to NewHLS. Progressive files
+// can be fragmented first with File.Fragment.
+func (h *HLS) ByteRangePlaylist(uri string) (string, os.Error) {
+	f := h.file
+	if len(f.moofs) == 0 {
+		return "", os.NewError("Byte range playlists need a fragmented file")
+	}
+	init_size := f.moov.Start() + f.moov.Size()
+	if init_size > f.moofs[0].Start() {
+		return "", os.NewError("The moov follows the first movie fragment")
+	}
+
+	// The first sample of the reference trak in each moof, if any
+	ref := f.moov.traks[0]
+	for _, trak := range f.moov.traks {
+		if !trak.allSync() {
+			ref = trak
+			break
+		}
+	}
+	first := make([]int, len(f.moofs))
+	for i := range first {
+		first[i] = -1
+	}
+	for _, chunk := range ref.chunks {
+		i := sort.Search(len(f.moofs), func(i int) bool {
+			return uint64(f.moofs[i].Start()) > chunk.offset
+		}) - 1
+		if i >= 0 && first[i] < 0 && chunk.sample_count > 0 {
+			first[i] = int(chunk.start_sample) - 1
+		}
+	}
+
+	// Segments start at the first moof and then at the first moof
+	// beginning with a sync sample at least the duration later
+	starts, times := []int{ 0 }, []int64{ 0 }
+	for i := 1; i < len(f.moofs); i++ {
+		if first[i] < 0 || !ref.samples[first[i]].sync {
+			continue
+		}
+		t := fromTimescale(ref.samples[first[i]].start_time, ref.mdia.mdhd.timescale)
+		if t - times[len(times)-1] >= h.duration {
+			starts = append(starts, i)
+			times = append(times, t)
+		}
+	}
+	// The last segment runs to the end of the last mdat or moof
+	end := int64(0)
+	for _, box := range f.boxes {
+		if name := box.Name(); (name == "moof" || name == "mdat") && box.Start() + box.Size() > end {
+			end = box.Start() + box.Size()
+		}
+	}
+	times = append(times, f.Duration())
+	durations := make([]int64, len(starts))
+	for i := range durations {
+		durations[i] = times[i+1] - times[i]
+	}
+
+	buf := playlistHeader(durations)
+	fmt.Fprintf(buf, "#EXT-X-MAP:URI=\"%v\",BYTERANGE=\"%v@0\"\n", uri, init_size)
+	for i, start := range starts {
+		offset, next := f.moofs[start].Start(), end
+		if i + 1 < len(starts) {
+			next = f.moofs[starts[i+1]].Start()
+		}
+		fmt.Fprintf(buf, "#EXTINF:%.3f,\n", float64(durations[i]) / 1e9)
+		fmt.Fprintf(buf, "#EXT-X-BYTERANGE:%v@%v\n", next - offset, offset)
+		fmt.Fprintln(buf, uri)
+	}
+	fmt.Fprintln(buf, "#EXT-X-ENDLIST")
+	return buf.String(), nil
+}
+
+// playlistHeader starts a media playlist of segments lasting the given
+// durations in nanoseconds.
+func playlistHeader(durations []int64) (*bytes.Buffer) {
+	// The target duration is the longest segment, rounded to the nearest
+	// second
+	longest := int64(0)
+	for _, d := range durations {
+		if d > longest {
+			longest = d
+		}
+	}
+	target := (longest + 5e8) / 1e9
+	if target < 1 {
+		target = 1
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "#EXTM3U")
+	fmt.Fprintf(buf, "#EXT-X-VERSION:%v\n", HLS_VERSION)
+	fmt.Fprintf(buf, "#EXT-X-TARGETDURATION:%v\n", target)
+	fmt.Fprintln(buf, "#EXT-X-MEDIA-SEQUENCE:0")
+	fmt.Fprintln(buf, "#EXT-X-PLAYLIST-TYPE:VOD")
+	fmt.Fprintln(buf, "#EXT-X-INDEPENDENT-SEGMENTS")
+	return buf
+}
@@ -0,0 +1,100 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHLSPlaylists(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	h, err := f.NewHLS(1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Segments()) != 3 {
+		t.Fatalf("%v segments, want 3", len(h.Segments()))
+	}
+
+	master := h.MasterPlaylist("media.m3u8")
+	for _, want := range []string{ "#EXT-X-STREAM-INF:BANDWIDTH=", "CODECS=\"avc1.64001f,mp4a.40.2\"", "RESOLUTION=640x360", "\nmedia.m3u8\n" } {
+		if !strings.Contains(master, want) {
+			t.Errorf("Master playlist lacks %q:\n%v", want, master)
+		}
+	}
+	// Other tracks' codecs are not listed
+	f.moov.traks[1].mdia.hdlr.handler_type = "text"
+	if master = h.MasterPlaylist("media.m3u8"); !strings.Contains(master, "CODECS=\"avc1.64001f\",") {
+		t.Errorf("Master playlist lists the codec of a text track:\n%v", master)
+	}
+	f.moov.traks[1].mdia.hdlr.handler_type = "soun"
+
+	media := h.MediaPlaylist("init.mp4", "seg-%d.m4s")
+	want := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"#EXTINF:1.000,\nseg-0.m4s\n#EXTINF:1.000,\nseg-1.m4s\n#EXTINF:1.000,\nseg-2.m4s\n#EXT-X-ENDLIST\n"
+	if media != want {
+		t.Errorf("Media playlist is\n%v\nwant\n%v", media, want)
+	}
+}
+
+func TestHLSByteRanges(t *testing.T) {
+	data := fixture{ frag: true }.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+	h, err := f.NewHLS(1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, err := h.ByteRangePlaylist("video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ranges cover the original file from its start, in order
+	var init_size, end int64
+	if _, err = fmt.Sscanf(playlist[strings.Index(playlist, "BYTERANGE=\""):], "BYTERANGE=\"%d@0\"", &init_size); err != nil {
+		t.Fatalf("No init segment range in\n%v", playlist)
+	}
+	end = init_size
+	segments := 0
+	for _, line := range strings.Split(playlist, "\n") {
+		if !strings.HasPrefix(line, "#EXT-X-BYTERANGE:") {
+			continue
+		}
+		var size, offset int64
+		fmt.Sscanf(line, "#EXT-X-BYTERANGE:%d@%d", &size, &offset)
+		if offset != end || string(data[offset + 4:offset + 8]) != "moof" {
+			t.Errorf("Segment %v at %v does not start with a moof following the last segment", segments, offset)
+		}
+		end = offset + size
+		segments++
+	}
+	if segments != 3 || end != int64(len(data)) {
+		t.Errorf("%v segments end at %v of %v bytes", segments, end, len(data))
+	}
+	if strings.Count(playlist, "#EXTINF:1.000,\n#EXT-X-BYTERANGE:") != 3 || strings.Count(playlist, "\nvideo.mp4\n") != 3 || !strings.Contains(playlist, "#EXT-X-TARGETDURATION:1\n") {
+		t.Errorf("Unexpected playlist\n%v", playlist)
+	}
+
+	// The init range is the ftyp and moov
+	init := openBytes(t, data[:init_size])
+	defer closeTemp(init)
+	if init.moov == nil || init.moov.mvex == nil || !bytes.Equal(data[:init_size], init.ReadBytesAt(init_size, 0)) {
+		t.Error("The init range is not an init segment")
+	}
+}
+
+func TestHLSByteRangesProgressive(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	h, err := f.NewHLS(1e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h.ByteRangePlaylist("video.mp4"); err == nil {
+		t.Error("Byte range playlist of a progressive file made")
+	}
+}
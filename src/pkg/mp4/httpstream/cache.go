@@ -0,0 +1,160 @@
+package httpstream
+
+import (
+	"container/list"
+	"mp4"
+	"os"
+	"sync"
+)
+
+// MaxPresentations is the most parsed files kept for later requests by
+// ServeFile and ServePackaged. Beyond it, the least recently used file is
+// closed, once the requests using it are done.
+var MaxPresentations = 64
+
+// A presentation is a parsed MP4 file and the packagings of it built so far
+// by ServePackaged, which are kept until the file is modified or evicted.
+type presentation struct {
+	sync.Mutex // Guards the packagings
+	name string
+	mtime_ns int64
+	ready chan bool // Closed once the file is parsed
+	file *mp4.File
+	err os.Error
+	hls *mp4.HLS
+	dash *mp4.DASH
+	flv *mp4.FLV
+
+	// Guarded by presentations
+	refs int // Requests using the file, which is closed at 0 once evicted
+	evicted bool
+	element *list.Element
+}
+
+// presentations holds the presentation of each file served, by path, and
+// their order of use, most recent first.
+var presentations = struct {
+	sync.Mutex
+	m map[string]*presentation
+	lru *list.List
+}{ m: make(map[string]*presentation), lru: list.New() }
+
+// openPresentation returns the presentation of the MP4 file name, last
+// modified at mtime_ns, parsing the file if it has not been seen since then.
+// A file is parsed once however many requests ask for it meanwhile, and
+// without holding up requests for other files. The caller calls release
+// when done with the presentation.
+func openPresentation(name string, mtime_ns int64) (*presentation, os.Error) {
+	presentations.Lock()
+	p, ok := presentations.m[name]
+	if ok && p.mtime_ns != mtime_ns {
+		p.evict()
+		ok = false
+	}
+	if ok {
+		presentations.lru.MoveToFront(p.element)
+	} else
+	{
+		p = &presentation{ name: name, mtime_ns: mtime_ns, ready: make(chan bool) }
+		presentations.m[name] = p
+		p.element = presentations.lru.PushFront(p)
+		for presentations.lru.Len() > MaxPresentations && presentations.lru.Len() > 1 {
+			presentations.lru.Back().Value.(*presentation).evict()
+		}
+	}
+	p.refs++
+	presentations.Unlock()
+
+	if ok {
+		<-p.ready
+	} else
+	{
+		f, err := mp4.Open(name)
+		if err != nil && f != nil {
+			f.Close()
+			f = nil
+		}
+		p.file, p.err = f, err
+		close(p.ready)
+		if err != nil {
+			// Failures are not kept, so the file is tried again next time
+			presentations.Lock()
+			if !p.evicted {
+				p.evict()
+			}
+			presentations.Unlock()
+		}
+	}
+	if p.err != nil {
+		p.release()
+		return nil, p.err
+	}
+	return p, nil
+}
+
+// evict removes the presentation from presentations, closing its file if no
+// request is using it. presentations must be locked.
+func (p *presentation) evict() {
+	if presentations.m[p.name] == p {
+		presentations.m[p.name] = nil, false
+	}
+	presentations.lru.Remove(p.element)
+	p.evicted = true
+	if p.refs == 0 && p.file != nil {
+		p.file.Close()
+	}
+}
+
+// release ends a request's use of the presentation.
+func (p *presentation) release() {
+	presentations.Lock()
+	defer presentations.Unlock()
+	p.refs--
+	if p.refs == 0 && p.evicted && p.file != nil {
+		p.file.Close()
+	}
+}
+
+// HLS returns the HLS presentation of the file, cut into segments of
+// SegmentDuration.
+func (p *presentation) HLS() (*mp4.HLS, os.Error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.hls == nil {
+		h, err := p.file.NewHLS(SegmentDuration)
+		if err != nil {
+			return nil, err
+		}
+		p.hls = h
+	}
+	return p.hls, nil
+}
+
+// DASH returns the DASH presentation of the file, cut into segments of
+// SegmentDuration.
+func (p *presentation) DASH() (*mp4.DASH, os.Error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.dash == nil {
+		d, err := p.file.NewDASH(SegmentDuration)
+		if err != nil {
+			return nil, err
+		}
+		p.dash = d
+	}
+	return p.dash, nil
+}
+
+// FLV returns the FLV remux of the file.
+func (p *presentation) FLV() (*mp4.FLV, os.Error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.flv == nil {
+		v, err := p.file.NewFLV()
+		if err != nil {
+			return nil, err
+		}
+		p.flv = v
+	}
+	return p.flv, nil
+}
@@ -0,0 +1,204 @@
+// Package httpstream serves MP4 files over HTTP for pseudo-streaming
+// players, in the manner of the nginx and lighttpd mod_h264_streaming
+// modules.
+package httpstream
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contentTypes maps the file extensions served by FileServer to their MIME
+// types.
+var contentTypes = map[string]string{
+	".mp4": "video/mp4",
+	".m4v": "video/mp4",
+	".m4a": "audio/mp4",
+}
+
+// Handler serves the MP4 file at Path. See ServeFile.
+type Handler struct {
+	Path string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ServeFile(w, r, h.Path)
+}
+
+// FileServer returns a handler that serves the MP4 files beneath root with
+// ServeFile, and their HLS and DASH presentations with ServePackaged under
+// paths such as /video.mp4/master.m3u8. Requests for other files are
+// answered with 404 Not Found.
+func FileServer(root string) http.Handler {
+	return &fileHandler{ root: root }
+}
+
+type fileHandler struct {
+	root string
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	// Parts of a presentation, such as init.mp4, may look like MP4s too
+	if dir := path.Dir(name); isMP4(dir) {
+		ServePackaged(w, r, filepath.Join(h.root, filepath.FromSlash(dir)), path.Base(name))
+		return
+	}
+	if isMP4(name) {
+		ServeFile(w, r, filepath.Join(h.root, filepath.FromSlash(name)))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// isMP4 reports whether name has the extension of an MP4 file.
+func isMP4(name string) (bool) {
+	_, ok := contentTypes[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// ServeFile replies to the request with the MP4 file name. If the request
+// has a start or end query parameter, given in seconds, the reply is a new
+// MP4 holding only that part of the file, beginning at the closest keyframe
+// before start. Otherwise the file is served as is. Either way, single byte
+// ranges are supported.
+func ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	start, err := parseSeconds(r.FormValue("start"))
+	if err != nil {
+		http.Error(w, "Invalid start: " + err.String(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseSeconds(r.FormValue("end"))
+	if err != nil {
+		http.Error(w, "Invalid end: " + err.String(), http.StatusBadRequest)
+		return
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil || fi.IsDirectory() {
+		http.NotFound(w, r)
+		return
+	}
+	mtime := fi.Mtime_ns / 1e9
+	ctype, ok := contentTypes[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		ctype = "video/mp4"
+	}
+
+	if start == 0 && end == 0 {
+		file, err := os.Open(name)
+		if err != nil {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		serveContent(w, r, file, fi.Size, ctype, mtime)
+		return
+	}
+
+	// The parsed file is kept for later seeks, as for ServePackaged
+	p, err := openPresentation(name, fi.Mtime_ns)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	defer p.release()
+	clip, err := p.file.NewClip(start, end)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return
+	}
+	serveContent(w, r, clip, clip.Size(), ctype, mtime)
+}
+
+// serveContent replies with size bytes of content, or the part of it asked
+// for by a Range header. mtime is the modification time in seconds.
+func serveContent(w http.ResponseWriter, r *http.Request, content io.ReaderAt, size int64, ctype string, mtime int64) {
+	start, length := int64(0), size
+	code := http.StatusOK
+	// Multiple ranges are not supported; they get the whole content
+	if rng := r.Header.Get("Range"); rng != "" && !strings.Contains(rng, ",") {
+		var err os.Error
+		start, length, err = parseRange(rng, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.String(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start + length - 1, size))
+		code = http.StatusPartialContent
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.Itoa64(length))
+	w.Header().Set("Last-Modified", time.SecondsToUTC(mtime).Format(http.TimeFormat))
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, io.NewSectionReader(content, start, length))
+}
+
+// parseRange parses a single range Range header such as "bytes=0-499",
+// "bytes=500-" or "bytes=-500" against content of the given size.
+func parseRange(s string, size int64) (start, length int64, err os.Error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, os.NewError("Invalid range")
+	}
+	spec := strings.TrimSpace(s[len("bytes="):])
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, os.NewError("Invalid range")
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, err := strconv.Atoi64(last)
+		if err != nil || n <= 0 {
+			return 0, 0, os.NewError("Invalid range")
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+	start, err = strconv.Atoi64(first)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, os.NewError("Invalid range")
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.Atoi64(last)
+		if err != nil || end < start {
+			return 0, 0, os.NewError("Invalid range")
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// parseSeconds converts a query parameter in seconds to nanoseconds. An
+// empty parameter is 0.
+func parseSeconds(s string) (int64, os.Error) {
+	if s == "" {
+		return 0, nil
+	}
+	secs, err := strconv.Atof64(s)
+	if err != nil {
+		return 0, err
+	}
+	if secs < 0 {
+		return 0, os.NewError("negative time")
+	}
+	return int64(secs * 1e9), nil
+}
@@ -0,0 +1,242 @@
+package httpstream
+
+import (
+	"bytes"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"mp4"
+	"os"
+	"strconv"
+	"testing"
+)
+
+var rangeTests = []struct {
+	header string
+	start, length int64
+	ok bool
+}{
+	{ "bytes=0-499", 0, 500, true },
+	{ "bytes=500-", 500, 500, true },
+	{ "bytes=-300", 700, 300, true },
+	{ "bytes=-3000", 0, 1000, true },
+	{ "bytes=900-5000", 900, 100, true },
+	{ "bytes=1000-", 0, 0, false },
+	{ "bytes=500-400", 0, 0, false },
+	{ "bytes=-0", 0, 0, false },
+	{ "items=0-1", 0, 0, false },
+	{ "bytes=a-b", 0, 0, false },
+}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range rangeTests {
+		start, length, err := parseRange(test.header, 1000)
+		if (err == nil) != test.ok {
+			t.Errorf("parseRange(%q) error %v", test.header, err)
+			continue
+		}
+		if test.ok && (start != test.start || length != test.length) {
+			t.Errorf("parseRange(%q) = %v, %v, want %v, %v", test.header, start, length, test.start, test.length)
+		}
+	}
+}
+
+func TestParseSeconds(t *testing.T) {
+	if ns, err := parseSeconds(""); ns != 0 || err != nil {
+		t.Errorf("parseSeconds(\"\") = %v, %v", ns, err)
+	}
+	if ns, err := parseSeconds("1.5"); ns != 15e8 || err != nil {
+		t.Errorf("parseSeconds(\"1.5\") = %v, %v", ns, err)
+	}
+	if _, err := parseSeconds("-1"); err == nil {
+		t.Error("parseSeconds(\"-1\") succeeded")
+	}
+	if _, err := parseSeconds("x"); err == nil {
+		t.Error("parseSeconds(\"x\") succeeded")
+	}
+}
+
+// serve records the reply to a GET of url with the given Range header, if
+// not empty.
+func serve(t *testing.T, h http.Handler, url, rng string) (*httptest.ResponseRecorder) {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		r.Header.Set("Range", rng)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// tempFile writes data to a temporary file with the given name in a new
+// directory, and returns the directory.
+func tempFile(t *testing.T, name string, data []byte) (string) {
+	dir, err := ioutil.TempDir("", "httpstream_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir + "/" + name, data, 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestServeFileRanges(t *testing.T) {
+	data := []byte("0123456789")
+	dir := tempFile(t, "a.mp4", data)
+	defer os.RemoveAll(dir)
+	h := &Handler{ Path: dir + "/a.mp4" }
+
+	w := serve(t, h, "/a.mp4", "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Whole file: %v %q", w.Code, w.Body.Bytes())
+	}
+	if ctype := w.HeaderMap.Get("Content-Type"); ctype != "video/mp4" {
+		t.Errorf("Content-Type is %q", ctype)
+	}
+
+	w = serve(t, h, "/a.mp4", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("Range: %v %q", w.Code, w.Body.Bytes())
+	}
+	if cr := w.HeaderMap.Get("Content-Range"); cr != "bytes 2-4/10" {
+		t.Errorf("Content-Range is %q", cr)
+	}
+
+	w = serve(t, h, "/a.mp4", "bytes=20-")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Unsatisfiable range: %v", w.Code)
+	}
+	if cr := w.HeaderMap.Get("Content-Range"); cr != "bytes */10" {
+		t.Errorf("Content-Range is %q", cr)
+	}
+}
+
+func TestServeFileErrors(t *testing.T) {
+	dir := tempFile(t, "a.mp4", []byte("not an mp4"))
+	defer os.RemoveAll(dir)
+	h := &Handler{ Path: dir + "/a.mp4" }
+
+	if w := serve(t, h, "/a.mp4?start=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid start: %v", w.Code)
+	}
+	if w := serve(t, h, "/a.mp4?start=1", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Clip of an invalid file: %v", w.Code)
+	}
+	h.Path = dir + "/missing.mp4"
+	if w := serve(t, h, "/missing.mp4", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Missing file: %v", w.Code)
+	}
+}
+
+func TestFileServer(t *testing.T) {
+	dir := tempFile(t, "a.mp4", []byte("0123456789"))
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir + "/notes.txt", []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := FileServer(dir)
+
+	if w := serve(t, h, "/a.mp4", ""); w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("MP4: %v %q", w.Code, w.Body.Bytes())
+	}
+	for _, url := range []string{ "/notes.txt", "/b.mp4", "/a.mp4/other.m3u8", "/" } {
+		if w := serve(t, h, url, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%v: %v, want 404", url, w.Code)
+		}
+	}
+	// Paths are kept beneath the root
+	if w := serve(t, h, "/../a.mp4", ""); w.Code != http.StatusOK {
+		t.Errorf("/../a.mp4: %v", w.Code)
+	}
+}
+
+// testGOP is a group of ten pictures of H.264 baseline video, 640x360 at 25
+// frames per second, in an Annex B stream: parameter sets, an IDR picture,
+// then P and B pictures.
+var testGOP = []byte{
+	0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1E, 0xED, 0x81, 0x40, 0x5F, 0xF2, 0xC2, 0x00, 0x00,
+	0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x65, 0x00, 0x00, 0x00, 0x01, 0x68, 0xCE, 0x38, 0x80,
+	0x00, 0x00, 0x00, 0x01, 0x65, 0xB8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x01, 0xAA, 0x00, 0x00, 0x00,
+	0x01, 0x41, 0xE2, 0x30, 0x01, 0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x01, 0xA9,
+	0x04, 0x02, 0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x01, 0xA9, 0x88, 0x03, 0x00,
+	0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x41, 0xE8, 0x60, 0x04, 0x00, 0x00, 0x03, 0x01,
+	0xAA, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAA, 0x90, 0x05, 0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00,
+	0x00, 0x01, 0x01, 0xAB, 0x14, 0x06, 0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x41,
+	0xEE, 0x90, 0x07, 0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAC, 0x1C, 0x08,
+	0x00, 0x00, 0x03, 0x01, 0xAA, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAC, 0xA0, 0x09, 0x00, 0x00, 0x03,
+	0x01, 0xAA,
+}
+
+// testVideo returns an MP4 of five GOPs of video, two seconds with a
+// keyframe every 0.4 seconds.
+func testVideo(t *testing.T) ([]byte) {
+	stream := bytes.Repeat(testGOP, 5)
+	m := new(mp4.Mux)
+	if err := m.AddH264(byteContent(stream), int64(len(stream)), 25); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServeFileClip(t *testing.T) {
+	dir := tempFile(t, "a.mp4", testVideo(t))
+	defer os.RemoveAll(dir)
+	h := FileServer(dir)
+
+	// 1s falls in the GOP starting at 0.8s, and 1.5s in the picture
+	// decoded from 1.48s
+	w := serve(t, h, "/a.mp4?start=1&end=1.5", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Clip: %v %q", w.Code, w.Body.String())
+	}
+	if length := w.HeaderMap.Get("Content-Length"); length != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length is %v for %v bytes", length, w.Body.Len())
+	}
+	clip_dir := tempFile(t, "clip.mp4", w.Body.Bytes())
+	defer os.RemoveAll(clip_dir)
+	f, err := mp4.Open(clip_dir + "/clip.mp4")
+	if f != nil {
+		defer f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := f.Tracks()[0]
+	if video.SampleCount() != 18 {
+		t.Errorf("Clip has %v pictures, want 18", video.SampleCount())
+	}
+	first, err := video.Sample(0)
+	if err != nil || !first.Sync() {
+		t.Errorf("Clip starts with %+v, %v", first, err)
+	}
+	// The picture is the IDR one, after its length
+	data, err := video.ReadSample(0)
+	if err != nil || len(data) < 5 || data[4] != 0x65 || !bytes.Contains(testGOP, data[4:]) {
+		t.Errorf("Clip starts with picture % x, %v", data, err)
+	}
+	if d := f.Duration(); d != 72e7 {
+		t.Errorf("Clip lasts %v, want 0.72s", d)
+	}
+
+	// Clips to the end of the file support ranges too, and are cut from
+	// the same parsed file
+	w = serve(t, h, "/a.mp4?start=1", "bytes=0-3")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 4 || w.HeaderMap.Get("Content-Length") != "4" {
+		t.Errorf("Clip range: %v %q", w.Code, w.Body.Bytes())
+	}
+	if presentations.m[dir + "/a.mp4"] == nil {
+		t.Error("Parsed file was not kept")
+	}
+	if w = serve(t, h, "/a.mp4?start=10", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Clip past the end: %v", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package httpstream
+
+import (
+	"http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SegmentDuration is the target duration, in nanoseconds, of the segments
+// served by ServePackaged. Presentations are kept once built, so it should be
+// set before any are served.
+var SegmentDuration = int64(6e9)
+
+// Content types of the parts of a packaged presentation
+const (
+	HLS_CONTENT_TYPE = "application/vnd.apple.mpegurl"
+	DASH_CONTENT_TYPE = "application/dash+xml"
+	SEGMENT_CONTENT_TYPE = "video/iso.segment"
+	FLV_CONTENT_TYPE = "video/x-flv"
+)
+
+// ServePackaged replies to a request for part of an HLS or DASH presentation
+// of the MP4 file name, or for its FLV remux. Nothing is written to disk: the
+// segments are cut at the file's sync samples and their moof and mdat built
+// in memory, which is kept for later requests until the file is modified
+// or is among the least recently used beyond MaxPresentations.
+// The parts, relative to the file, are
+//
+//	master.m3u8   the HLS master playlist
+//	media.m3u8    the HLS media playlist
+//	init.mp4      the HLS init segment
+//	seg-N.m4s     HLS segment N, counting from 0
+//	manifest.mpd  the DASH MPD
+//	track-N.mp4   the DASH representation of the track with ID N
+//	video.flv     the FLV, from the byte offset given by a start query
+//	              parameter, as Flash players ask for it
+//
+// FileServer answers requests such as /video.mp4/master.m3u8 this way.
+func ServePackaged(w http.ResponseWriter, r *http.Request, name, part string) {
+	fi, err := os.Stat(name)
+	if err != nil || fi.IsDirectory() {
+		http.NotFound(w, r)
+		return
+	}
+	mtime := fi.Mtime_ns / 1e9
+
+	hls := part == "master.m3u8" || part == "media.m3u8" || part == "init.mp4"
+	n, numbered := partNumber(part, "seg-", ".m4s")
+	hls = hls || numbered
+	dash := part == "manifest.mpd"
+	track_id, track := partNumber(part, "track-", ".mp4")
+	dash = dash || track
+	flv := part == "video.flv"
+	if !hls && !dash && !flv {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := openPresentation(name, fi.Mtime_ns)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	defer p.release()
+
+	if flv {
+		serveFLV(w, r, p, mtime)
+		return
+	}
+
+	if hls {
+		h, err := p.HLS()
+		if err != nil {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case part == "master.m3u8":
+			serveBytes(w, r, []byte(h.MasterPlaylist("media.m3u8")), HLS_CONTENT_TYPE, mtime)
+		case part == "media.m3u8":
+			serveBytes(w, r, []byte(h.MediaPlaylist("init.mp4", "seg-%d.m4s")), HLS_CONTENT_TYPE, mtime)
+		case part == "init.mp4":
+			serveBytes(w, r, h.Init(), "video/mp4", mtime)
+		case n < len(h.Segments()):
+			segment := h.Segments()[n]
+			serveContent(w, r, segment, segment.Size(), SEGMENT_CONTENT_TYPE, mtime)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	d, err := p.DASH()
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	if part == "manifest.mpd" {
+		serveBytes(w, r, []byte(d.MPD("track-%d.mp4")), DASH_CONTENT_TYPE, mtime)
+		return
+	}
+	for _, rep := range d.Representations() {
+		if int(rep.TrackID()) == track_id {
+			serveContent(w, r, rep, rep.Size(), "video/mp4", mtime)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveFLV replies with the FLV of p, from the start of the tag at the byte
+// offset in the start query parameter, if there is one.
+func serveFLV(w http.ResponseWriter, r *http.Request, p *presentation, mtime int64) {
+	v, err := p.FLV()
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	if start := r.FormValue("start"); start != "" && start != "0" {
+		offset, err := strconv.Atoi64(start)
+		if err != nil {
+			http.Error(w, "Invalid start: " + err.String(), http.StatusBadRequest)
+			return
+		}
+		if v, err = v.From(offset); err != nil {
+			http.Error(w, err.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	serveContent(w, r, v, v.Size(), FLV_CONTENT_TYPE, mtime)
+}
+
+// partNumber returns the number in a part named prefix + number + suffix,
+// and whether part is named that way.
+func partNumber(part, prefix, suffix string) (int, bool) {
+	if !strings.HasPrefix(part, prefix) || !strings.HasSuffix(part, suffix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(part[len(prefix):len(part) - len(suffix)])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// serveBytes replies with content held in memory. See serveContent.
+func serveBytes(w http.ResponseWriter, r *http.Request, content []byte, ctype string, mtime int64) {
+	serveContent(w, r, byteContent(content), int64(len(content)), ctype, mtime)
+}
+
+// byteContent reads a byte slice as an io.ReaderAt.
+type byteContent []byte
+
+func (b byteContent) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off >= int64(len(b)) {
+		return 0, os.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = os.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,174 @@
+package httpstream
+
+import (
+	"bytes"
+	"http"
+	"mp4"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testMP4 returns a progressive MP4 of 100 frames of AAC, about 2.3 seconds
+// at 44.1 kHz.
+func testMP4(t *testing.T) ([]byte) {
+	var adts []byte
+	for i := 0; i < 100; i++ {
+		length := 7 + 20
+		adts = append(adts, 0xFF, 0xF1, 0x50, 0x80, byte(length >> 3), byte(length & 7) << 5 | 0x1F, 0xFC)
+		adts = append(adts, bytes.Repeat([]byte{ byte(i) }, 20)...)
+	}
+	m := new(mp4.Mux)
+	if err := m.AddAAC(byteContent(adts), int64(len(adts))); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServePackaged(t *testing.T) {
+	dir := tempFile(t, "a.mp4", testMP4(t))
+	defer os.RemoveAll(dir)
+	h := FileServer(dir)
+
+	w := serve(t, h, "/a.mp4/master.m3u8", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `CODECS="mp4a.40.2"`) {
+		t.Errorf("Master playlist: %v %q", w.Code, w.Body.String())
+	}
+	if ctype := w.HeaderMap.Get("Content-Type"); ctype != HLS_CONTENT_TYPE {
+		t.Errorf("Content-Type is %q", ctype)
+	}
+	w = serve(t, h, "/a.mp4/media.m3u8", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "seg-0.m4s") || strings.Contains(w.Body.String(), "seg-1.m4s") {
+		t.Errorf("Media playlist: %v %q", w.Code, w.Body.String())
+	}
+	if w = serve(t, h, "/a.mp4/seg-0.m4s", "bytes=4-7"); w.Code != http.StatusPartialContent || w.Body.String() != "moof" {
+		t.Errorf("Segment: %v %q", w.Code, w.Body.Bytes())
+	}
+	if w = serve(t, h, "/a.mp4/manifest.mpd", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "track-1.mp4") {
+		t.Errorf("MPD: %v %q", w.Code, w.Body.String())
+	}
+	if w = serve(t, h, "/a.mp4/track-1.mp4", "bytes=4-7"); w.Code != http.StatusPartialContent || w.Body.String() != "ftyp" {
+		t.Errorf("Representation: %v %q", w.Code, w.Body.Bytes())
+	}
+	for _, part := range []string{ "seg-1.m4s", "track-2.mp4", "other.mp4" } {
+		if w = serve(t, h, "/a.mp4/" + part, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%v: %v, want 404", part, w.Code)
+		}
+	}
+}
+
+func TestServePackagedCache(t *testing.T) {
+	dir := tempFile(t, "a.mp4", testMP4(t))
+	defer os.RemoveAll(dir)
+	h := FileServer(dir)
+	name := dir + "/a.mp4"
+
+	serve(t, h, "/a.mp4/master.m3u8", "")
+	p := presentations.m[name]
+	if p == nil || p.hls == nil || p.dash != nil {
+		t.Fatalf("Cached presentation is %+v", p)
+	}
+	serve(t, h, "/a.mp4/manifest.mpd", "")
+	if presentations.m[name] != p || p.dash == nil {
+		t.Error("Presentation was not reused")
+	}
+
+	// A modified file is parsed again
+	p.mtime_ns--
+	if w := serve(t, h, "/a.mp4/media.m3u8", ""); w.Code != http.StatusOK {
+		t.Errorf("Media playlist: %v", w.Code)
+	}
+	if q := presentations.m[name]; q == p || q.hls == nil || q.dash != nil {
+		t.Errorf("Presentation of the modified file is %+v", q)
+	}
+}
+
+// closed reports whether the presentation's file has been closed.
+func closed(p *presentation) (bool) {
+	_, err := p.file.Stat()
+	return err != nil
+}
+
+func TestPresentationCache(t *testing.T) {
+	defer func(max int) { MaxPresentations = max }(MaxPresentations)
+	MaxPresentations = 2
+	data := testMP4(t)
+	var names []string
+	for i := 0; i < 3; i++ {
+		dir := tempFile(t, "a.mp4", data)
+		defer os.RemoveAll(dir)
+		names = append(names, dir + "/a.mp4")
+	}
+	open := func(name string) (*presentation) {
+		p, err := openPresentation(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// The least recently used file is closed
+	a := open(names[0])
+	a.release()
+	b := open(names[1])
+	b.release()
+	c := open(names[2])
+	if presentations.m[names[0]] != nil || !a.evicted || !closed(a) {
+		t.Error("Least recently used presentation was not closed")
+	}
+	if presentations.m[names[1]] != b || closed(b) {
+		t.Error("Presentation was evicted early")
+	}
+
+	// A file in use is closed once released
+	if open(names[1]) != b {
+		t.Error("Presentation was not reused")
+	}
+	b.release()
+	a = open(names[0])
+	defer a.release()
+	if !c.evicted || closed(c) {
+		t.Errorf("Presentation in use: evicted %v, closed %v", c.evicted, closed(c))
+	}
+	c.release()
+	if !closed(c) {
+		t.Error("Evicted presentation was not closed on release")
+	}
+
+	// Requests made during a parse share it
+	ps := make(chan *presentation)
+	for i := 0; i < 10; i++ {
+		go func() {
+			p, _ := openPresentation(names[2], 2)
+			ps <- p
+		}()
+	}
+	first := <-ps
+	for i := 1; i < 10; i++ {
+		if p := <-ps; p != first {
+			t.Error("File was parsed more than once")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		first.release()
+	}
+	if len(presentations.m) > MaxPresentations || presentations.lru.Len() != len(presentations.m) {
+		t.Errorf("%v presentations cached, %v in use order", len(presentations.m), presentations.lru.Len())
+	}
+}
+
+func TestPresentationError(t *testing.T) {
+	dir := tempFile(t, "a.mp4", []byte("not an MP4"))
+	defer os.RemoveAll(dir)
+	name := dir + "/a.mp4"
+	if _, err := openPresentation(name, 1); err == nil {
+		t.Fatal("Opened a file that is not an MP4")
+	}
+	if presentations.m[name] != nil {
+		t.Error("Failed parse was kept")
+	}
+}
@@ -0,0 +1,568 @@
+package mp4
+
+import (
+	"fmt"
+	"os"
+	"encoding/binary"
+)
+
+// tfhd flags
+const (
+	TFHD_BASE_DATA_OFFSET = 0x000001
+	TFHD_SAMPLE_DESCRIPTION_INDEX = 0x000002
+	TFHD_DEFAULT_SAMPLE_DURATION = 0x000008
+	TFHD_DEFAULT_SAMPLE_SIZE = 0x000010
+	TFHD_DEFAULT_SAMPLE_FLAGS = 0x000020
+	TFHD_DURATION_IS_EMPTY = 0x010000
+	TFHD_DEFAULT_BASE_IS_MOOF = 0x020000
+)
+
+// trun flags
+const (
+	TRUN_DATA_OFFSET = 0x000001
+	TRUN_FIRST_SAMPLE_FLAGS = 0x000004
+	TRUN_SAMPLE_DURATION = 0x000100
+	TRUN_SAMPLE_SIZE = 0x000200
+	TRUN_SAMPLE_FLAGS = 0x000400
+	TRUN_SAMPLE_CTO = 0x000800
+)
+
+// TRUN_MAX_SAMPLES is the most samples a trun may hold. Truns that take
+// every sample field from the defaults are as small for any sample count,
+// so the count is limited here and by the data left in the file.
+const TRUN_MAX_SAMPLES = 1 << 24
+
+// SAMPLE_IS_NON_SYNC is the sample_is_non_sync_sample bit of the sample
+// flags carried by trex, tfhd and trun.
+const SAMPLE_IS_NON_SYNC = 0x010000
+
+// flagBits returns the 24-bit flags field of a full box as an integer.
+func flagBits(flags [3]byte) (uint32) {
+	return uint32(flags[0]) << 16 | uint32(flags[1]) << 8 | uint32(flags[2])
+}
+
+// flagBytes returns the 24-bit flags field of a full box for an integer.
+func flagBytes(flags uint32) ([3]byte) {
+	return [3]byte{ byte(flags >> 16), byte(flags >> 8), byte(flags) }
+}
+
+// buildFragmentTables appends the samples of each movie fragment to the
+// tables of its trak, so that fragmented files can be read like any other.
+// Every trun becomes a chunk.
+func (f *File) buildFragmentTables() (os.Error) {
+	if len(f.moofs) == 0 {
+		return nil
+	}
+	if f.moov.mvex == nil {
+		return os.NewError("Movie fragment found without mvex")
+	}
+	for _, moof := range f.moofs {
+		// Without an explicit base, a traf's data follows that of the
+		// previous traf, or starts at the moof for the first one
+		data_end := uint64(moof.Start())
+		for _, traf := range moof.trafs {
+			tfhd := traf.tfhd
+			trak := f.moov.trak(tfhd.track_id)
+			trex := f.moov.mvex.trex(tfhd.track_id)
+			if trak == nil || trex == nil {
+				return os.NewError(fmt.Sprintf("Fragment refers to unknown track %v", tfhd.track_id))
+			}
+			flags := flagBits(tfhd.flags)
+
+			base := data_end
+			if flags & TFHD_BASE_DATA_OFFSET != 0 {
+				base = tfhd.base_data_offset
+			} else if flags & TFHD_DEFAULT_BASE_IS_MOOF != 0 {
+				base = uint64(moof.Start())
+			}
+			sdi := trex.default_sample_description_index
+			if flags & TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+				sdi = tfhd.sample_description_index
+			}
+			default_duration := trex.default_sample_duration
+			if flags & TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+				default_duration = tfhd.default_sample_duration
+			}
+			default_size := trex.default_sample_size
+			if flags & TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+				default_size = tfhd.default_sample_size
+			}
+			default_flags := trex.default_sample_flags
+			if flags & TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+				default_flags = tfhd.default_sample_flags
+			}
+
+			// Decoding continues from the end of the trak unless tfdt says
+			// otherwise
+			decode_time := uint64(0)
+			if n := len(trak.samples); n > 0 {
+				decode_time = trak.samples[n-1].start_time + uint64(trak.samples[n-1].duration)
+			}
+			if traf.tfdt != nil {
+				decode_time = traf.tfdt.base_media_decode_time
+			}
+
+			offset := base
+			for _, trun := range traf.truns {
+				trun_flags := flagBits(trun.flags)
+				if trun_flags & TRUN_DATA_OFFSET != 0 {
+					offset = uint64(int64(base) + int64(trun.data_offset))
+				}
+				// Without sample sizes, the sample count is only bounded by
+				// the default size
+				if trun_flags & TRUN_SAMPLE_SIZE == 0 && default_size > 0 {
+					left := uint64(0)
+					if offset < uint64(f.size) {
+						left = uint64(f.size) - offset
+					}
+					if uint64(trun.sample_count) > left / uint64(default_size) {
+						return os.NewError(fmt.Sprintf("trun of %v samples of %v bytes runs past the end of the file", trun.sample_count, default_size))
+					}
+				}
+				trak.chunks = append(trak.chunks, Chunk{
+					sample_description_index: sdi,
+					start_sample: uint32(len(trak.samples) + 1),
+					sample_count: trun.sample_count,
+					offset: offset,
+				})
+				for i := 0; i < int(trun.sample_count); i++ {
+					sample := Sample{
+						size: default_size,
+						duration: default_duration,
+						start_time: decode_time,
+						offset: offset,
+					}
+					sample_flags := default_flags
+					if i == 0 && trun_flags & TRUN_FIRST_SAMPLE_FLAGS != 0 {
+						sample_flags = trun.first_sample_flags
+					}
+					if trun_flags & TRUN_SAMPLE_DURATION != 0 {
+						sample.duration = trun.sample_duration[i]
+					}
+					if trun_flags & TRUN_SAMPLE_SIZE != 0 {
+						sample.size = trun.sample_size[i]
+					}
+					if trun_flags & TRUN_SAMPLE_FLAGS != 0 {
+						sample_flags = trun.sample_flags[i]
+					}
+					if trun_flags & TRUN_SAMPLE_CTO != 0 {
+						sample.cto = trun.sample_cto[i]
+					}
+					sample.sync = sample_flags & SAMPLE_IS_NON_SYNC == 0
+					trak.samples = append(trak.samples, sample)
+					decode_time += uint64(sample.duration)
+					offset += uint64(sample.size)
+				}
+				if offset > data_end {
+					data_end = offset
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type MvexBox struct {
+	*Box
+	trexs []*TrexBox
+}
+
+func (b *MvexBox) parse() (err os.Error) {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		switch subBox.Name() {
+		case "trex":
+			trex := &TrexBox{ Box:subBox }
+			err = trex.parse()
+			b.trexs = append(b.trexs, trex)
+			b.children = append(b.children, trex)
+		default:
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MvexBox) encode() []byte {
+	var known []BoxInt
+	for _, trex := range b.trexs {
+		known = append(known, trex)
+	}
+	return makeBox("mvex", encodeChildren(b.Box, known))
+}
+
+// trex returns the fragment defaults for the given track ID, or nil.
+func (b *MvexBox) trex(track_id uint32) (*TrexBox) {
+	for _, trex := range b.trexs {
+		if trex.track_id == track_id {
+			return trex
+		}
+	}
+	return nil
+}
+
+type TrexBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	track_id uint32
+	default_sample_description_index uint32
+	default_sample_duration uint32
+	default_sample_size uint32
+	default_sample_flags uint32
+}
+
+func (b *TrexBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 24 {
+		return os.NewError("trex box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.track_id = binary.BigEndian.Uint32(data[4:8])
+	b.default_sample_description_index = binary.BigEndian.Uint32(data[8:12])
+	b.default_sample_duration = binary.BigEndian.Uint32(data[12:16])
+	b.default_sample_size = binary.BigEndian.Uint32(data[16:20])
+	b.default_sample_flags = binary.BigEndian.Uint32(data[20:24])
+	return nil
+}
+
+func (b *TrexBox) encode() []byte {
+	data := putUint32(nil, b.track_id)
+	data = putUint32(data, b.default_sample_description_index)
+	data = putUint32(data, b.default_sample_duration)
+	data = putUint32(data, b.default_sample_size)
+	data = putUint32(data, b.default_sample_flags)
+	return makeFullBox("trex", b.version, b.flags, data)
+}
+
+type MoofBox struct {
+	*Box
+	mfhd *MfhdBox
+	trafs []*TrafBox
+}
+
+func (b *MoofBox) parse() (err os.Error) {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		switch subBox.Name() {
+		case "mfhd":
+			b.mfhd = &MfhdBox{ Box:subBox }
+			err = b.mfhd.parse()
+			b.children = append(b.children, b.mfhd)
+		case "traf":
+			traf := &TrafBox{ Box:subBox }
+			err = traf.parse()
+			b.trafs = append(b.trafs, traf)
+			b.children = append(b.children, traf)
+		default:
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if b.mfhd == nil {
+		return os.NewError("Missing mfhd in moof")
+	}
+	return nil
+}
+
+func (b *MoofBox) encode() []byte {
+	known := []BoxInt{ b.mfhd }
+	for _, traf := range b.trafs {
+		known = append(known, traf)
+	}
+	return makeBox("moof", encodeChildren(b.Box, known))
+}
+
+type MfhdBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	sequence_number uint32
+}
+
+func (b *MfhdBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return os.NewError("mfhd box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.sequence_number = binary.BigEndian.Uint32(data[4:8])
+	return nil
+}
+
+func (b *MfhdBox) encode() []byte {
+	return makeFullBox("mfhd", b.version, b.flags, putUint32(nil, b.sequence_number))
+}
+
+type TrafBox struct {
+	*Box
+	tfhd *TfhdBox
+	tfdt *TfdtBox
+	truns []*TrunBox
+}
+
+func (b *TrafBox) parse() (err os.Error) {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		switch subBox.Name() {
+		case "tfhd":
+			b.tfhd = &TfhdBox{ Box:subBox }
+			err = b.tfhd.parse()
+			b.children = append(b.children, b.tfhd)
+		case "tfdt":
+			b.tfdt = &TfdtBox{ Box:subBox }
+			err = b.tfdt.parse()
+			b.children = append(b.children, b.tfdt)
+		case "trun":
+			trun := &TrunBox{ Box:subBox }
+			err = trun.parse()
+			b.truns = append(b.truns, trun)
+			b.children = append(b.children, trun)
+		default:
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if b.tfhd == nil {
+		return os.NewError("Missing tfhd in traf")
+	}
+	return nil
+}
+
+func (b *TrafBox) encode() []byte {
+	known := []BoxInt{ b.tfhd }
+	if b.tfdt != nil {
+		known = append(known, b.tfdt)
+	}
+	for _, trun := range b.truns {
+		known = append(known, trun)
+	}
+	return makeBox("traf", encodeChildren(b.Box, known))
+}
+
+type TfhdBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	track_id uint32
+	// The following are only present when flagged
+	base_data_offset uint64
+	sample_description_index uint32
+	default_sample_duration uint32
+	default_sample_size uint32
+	default_sample_flags uint32
+}
+
+func (b *TfhdBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return os.NewError("tfhd box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.track_id = binary.BigEndian.Uint32(data[4:8])
+	flags := flagBits(b.flags)
+	data = data[8:]
+	next := func(n int) ([]byte) {
+		if len(data) < n {
+			err = os.NewError("tfhd box is too short")
+			return make([]byte, n)
+		}
+		field := data[:n]
+		data = data[n:]
+		return field
+	}
+	if flags & TFHD_BASE_DATA_OFFSET != 0 {
+		b.base_data_offset = binary.BigEndian.Uint64(next(8))
+	}
+	if flags & TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+		b.sample_description_index = binary.BigEndian.Uint32(next(4))
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+		b.default_sample_duration = binary.BigEndian.Uint32(next(4))
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+		b.default_sample_size = binary.BigEndian.Uint32(next(4))
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+		b.default_sample_flags = binary.BigEndian.Uint32(next(4))
+	}
+	return err
+}
+
+func (b *TfhdBox) encode() []byte {
+	flags := flagBits(b.flags)
+	data := putUint32(nil, b.track_id)
+	if flags & TFHD_BASE_DATA_OFFSET != 0 {
+		data = putUint64(data, b.base_data_offset)
+	}
+	if flags & TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+		data = putUint32(data, b.sample_description_index)
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+		data = putUint32(data, b.default_sample_duration)
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+		data = putUint32(data, b.default_sample_size)
+	}
+	if flags & TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+		data = putUint32(data, b.default_sample_flags)
+	}
+	return makeFullBox("tfhd", b.version, b.flags, data)
+}
+
+type TfdtBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	base_media_decode_time uint64
+}
+
+func (b *TfdtBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 8 || (data[0] == 1 && len(data) < 12) {
+		return os.NewError("tfdt box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	if b.version == 1 {
+		b.base_media_decode_time = binary.BigEndian.Uint64(data[4:12])
+	} else
+	{
+		b.base_media_decode_time = uint64(binary.BigEndian.Uint32(data[4:8]))
+	}
+	return nil
+}
+
+func (b *TfdtBox) encode() []byte {
+	version := headerVersion(b.version, b.base_media_decode_time)
+	return makeFullBox("tfdt", version, b.flags, putTime(nil, b.base_media_decode_time, version))
+}
+
+type TrunBox struct {
+	*Box
+	version uint8
+	flags [3]byte
+	sample_count uint32
+	// The following are only present when flagged
+	data_offset int32
+	first_sample_flags uint32
+	sample_duration []uint32
+	sample_size []uint32
+	sample_flags []uint32
+	sample_cto []uint32 // Signed in version 1
+}
+
+func (b *TrunBox) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return os.NewError("trun box is too short")
+	}
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.sample_count = binary.BigEndian.Uint32(data[4:8])
+	if b.sample_count > TRUN_MAX_SAMPLES {
+		return os.NewError(fmt.Sprintf("trun has too many samples: %v", b.sample_count))
+	}
+	flags := flagBits(b.flags)
+	data = data[8:]
+	next := func() (uint32) {
+		if len(data) < 4 {
+			err = os.NewError("trun box is too short")
+			return 0
+		}
+		v := binary.BigEndian.Uint32(data[0:4])
+		data = data[4:]
+		return v
+	}
+	if flags & TRUN_DATA_OFFSET != 0 {
+		b.data_offset = int32(next())
+	}
+	if flags & TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		b.first_sample_flags = next()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Make sure the flagged per-sample fields are all there before making
+	// room for them, as sample_count comes straight from the file
+	fields := 0
+	for _, flag := range []uint32{ TRUN_SAMPLE_DURATION, TRUN_SAMPLE_SIZE, TRUN_SAMPLE_FLAGS, TRUN_SAMPLE_CTO } {
+		if flags & flag != 0 {
+			fields++
+		}
+	}
+	if uint64(b.sample_count) * uint64(fields) * 4 > uint64(len(data)) {
+		return os.NewError("trun box is too short for its sample count")
+	}
+	field := func(flag uint32) ([]uint32) {
+		if flags & flag == 0 {
+			return nil
+		}
+		return make([]uint32, 0, b.sample_count)
+	}
+	b.sample_duration = field(TRUN_SAMPLE_DURATION)
+	b.sample_size = field(TRUN_SAMPLE_SIZE)
+	b.sample_flags = field(TRUN_SAMPLE_FLAGS)
+	b.sample_cto = field(TRUN_SAMPLE_CTO)
+	for i := 0; i < int(b.sample_count) && fields > 0; i++ {
+		if flags & TRUN_SAMPLE_DURATION != 0 {
+			b.sample_duration = append(b.sample_duration, next())
+		}
+		if flags & TRUN_SAMPLE_SIZE != 0 {
+			b.sample_size = append(b.sample_size, next())
+		}
+		if flags & TRUN_SAMPLE_FLAGS != 0 {
+			b.sample_flags = append(b.sample_flags, next())
+		}
+		if flags & TRUN_SAMPLE_CTO != 0 {
+			b.sample_cto = append(b.sample_cto, next())
+		}
+	}
+	return nil
+}
+
+func (b *TrunBox) encode() []byte {
+	flags := flagBits(b.flags)
+	data := putUint32(nil, b.sample_count)
+	if flags & TRUN_DATA_OFFSET != 0 {
+		data = putUint32(data, uint32(b.data_offset))
+	}
+	if flags & TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		data = putUint32(data, b.first_sample_flags)
+	}
+	for i := 0; i < int(b.sample_count); i++ {
+		if flags & TRUN_SAMPLE_DURATION != 0 {
+			data = putUint32(data, b.sample_duration[i])
+		}
+		if flags & TRUN_SAMPLE_SIZE != 0 {
+			data = putUint32(data, b.sample_size[i])
+		}
+		if flags & TRUN_SAMPLE_FLAGS != 0 {
+			data = putUint32(data, b.sample_flags[i])
+		}
+		if flags & TRUN_SAMPLE_CTO != 0 {
+			data = putUint32(data, b.sample_cto[i])
+		}
+	}
+	return makeFullBox("trun", b.version, b.flags, data)
+}
@@ -0,0 +1,102 @@
+package mp4
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFragmentTables(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	data := fixture{ frag: true }.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+
+	if len(f.moofs) != 15 || f.moov.mvex == nil {
+		t.Fatalf("%v moofs parsed", len(f.moofs))
+	}
+	for i, trak := range plain.moov.traks {
+		checkSamples(t, f.moov.traks[i], trak, 0, len(trak.samples))
+	}
+	if len(f.moov.traks[0].chunks) != 15 || len(f.moov.traks[1].chunks) != 12 {
+		t.Errorf("Fragments make %v and %v chunks", len(f.moov.traks[0].chunks), len(f.moov.traks[1].chunks))
+	}
+	if d := f.Duration(); d != 3e9 {
+		t.Errorf("Duration is %v", d)
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Writing changed the bytes")
+	}
+}
+
+func TestTrunTooShort(t *testing.T) {
+	flags := uint32(TRUN_SAMPLE_SIZE | TRUN_SAMPLE_FLAGS)
+	for _, count := range []uint32{ 3, 0xFFFFFFFF } {
+		box := rawBox(t, tfull("trun", 0, flags, tu32(count), tu32(10), tu32(0), tu32(20), tu32(0)))
+		defer closeTemp(box.File())
+		trun := &TrunBox{ Box: box }
+		if err := trun.parse(); err == nil {
+			t.Errorf("trun of %v samples parsed with room for 2", count)
+		}
+	}
+
+	// Without per-sample fields, the count is capped
+	box := rawBox(t, tfull("trun", 0, 0, tu32(TRUN_MAX_SAMPLES + 1)))
+	defer closeTemp(box.File())
+	if err := (&TrunBox{ Box: box }).parse(); err == nil {
+		t.Error("trun of too many samples parsed")
+	}
+
+	data := tfull("trun", 0, flags, tu32(2), tu32(10), tu32(0), tu32(20), tu32(SAMPLE_IS_NON_SYNC))
+	box = rawBox(t, data)
+	defer closeTemp(box.File())
+	trun := &TrunBox{ Box: box }
+	if err := trun.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if len(trun.sample_size) != 2 || trun.sample_size[1] != 20 || trun.sample_flags[1] != SAMPLE_IS_NON_SYNC || trun.sample_duration != nil {
+		t.Errorf("trun is %+v", trun)
+	}
+	if !bytes.Equal(trun.encode(), data) {
+		t.Error("trun encodes to different bytes")
+	}
+}
+
+func TestTrunOfDefaults(t *testing.T) {
+	frag := fixture{ frag: true }.build()
+	head := frag[:bytes.Index(frag, []byte("moof")) - 4]
+	// Audio samples of 100 bytes each, and 1000 bytes of data
+	for _, test := range []struct{ count uint32; ok bool }{ { 10, true }, { 11, false }, { TRUN_MAX_SAMPLES, false } } {
+		moof := tbox("moof", tfull("mfhd", 0, 0, tu32(1)),
+			tbox("traf", tfull("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF | TFHD_DEFAULT_SAMPLE_SIZE, tu32(2), tu32(100)),
+				tfull("trun", 0, TRUN_DATA_OFFSET, tu32(test.count), tu32(0))))
+		moof = tbox("moof", tfull("mfhd", 0, 0, tu32(1)),
+			tbox("traf", tfull("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF | TFHD_DEFAULT_SAMPLE_SIZE, tu32(2), tu32(100)),
+				tfull("trun", 0, TRUN_DATA_OFFSET, tu32(test.count), tu32(uint32(len(moof) + 8)))))
+		data := bytes.Join([][]byte{ head, moof, tbox("mdat", make([]byte, 1000)) }, nil)
+		tmp, err := ioutil.TempFile("", "mp4_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.Write(data)
+		tmp.Close()
+		f, err := Open(tmp.Name())
+		if err == nil && len(f.moov.traks[1].samples) != int(test.count) {
+			t.Errorf("trun of %v samples made %v", test.count, len(f.moov.traks[1].samples))
+		}
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(tmp.Name())
+		if (err == nil) != test.ok {
+			t.Errorf("trun of %v samples of 100 bytes in 1000 opened with %v", test.count, err)
+		}
+	}
+}
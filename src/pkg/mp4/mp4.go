@@ -2,21 +2,19 @@ package mp4
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"encoding/binary"
 )
 
 const (
 	BOX_HEADER_SIZE = int64(8)
+	LARGE_BOX_HEADER_SIZE = int64(16) // Header with a 64-bit largesize
 )
 
 func Open(path string) (f *File, err os.Error) {
-	// fmt.Println(flag.Args())
-	fmt.Println(path)
-
 	file, err := os.OpenFile(path, os.O_RDONLY, 0400)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
 
@@ -30,49 +28,83 @@ func Open(path string) (f *File, err os.Error) {
 func (f *File) parse() (os.Error) {
 	info, err := f.Stat()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
-	fmt.Printf("File size: %v \n", info.Size)
 	f.size = info.Size
 
 	// Loop through top-level Boxes
-	boxes := readBoxes(f, int64(0), f.size)
-	for box := range boxes {
+	boxes, err := readBoxes(f, int64(0), f.size)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
 		switch box.Name() {
 		case "ftyp":
 			f.ftyp = &FtypBox{ Box:box }
-			f.ftyp.parse()
+			if err = f.ftyp.parse(); err != nil {
+				return err
+			}
+			f.boxes = append(f.boxes, f.ftyp)
 		case "moov":
 			f.moov = &MoovBox{ Box:box }
-			f.moov.parse()
+			if err = f.moov.parse(); err != nil {
+				return err
+			}
+			f.boxes = append(f.boxes, f.moov)
+		case "moof":
+			moof := &MoofBox{ Box:box }
+			if err = moof.parse(); err != nil {
+				return err
+			}
+			f.moofs = append(f.moofs, moof)
+			f.boxes = append(f.boxes, moof)
+		case "sidx":
+			sidx := &SidxBox{ Box:box }
+			if err = sidx.parse(); err != nil {
+				return err
+			}
+			f.sidxs = append(f.sidxs, sidx)
+			f.boxes = append(f.boxes, sidx)
 		case "mdat":
-			f.mdat = box
+			// Fragmented files have an mdat per moof; keep the first
+			if f.mdat == nil {
+				f.mdat = box
+			}
+			f.boxes = append(f.boxes, box)
 		default:
-			fmt.Printf("Unhandled Box: %v \n", box.Name())
+			// Other boxes, such as free and udta, are kept as they are
+			f.boxes = append(f.boxes, box)
 		}
 	}
 
-	// Make sure we have all 3 required boxes
-	if f.ftyp == nil || f.moov == nil || f.mdat == nil {
+	// Make sure we have all 3 required boxes. Fragmented files, marked by
+	// an mvex, keep their samples in moof/mdat pairs and may have none yet.
+	if f.ftyp == nil || f.moov == nil || (f.mdat == nil && f.moov.mvex == nil) {
 		return os.NewError("Missing a required box (ftyp, moov, or mdat)")
 	}
 
 	// Build chunk & sample tables
-	fmt.Println("Building trak tables...")
 	if err = f.buildTrakTables(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
-	fmt.Println("Chunk and Sample tables built.")
+	if err = f.buildFragmentTables(); err != nil {
+		return err
+	}
+	for _, trak := range f.moov.traks {
+		trak.indexTimes()
+	}
 
 	return nil
 }
 
 func (f *File) buildTrakTables() (os.Error) {
 	for _, trak := range f.moov.traks {
-		trak.chunks = make([]Chunk, trak.mdia.minf.stbl.stco.entry_count)
-		for i, offset := range trak.mdia.minf.stbl.stco.chunk_offset {
+		offsets := trak.mdia.minf.stbl.chunkOffsets()
+		if offsets == nil {
+			return os.NewError("Missing chunk offset box (stco or co64)")
+		}
+		trak.chunks = make([]Chunk, len(offsets))
+		for i, offset := range offsets {
 			trak.chunks[i].offset = offset
 		}
 
@@ -80,7 +112,9 @@ func (f *File) buildTrakTables() (os.Error) {
 		next_chunk_id := 1
 		for i := 0; i < int(trak.mdia.minf.stbl.stsc.entry_count); i++ {
 			if i + 1 < int(trak.mdia.minf.stbl.stsc.entry_count) {
-				next_chunk_id = int(trak.mdia.minf.stbl.stsc.first_chunk[i+1])
+				// first_chunk is 1-based, so this is the 0-based index of
+				// the last chunk in this run, plus one
+				next_chunk_id = int(trak.mdia.minf.stbl.stsc.first_chunk[i+1]) - 1
 			} else
 			{
 				next_chunk_id = len(trak.chunks)
@@ -113,19 +147,20 @@ func (f *File) buildTrakTables() (os.Error) {
 		for i := 0; i < len(trak.chunks); i++ {
 			sample_offset := trak.chunks[i].offset
 			for j := 0; j < int(trak.chunks[i].sample_count); j++ {
-				sample_offset += trak.samples[sample_id].size
+				trak.samples[sample_id].offset = sample_offset
+				sample_offset += uint64(trak.samples[sample_id].size)
 				sample_id++
 			}
 		}
 
 		// Calculate decoding time for each sample
-		sample_id, sample_time := 0, uint32(0)
+		sample_id, sample_time := 0, uint64(0)
 		for i := 0; i < int(trak.mdia.minf.stbl.stts.entry_count); i++ {
 			sample_duration := trak.mdia.minf.stbl.stts.sample_delta[i]
 			for j := 0; j < int(trak.mdia.minf.stbl.stts.sample_count[i]); j++ {
 				trak.samples[sample_id].start_time = sample_time
 				trak.samples[sample_id].duration = sample_duration
-				sample_time += sample_duration
+				sample_time += uint64(sample_duration)
 				sample_id++
 			}
 		}
@@ -141,33 +176,55 @@ func (f *File) buildTrakTables() (os.Error) {
 				}
 			}
 		}
+		// Mark sync samples; all samples are sync samples without stss
+		if stss := trak.mdia.minf.stbl.stss; stss != nil {
+			for _, n := range stss.sample_number {
+				if int(n) >= 1 && int(n) <= len(trak.samples) {
+					trak.samples[n-1].sync = true
+				}
+			}
+		} else
+		{
+			for i := range trak.samples {
+				trak.samples[i].sync = true
+			}
+		}
 	}
 	return nil
 }
 
-func readBoxes(f *File, start int64, n int64) (boxes chan *Box) {
-	boxes = make(chan *Box, 100)
-	go func() {
-		for offset := start; offset < start + n; {
-			size, name := f.ReadBoxAt(offset)
-			fmt.Printf("Box found:\nType: %v \nSize (bytes): %v \n", name, size)
+// readBoxes reads the headers of the boxes in the n bytes of f from start.
+// A box whose size is smaller than its header is an error.
+func readBoxes(f *File, start int64, n int64) (boxes []*Box, err os.Error) {
+	for offset := start; offset + BOX_HEADER_SIZE <= start + n; {
+		size, name, header_size := f.ReadBoxAt(offset)
+		if header_size == 0 {
+			// The header could not be read
+			break
+		}
+		if size == 0 {
+			// The box extends to the end of its parent (or the file)
+			size = start + n - offset
+		}
+		if size < header_size {
+			return nil, os.NewError(fmt.Sprintf("Invalid size %v for box %v at %v", size, name, offset))
+		}
 
-			box := &Box {
-				name:		name,
-				size:		int64(size),
-				start:	offset,
-				file:		f,
-			}
-			boxes <- box
-			offset += int64(size)
+		box := &Box {
+			name:		name,
+			size:		size,
+			start:	offset,
+			header_size:	header_size,
+			file:		f,
 		}
-		close(boxes)
-	} ()
-	return boxes
+		boxes = append(boxes, box)
+		offset += size
+	}
+	return boxes, nil
 }
 
-func readSubBoxes(f *File, start int64, n int64) (boxes chan *Box) {
-	return readBoxes(f, start + BOX_HEADER_SIZE, n - BOX_HEADER_SIZE)
+func readSubBoxes(b *Box) (boxes []*Box, err os.Error) {
+	return readBoxes(b.File(), b.Start() + b.HeaderSize(), b.Size() - b.HeaderSize())
 }
 
 type File struct {
@@ -175,24 +232,88 @@ type File struct {
 	ftyp *FtypBox
 	moov *MoovBox
 	mdat *Box
+	moofs []*MoofBox
+	sidxs []*SidxBox // Segment indexes, as in DASH on-demand files
 	size int64
+	boxes []BoxInt // Top-level boxes in file order
+}
+
+// WriteTo writes f out as an MP4, reflecting any changes made to its boxes.
+// Unrecognised boxes and the mdat are copied from the original file as is,
+// so writing an untouched File reproduces it byte for byte.
+func (f *File) WriteTo(w io.Writer) (n int64, err os.Error) {
+	return f.writeBoxes(w, f.boxes)
+}
+
+// writeBoxes writes the given top-level boxes of f to w in order.
+func (f *File) writeBoxes(w io.Writer, boxes []BoxInt) (n int64, err os.Error) {
+	for _, box := range boxes {
+		var m int64
+		if raw, ok := box.(*Box); ok {
+			m, err = io.Copy(w, io.NewSectionReader(f, raw.Start(), raw.Size()))
+		} else
+		{
+			var k int
+			k, err = w.Write(box.encode())
+			m = int64(k)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
 }
 
-func (f *File) ReadBoxAt(offset int64) (boxSize uint32, boxType string) {
+// Traks returns the tracks of the movie.
+func (f *File) Traks() ([]*TrakBox) {
+	return f.moov.traks
+}
+
+// Duration returns the length of the movie in nanoseconds. For fragmented
+// files this is the length of the longest trak.
+func (f *File) Duration() (int64) {
+	if f.moov.mvhd.duration == 0 {
+		duration := int64(0)
+		for _, trak := range f.moov.traks {
+			if d := trak.Duration(); d > duration {
+				duration = d
+			}
+		}
+		return duration
+	}
+	return f.moov.mvhd.Duration()
+}
+
+// ReadBoxAt reads the header of the box at offset. A size of 0 means the box
+// extends to the end of its parent. headerSize is 0 if the header could not
+// be read.
+func (f *File) ReadBoxAt(offset int64) (boxSize int64, boxType string, headerSize int64) {
 	// Get Box size
 	buf := f.ReadBytesAt(BOX_HEADER_SIZE, offset)
-	boxSize = binary.BigEndian.Uint32(buf[0:4])
-	offset += BOX_HEADER_SIZE
+	if buf == nil {
+		return 0, "", 0
+	}
+	boxSize = int64(binary.BigEndian.Uint32(buf[0:4]))
+	headerSize = BOX_HEADER_SIZE
 	// Get Box name
 	boxType = string(buf[4:8])
-	return boxSize, boxType
+	if boxSize == 1 {
+		// The real size follows the name as a 64-bit largesize
+		buf = f.ReadBytesAt(8, offset + BOX_HEADER_SIZE)
+		if buf == nil {
+			return 0, "", 0
+		}
+		boxSize = int64(binary.BigEndian.Uint64(buf))
+		headerSize = LARGE_BOX_HEADER_SIZE
+	}
+	return boxSize, boxType, headerSize
 }
 
 func (f *File) ReadBytesAt(n int64, offset int64) (word []byte) {
 	buf := make([]byte, n)
-	if _, error := f.ReadAt(buf, offset); error != nil {
-		fmt.Println(error)
-		return
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil
 	}
 	return buf
 }
@@ -202,13 +323,17 @@ type BoxInt interface {
 	File() *File
 	Size() int64
 	Start() int64
+	HeaderSize() int64
 	parse() os.Error
+	encode() []byte
 }
 
 type Box struct {
 	name string
 	size, start int64
+	header_size int64
 	file *File
+	children []BoxInt // Sub-boxes of a parsed container, in file order
 }
 
 func (b *Box) Name() (string) { return b.name }
@@ -219,16 +344,111 @@ func (b *Box) File() (*File) { return b.file }
 
 func (b *Box) Start() (int64) { return b.start }
 
+func (b *Box) HeaderSize() (int64) { return b.header_size }
+
 func (b *Box) parse() (os.Error) {
-	fmt.Printf("Default parser called; skip parsing. (%v)\n", b.name)
 	return nil
 }
 
+// encode returns the box exactly as it appears in the file. It is used for
+// boxes that are not otherwise understood.
+func (b *Box) encode() []byte {
+	return b.File().ReadBytesAt(b.Size(), b.Start())
+}
+
 func (b *Box) ReadBoxData() ([]byte) {
-	if b.Size() <= BOX_HEADER_SIZE {
+	if b.Size() <= b.HeaderSize() {
 		return nil
 	}
-	return b.File().ReadBytesAt(b.Size() - BOX_HEADER_SIZE, b.Start() + BOX_HEADER_SIZE)
+	return b.File().ReadBytesAt(b.Size() - b.HeaderSize(), b.Start() + b.HeaderSize())
+}
+
+// newBox returns an empty Box of the given type, used when building boxes
+// that do not come from a parsed file.
+func newBox(name string) *Box {
+	return &Box{ name: name }
+}
+
+// makeBox prepends a box header for the given type to data.
+func makeBox(name string, data []byte) []byte {
+	return append(makeBoxHeader(name, int64(len(data))), data...)
+}
+
+// makeBoxHeader returns the header of a box of the given type holding n
+// bytes of data. Boxes too large for a 32-bit size get a 64-bit largesize.
+func makeBoxHeader(name string, n int64) (header []byte) {
+	if BOX_HEADER_SIZE + n > 0xFFFFFFFF {
+		header = append(putUint32(nil, 1), name...)
+		return putUint64(header, uint64(LARGE_BOX_HEADER_SIZE + n))
+	}
+	header = putUint32(nil, uint32(BOX_HEADER_SIZE + n))
+	return append(header, name...)
+}
+
+// makeFullBox prepends a full box header (box header, version and flags) to data.
+func makeFullBox(name string, version uint8, flags [3]byte, data []byte) []byte {
+	return makeBox(name, append([]byte{ version, flags[0], flags[1], flags[2] }, data...))
+}
+
+// encodeChildren serializes the sub-boxes of a container. known holds the
+// container's recognised sub-boxes in their current state. For a container
+// parsed from a file these are written in their original places, alongside
+// its unrecognised sub-boxes, and any known boxes new to the container are
+// appended. A container built from scratch is written in the order of known.
+func encodeChildren(b *Box, known []BoxInt) (data []byte) {
+	used := make([]bool, len(known))
+	for _, child := range b.children {
+		if raw, ok := child.(*Box); ok {
+			data = append(data, raw.encode()...)
+			continue
+		}
+		// Recognised sub-boxes that have since been removed are dropped
+		for i, box := range known {
+			if !used[i] && box.Name() == child.Name() {
+				data = append(data, box.encode()...)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, box := range known {
+		if !used[i] {
+			data = append(data, box.encode()...)
+		}
+	}
+	return data
+}
+
+func putUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v >> 8), byte(v))
+}
+
+func putUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
+
+func putUint64(buf []byte, v uint64) []byte {
+	return putUint32(putUint32(buf, uint32(v >> 32)), uint32(v))
+}
+
+// putTime appends a time or duration field of a version 0 (32-bit) or
+// version 1 (64-bit) header.
+func putTime(buf []byte, v uint64, version uint8) []byte {
+	if version == 1 {
+		return putUint64(buf, v)
+	}
+	return putUint32(buf, uint32(v))
+}
+
+// headerVersion returns the version a header must be written with to hold
+// the given times: its current version, or 1 if any do not fit in 32 bits.
+func headerVersion(version uint8, times ...uint64) uint8 {
+	for _, t := range times {
+		if t > 0xFFFFFFFF {
+			return 1
+		}
+	}
+	return version
 }
 
 type FtypBox struct {
@@ -248,33 +468,83 @@ func (b *FtypBox) parse() (os.Error) {
 	return nil
 }
 
+func (b *FtypBox) encode() []byte {
+	data := []byte(b.major_brand + b.minor_version)
+	for _, brand := range b.compatible_brands {
+		data = append(data, brand...)
+	}
+	return makeBox("ftyp", data)
+}
+
 type MoovBox struct {
 	*Box
 	mvhd *MvhdBox
 	iods *IodsBox
 	traks []*TrakBox
 	udta *UdtaBox
+	mvex *MvexBox
 }
 
 func (b *MoovBox) parse() (os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "mvhd":
 			b.mvhd = &MvhdBox{ Box:subBox }
-			b.mvhd.parse()
+			err = b.mvhd.parse()
+			b.children = append(b.children, b.mvhd)
 		case "iods":
 			b.iods = &IodsBox{ Box:subBox }
-			b.iods.parse()
+			err = b.iods.parse()
+			b.children = append(b.children, b.iods)
 		case "trak":
 			trak := &TrakBox{ Box:subBox }
-			trak.parse()
+			err = trak.parse()
 			b.traks = append(b.traks, trak)
+			b.children = append(b.children, trak)
 		case "udta":
 			b.udta = &UdtaBox{ Box:subBox }
-			b.udta.parse()
+			err = b.udta.parse()
+			b.children = append(b.children, b.udta)
+		case "mvex":
+			b.mvex = &MvexBox{ Box:subBox }
+			err = b.mvex.parse()
+			b.children = append(b.children, b.mvex)
 		default:
-			fmt.Printf("Unhandled Moov Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MoovBox) encode() []byte {
+	known := []BoxInt{ b.mvhd }
+	if b.iods != nil {
+		known = append(known, b.iods)
+	}
+	for _, trak := range b.traks {
+		known = append(known, trak)
+	}
+	if b.mvex != nil {
+		known = append(known, b.mvex)
+	}
+	if b.udta != nil {
+		known = append(known, b.udta)
+	}
+	return makeBox("moov", encodeChildren(b.Box, known))
+}
+
+// trak returns the trak with the given track ID, or nil.
+func (b *MoovBox) trak(track_id uint32) (*TrakBox) {
+	for _, trak := range b.traks {
+		if trak.tkhd.track_id == track_id {
+			return trak
 		}
 	}
 	return nil
@@ -284,7 +554,8 @@ type MvhdBox struct {
 	*Box
 	version uint8
 	flags [3]byte
-	creation_time, modification_time, timescale, duration, next_track_id uint32
+	creation_time, modification_time, duration uint64
+	timescale, next_track_id uint32
 	rate Fixed32
 	volume Fixed16
 	other_data []byte
@@ -294,10 +565,19 @@ func (b *MvhdBox) parse() (err os.Error) {
 	data := b.ReadBoxData()
 	b.version = data[0]
 	b.flags = [3]byte{data[1], data[2], data[3]}
-	b.creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.timescale = binary.BigEndian.Uint32(data[12:16])
-	b.duration = binary.BigEndian.Uint32(data[16:20])
+	if b.version == 1 {
+		b.creation_time = binary.BigEndian.Uint64(data[4:12])
+		b.modification_time = binary.BigEndian.Uint64(data[12:20])
+		b.timescale = binary.BigEndian.Uint32(data[20:24])
+		b.duration = binary.BigEndian.Uint64(data[24:32])
+		data = data[12:]
+	} else
+	{
+		b.creation_time = uint64(binary.BigEndian.Uint32(data[4:8]))
+		b.modification_time = uint64(binary.BigEndian.Uint32(data[8:12]))
+		b.timescale = binary.BigEndian.Uint32(data[12:16])
+		b.duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
 	b.rate, err = MakeFixed32(data[20:24])
 	if err != nil {
 		return err
@@ -307,9 +587,33 @@ func (b *MvhdBox) parse() (err os.Error) {
 		return err
 	}
 	b.other_data = data[26:]
+	// next_track_id ends the box, after the matrix and pre_defined
+	if n := len(b.other_data); n >= 4 {
+		b.next_track_id = binary.BigEndian.Uint32(b.other_data[n-4:])
+		b.other_data = b.other_data[:n-4]
+	}
 	return nil
 }
 
+func (b *MvhdBox) encode() []byte {
+	version := headerVersion(b.version, b.creation_time, b.modification_time, b.duration)
+	data := make([]byte, 0, 108)
+	data = putTime(data, b.creation_time, version)
+	data = putTime(data, b.modification_time, version)
+	data = putUint32(data, b.timescale)
+	data = putTime(data, b.duration, version)
+	data = putUint32(data, uint32(b.rate))
+	data = putUint16(data, uint16(b.volume))
+	data = append(data, b.other_data...)
+	data = putUint32(data, b.next_track_id)
+	return makeFullBox("mvhd", version, b.flags, data)
+}
+
+// Duration returns the length of the movie in nanoseconds.
+func (b *MvhdBox) Duration() (int64) {
+	return fromTimescale(b.duration, b.timescale)
+}
+
 type IodsBox struct {
 	*Box
 	data []byte
@@ -320,6 +624,10 @@ func (b *IodsBox) parse() (os.Error) {
 	return nil
 }
 
+func (b *IodsBox) encode() []byte {
+	return makeBox("iods", b.data)
+}
+
 type TrakBox struct {
 	*Box
 	tkhd *TkhdBox
@@ -327,33 +635,107 @@ type TrakBox struct {
 	edts *EdtsBox
 	chunks []Chunk
 	samples []Sample
+	time_index *timeIndex // See indexTimes
 }
 
 func (b *TrakBox) parse() (os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "tkhd":
 			b.tkhd = &TkhdBox{ Box:subBox }
-			b.tkhd.parse()
+			err = b.tkhd.parse()
+			b.children = append(b.children, b.tkhd)
 		case "mdia":
 			b.mdia = &MdiaBox{ Box:subBox }
-			b.mdia.parse()
+			err = b.mdia.parse()
+			b.children = append(b.children, b.mdia)
 		case "edts":
 			b.edts = &EdtsBox{ Box:subBox }
-			b.edts.parse()
+			err = b.edts.parse()
+			b.children = append(b.children, b.edts)
 		default:
-			fmt.Printf("Unhandled Trak Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (b *TrakBox) encode() []byte {
+	known := []BoxInt{ b.tkhd }
+	if b.edts != nil {
+		known = append(known, b.edts)
+	}
+	known = append(known, b.mdia)
+	return makeBox("trak", encodeChildren(b.Box, known))
+}
+
+// HandlerType returns the type of the trak's media, such as "vide" or "soun".
+func (b *TrakBox) HandlerType() (string) {
+	return b.mdia.hdlr.handler_type
+}
+
+// SampleEntries returns the trak's sample descriptions from stsd, each a
+// *VisualSampleEntry, an *AudioSampleEntry or, for other formats, a *Box.
+func (b *TrakBox) SampleEntries() ([]BoxInt) {
+	return b.mdia.minf.stbl.stsd.entries
+}
+
+// Format returns the type of the trak's first sample entry, such as "avc1"
+// or "mp4a", which names the codec it carries.
+func (b *TrakBox) Format() (string) {
+	if entry := b.sampleEntry(); entry != nil {
+		return entry.Name()
+	}
+	return ""
+}
+
+// Width and Height return the size in pixels of a video trak's first sample
+// entry, or 0 for other traks.
+func (b *TrakBox) Width() (int) {
+	if entry, ok := b.sampleEntry().(*VisualSampleEntry); ok {
+		return entry.Width()
+	}
+	return 0
+}
+
+func (b *TrakBox) Height() (int) {
+	if entry, ok := b.sampleEntry().(*VisualSampleEntry); ok {
+		return entry.Height()
+	}
+	return 0
+}
+
+// sampleEntry returns the trak's first sample entry, or nil.
+func (b *TrakBox) sampleEntry() (BoxInt) {
+	if entries := b.SampleEntries(); len(entries) > 0 {
+		return entries[0]
+	}
+	return nil
+}
+
+// Duration returns the length of the trak's media in nanoseconds. Fragmented
+// traks, whose mdhd duration is usually 0, are measured from their samples.
+func (b *TrakBox) Duration() (int64) {
+	if b.mdia.mdhd.duration == 0 && len(b.samples) > 0 {
+		last := b.samples[len(b.samples)-1]
+		return fromTimescale(last.start_time + uint64(last.duration), b.mdia.mdhd.timescale)
+	}
+	return b.mdia.mdhd.Duration()
+}
+
 type TkhdBox struct {
 	*Box
 	version uint8
 	flags [3]byte
-	creation_time, modification_time, track_id, duration uint32
+	creation_time, modification_time, duration uint64
+	track_id uint32
 	layer, alternate_group uint16 // This should really be int16 but not sure how to parse
 	volume Fixed16
 	matrix []byte
@@ -364,11 +746,22 @@ func (b *TkhdBox) parse() (err os.Error) {
 	data := b.ReadBoxData()
 	b.version = data[0]
 	b.flags = [3]byte{ data[1], data[2], data[3] }
-	b.creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.track_id = binary.BigEndian.Uint32(data[12:16])
-	// Skip 4 bytes for reserved space (uint32)
-	b.duration = binary.BigEndian.Uint32(data[20:24])
+	if b.version == 1 {
+		b.creation_time = binary.BigEndian.Uint64(data[4:12])
+		b.modification_time = binary.BigEndian.Uint64(data[12:20])
+		b.track_id = binary.BigEndian.Uint32(data[20:24])
+		// Skip 4 bytes for reserved space (uint32)
+		b.duration = binary.BigEndian.Uint64(data[28:36])
+		// The rest of the box is laid out as in version 0
+		data = data[12:]
+	} else
+	{
+		b.creation_time = uint64(binary.BigEndian.Uint32(data[4:8]))
+		b.modification_time = uint64(binary.BigEndian.Uint32(data[8:12]))
+		b.track_id = binary.BigEndian.Uint32(data[12:16])
+		// Skip 4 bytes for reserved space (uint32)
+		b.duration = uint64(binary.BigEndian.Uint32(data[20:24]))
+	}
 	// Skip 8 bytes for reserved space (2 uint32)
 	b.layer = binary.BigEndian.Uint16(data[32:34])
 	b.alternate_group = binary.BigEndian.Uint16(data[34:36])
@@ -389,20 +782,44 @@ func (b *TkhdBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *TkhdBox) encode() []byte {
+	version := headerVersion(b.version, b.creation_time, b.modification_time, b.duration)
+	data := make([]byte, 0, 92)
+	data = putTime(data, b.creation_time, version)
+	data = putTime(data, b.modification_time, version)
+	data = putUint32(data, b.track_id)
+	data = putUint32(data, 0)
+	data = putTime(data, b.duration, version)
+	data = putUint32(data, 0)
+	data = putUint32(data, 0)
+	data = putUint16(data, b.layer)
+	data = putUint16(data, b.alternate_group)
+	data = putUint16(data, uint16(b.volume))
+	data = putUint16(data, 0)
+	data = append(data, b.matrix...)
+	data = putUint32(data, uint32(b.width))
+	data = putUint32(data, uint32(b.height))
+	return makeFullBox("tkhd", version, b.flags, data)
+}
+
 type EdtsBox struct {
 	*Box
 	elst *ElstBox
 }
 
 func (b *EdtsBox) parse() (err os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "elst":
 			b.elst = &ElstBox{ Box:subBox }
 			err = b.elst.parse()
+			b.children = append(b.children, b.elst)
 		default:
-			fmt.Printf("Unhandled Edts Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -411,12 +828,21 @@ func (b *EdtsBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *EdtsBox) encode() []byte {
+	var known []BoxInt
+	if b.elst != nil {
+		known = append(known, b.elst)
+	}
+	return makeBox("edts", encodeChildren(b.Box, known))
+}
+
 type ElstBox struct {
 	*Box
 	version uint8
 	flags [3]byte
 	entry_count uint32
-	segment_duration, media_time []uint32
+	segment_duration []uint64
+	media_time []int64 // -1 marks an empty edit
 	media_rate_integer, media_rate_fraction []uint16 // This should really be int16 but not sure how to parse
 }
 
@@ -426,10 +852,21 @@ func (b *ElstBox) parse() (err os.Error) {
 	b.flags = [3]byte{ data[1], data[2], data[3] }
 	b.entry_count = binary.BigEndian.Uint32(data[4:8])
 	for i := 0; i < int(b.entry_count); i++ {
-		sd := binary.BigEndian.Uint32(data[(8+12*i):(12+12*i)])
-		mt := binary.BigEndian.Uint32(data[(12+12*i):(16+12*i)])
-		mri := binary.BigEndian.Uint16(data[(16+12*i):(18+12*i)])
-		mrf := binary.BigEndian.Uint16(data[(18+12*i):(20+12*i)])
+		var sd uint64
+		var mt int64
+		var mri, mrf uint16
+		if b.version == 1 {
+			sd = binary.BigEndian.Uint64(data[(8+20*i):(16+20*i)])
+			mt = int64(binary.BigEndian.Uint64(data[(16+20*i):(24+20*i)]))
+			mri = binary.BigEndian.Uint16(data[(24+20*i):(26+20*i)])
+			mrf = binary.BigEndian.Uint16(data[(26+20*i):(28+20*i)])
+		} else
+		{
+			sd = uint64(binary.BigEndian.Uint32(data[(8+12*i):(12+12*i)]))
+			mt = int64(int32(binary.BigEndian.Uint32(data[(12+12*i):(16+12*i)])))
+			mri = binary.BigEndian.Uint16(data[(16+12*i):(18+12*i)])
+			mrf = binary.BigEndian.Uint16(data[(18+12*i):(20+12*i)])
+		}
 		b.segment_duration = append(b.segment_duration, sd)
 		b.media_time = append(b.media_time, mt)
 		b.media_rate_integer = append(b.media_rate_integer, mri)
@@ -438,6 +875,23 @@ func (b *ElstBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *ElstBox) encode() []byte {
+	version := b.version
+	for i := 0; i < int(b.entry_count); i++ {
+		if b.segment_duration[i] > 0xFFFFFFFF || b.media_time[i] > 0x7FFFFFFF {
+			version = 1
+		}
+	}
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putTime(data, b.segment_duration[i], version)
+		data = putTime(data, uint64(b.media_time[i]), version)
+		data = putUint16(data, b.media_rate_integer[i])
+		data = putUint16(data, b.media_rate_fraction[i])
+	}
+	return makeFullBox("elst", version, b.flags, data)
+}
+
 type MdiaBox struct {
 	*Box
 	mdhd *MdhdBox
@@ -446,52 +900,96 @@ type MdiaBox struct {
 }
 
 func (b *MdiaBox) parse() (os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "mdhd":
 			b.mdhd = &MdhdBox{ Box:subBox }
-			b.mdhd.parse()
+			err = b.mdhd.parse()
+			b.children = append(b.children, b.mdhd)
 		case "hdlr":
 			b.hdlr = &HdlrBox{ Box:subBox }
-			b.hdlr.parse()
+			err = b.hdlr.parse()
+			b.children = append(b.children, b.hdlr)
 		case "minf":
 			b.minf = &MinfBox{ Box:subBox }
-			b.minf.parse()
+			err = b.minf.parse()
+			b.children = append(b.children, b.minf)
 		default:
-			fmt.Printf("Unhandled Mdia Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (b *MdiaBox) encode() []byte {
+	known := []BoxInt{ b.mdhd, b.hdlr, b.minf }
+	return makeBox("mdia", encodeChildren(b.Box, known))
+}
+
 type MdhdBox struct {
 	*Box
 	version uint8
 	flags [3]byte
-	creation_time, modification_time, timescale, duration uint32
+	creation_time, modification_time, duration uint64
+	timescale uint32
 	language uint16 // Combine 1-bit padding w/ 15-bit language data
+	pre_defined uint16 // QuickTime stores the media quality here
 }
 
 func (b *MdhdBox) parse() (err os.Error) {
 	data := b.ReadBoxData()
 	b.version = data[0]
 	b.flags = [3]byte{ data[1], data[2], data[3] }
-	b.creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.timescale = binary.BigEndian.Uint32(data[12:16])
-	b.duration = binary.BigEndian.Uint32(data[16:20])
+	if b.version == 1 {
+		b.creation_time = binary.BigEndian.Uint64(data[4:12])
+		b.modification_time = binary.BigEndian.Uint64(data[12:20])
+		b.timescale = binary.BigEndian.Uint32(data[20:24])
+		b.duration = binary.BigEndian.Uint64(data[24:32])
+		data = data[12:]
+	} else
+	{
+		b.creation_time = uint64(binary.BigEndian.Uint32(data[4:8]))
+		b.modification_time = uint64(binary.BigEndian.Uint32(data[8:12]))
+		b.timescale = binary.BigEndian.Uint32(data[12:16])
+		b.duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
 	// language includes 1 padding bit
 	b.language = binary.BigEndian.Uint16(data[20:22])
+	b.pre_defined = binary.BigEndian.Uint16(data[22:24])
 	return nil
 }
 
+func (b *MdhdBox) encode() []byte {
+	version := headerVersion(b.version, b.creation_time, b.modification_time, b.duration)
+	data := make([]byte, 0, 32)
+	data = putTime(data, b.creation_time, version)
+	data = putTime(data, b.modification_time, version)
+	data = putUint32(data, b.timescale)
+	data = putTime(data, b.duration, version)
+	data = putUint16(data, b.language)
+	data = putUint16(data, b.pre_defined)
+	return makeFullBox("mdhd", version, b.flags, data)
+}
+
+// Duration returns the length of the media in nanoseconds.
+func (b *MdhdBox) Duration() (int64) {
+	return fromTimescale(b.duration, b.timescale)
+}
+
 type HdlrBox struct {
 	*Box
 	version uint8
 	flags [3]byte
 	pre_defined uint32
 	handler_type, track_name string
+	reserved []byte // QuickTime stores the component manufacturer here
 }
 
 func (b *HdlrBox) parse() (err os.Error) {
@@ -500,11 +998,24 @@ func (b *HdlrBox) parse() (err os.Error) {
 	b.flags = [3]byte{ data[1], data[2], data[3] }
 	b.pre_defined = binary.BigEndian.Uint32(data[4:8])
 	b.handler_type = string(data[8:12])
-	// Skip 12 bytes for reserved space (3 uint32)
+	b.reserved = data[12:24]
 	b.track_name = string(data[24:])
 	return nil
 }
 
+func (b *HdlrBox) encode() []byte {
+	data := putUint32(nil, b.pre_defined)
+	data = append(data, b.handler_type...)
+	if b.reserved != nil {
+		data = append(data, b.reserved...)
+	} else
+	{
+		data = append(data, make([]byte, 12)...)
+	}
+	data = append(data, b.track_name...)
+	return makeFullBox("hdlr", b.version, b.flags, data)
+}
+
 type MinfBox struct {
 	*Box
 	vmhd *VmhdBox
@@ -515,26 +1026,34 @@ type MinfBox struct {
 }
 
 func (b *MinfBox) parse() (err os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "vmhd":
 			b.vmhd = &VmhdBox{ Box:subBox }
 			err = b.vmhd.parse()
+			b.children = append(b.children, b.vmhd)
 		case "smhd":
 			b.smhd = &SmhdBox{ Box:subBox }
 			err = b.smhd.parse()
+			b.children = append(b.children, b.smhd)
 		case "stbl":
 			b.stbl = &StblBox{ Box:subBox }
 			err = b.stbl.parse()
+			b.children = append(b.children, b.stbl)
 		case "dinf":
 			b.dinf = &DinfBox{ Box:subBox }
 			err = b.dinf.parse()
+			b.children = append(b.children, b.dinf)
 		case "hdlr":
 			b.hdlr = &HdlrBox{ Box:subBox }
 			err = b.hdlr.parse()
+			b.children = append(b.children, b.hdlr)
 		default:
-			fmt.Printf("Unhandled Minf Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -543,6 +1062,24 @@ func (b *MinfBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *MinfBox) encode() []byte {
+	var known []BoxInt
+	if b.vmhd != nil {
+		known = append(known, b.vmhd)
+	}
+	if b.smhd != nil {
+		known = append(known, b.smhd)
+	}
+	if b.hdlr != nil {
+		known = append(known, b.hdlr)
+	}
+	if b.dinf != nil {
+		known = append(known, b.dinf)
+	}
+	known = append(known, b.stbl)
+	return makeBox("minf", encodeChildren(b.Box, known))
+}
+
 type VmhdBox struct {
 	*Box
 	version uint8
@@ -562,6 +1099,14 @@ func (b *VmhdBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *VmhdBox) encode() []byte {
+	data := putUint16(nil, b.graphicsmode)
+	for i := 0; i < 3; i++ {
+		data = putUint16(data, b.opcolor[i])
+	}
+	return makeFullBox("vmhd", b.version, b.flags, data)
+}
+
 type SmhdBox struct {
 	*Box
 	version uint8
@@ -577,6 +1122,12 @@ func (b *SmhdBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *SmhdBox) encode() []byte {
+	data := putUint16(nil, b.balance)
+	data = putUint16(data, 0)
+	return makeFullBox("smhd", b.version, b.flags, data)
+}
+
 type StblBox struct {
 	*Box
 	stsd *StsdBox
@@ -585,36 +1136,51 @@ type StblBox struct {
 	stsc *StscBox
 	stsz *StszBox
 	stco *StcoBox
+	co64 *Co64Box
 	ctts *CttsBox
 }
 
 func (b *StblBox) parse() (err os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "stsd":
 			b.stsd = &StsdBox{ Box:subBox }
 			err = b.stsd.parse()
+			b.children = append(b.children, b.stsd)
 		case "stts":
 			b.stts = &SttsBox{ Box:subBox }
 			err = b.stts.parse()
+			b.children = append(b.children, b.stts)
 		case "stss":
 			b.stss = &StssBox{ Box:subBox }
 			err = b.stss.parse()
+			b.children = append(b.children, b.stss)
 		case "stsc":
 			b.stsc = &StscBox{ Box:subBox }
 			err = b.stsc.parse()
+			b.children = append(b.children, b.stsc)
 		case "stsz":
 			b.stsz = &StszBox{ Box:subBox }
 			err = b.stsz.parse()
+			b.children = append(b.children, b.stsz)
 		case "stco":
 			b.stco = &StcoBox{ Box:subBox }
 			err = b.stco.parse()
+			b.children = append(b.children, b.stco)
+		case "co64":
+			b.co64 = &Co64Box{ Box:subBox }
+			err = b.co64.parse()
+			b.children = append(b.children, b.co64)
 		case "ctts":
 			b.ctts = &CttsBox{ Box:subBox }
 			err = b.ctts.parse()
+			b.children = append(b.children, b.ctts)
 		default:
-			fmt.Printf("Unhandled Stbl Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -623,12 +1189,62 @@ func (b *StblBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *StblBox) encode() []byte {
+	known := []BoxInt{ b.stsd, b.stts }
+	if b.ctts != nil {
+		known = append(known, b.ctts)
+	}
+	if b.stss != nil {
+		known = append(known, b.stss)
+	}
+	known = append(known, b.stsc, b.stsz)
+	if b.stco != nil {
+		known = append(known, b.stco)
+	}
+	if b.co64 != nil {
+		known = append(known, b.co64)
+	}
+	return makeBox("stbl", encodeChildren(b.Box, known))
+}
+
+// chunkOffsets returns the chunk offsets from whichever of stco or co64 is
+// present, or nil if neither is.
+func (b *StblBox) chunkOffsets() (offsets []uint64) {
+	if b.co64 != nil {
+		return append(make([]uint64, 0, len(b.co64.chunk_offset)), b.co64.chunk_offset...)
+	}
+	if b.stco == nil {
+		return nil
+	}
+	offsets = make([]uint64, len(b.stco.chunk_offset))
+	for i, offset := range b.stco.chunk_offset {
+		offsets[i] = uint64(offset)
+	}
+	return offsets
+}
+
+// setChunkOffsets replaces the chunk offsets, storing them in a co64 if
+// large is set and in an stco otherwise.
+func (b *StblBox) setChunkOffsets(offsets []uint64, large bool) {
+	if large {
+		b.stco = nil
+		b.co64 = &Co64Box{ Box: newBox("co64"), entry_count: uint32(len(offsets)) }
+		b.co64.chunk_offset = append(b.co64.chunk_offset, offsets...)
+		return
+	}
+	b.co64 = nil
+	b.stco = &StcoBox{ Box: newBox("stco"), entry_count: uint32(len(offsets)) }
+	for _, offset := range offsets {
+		b.stco.chunk_offset = append(b.stco.chunk_offset, uint32(offset))
+	}
+}
+
 type StsdBox struct {
 	*Box
 	version uint8
 	flags [3]byte
 	entry_count uint32
-	other_data []byte
+	entries []BoxInt // Sample entries, see stsd.go
 }
 
 func (b *StsdBox) parse() (err os.Error) {
@@ -636,11 +1252,29 @@ func (b *StsdBox) parse() (err os.Error) {
 	b.version = data[0]
 	b.flags = [3]byte{ data[1], data[2], data[3] }
 	b.entry_count = binary.BigEndian.Uint32(data[4:8])
-	b.other_data = data[8:]
-	fmt.Println("stsd box parsing not yet finished")
+	// Each entry is a box following the entry count
+	boxes, err := readBoxes(b.File(), b.Start() + b.HeaderSize() + 8, b.Size() - b.HeaderSize() - 8)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		entry := newSampleEntry(subBox)
+		if err = entry.parse(); err != nil {
+			return err
+		}
+		b.entries = append(b.entries, entry)
+	}
 	return nil
 }
 
+func (b *StsdBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for _, entry := range b.entries {
+		data = append(data, entry.encode()...)
+	}
+	return makeFullBox("stsd", b.version, b.flags, data)
+}
+
 type SttsBox struct {
 	*Box
 	version uint8
@@ -664,6 +1298,27 @@ func (b *SttsBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *SttsBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint32(data, b.sample_count[i])
+		data = putUint32(data, b.sample_delta[i])
+	}
+	return makeFullBox("stts", b.version, b.flags, data)
+}
+
+// addSample appends a sample of the given duration, extending the last
+// entry when it has the same delta.
+func (b *SttsBox) addSample(delta uint32) {
+	if n := len(b.sample_delta); n > 0 && b.sample_delta[n-1] == delta {
+		b.sample_count[n-1]++
+		return
+	}
+	b.sample_count = append(b.sample_count, 1)
+	b.sample_delta = append(b.sample_delta, delta)
+	b.entry_count++
+}
+
 type StssBox struct {
 	*Box
 	version uint8
@@ -684,6 +1339,14 @@ func (b *StssBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *StssBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint32(data, b.sample_number[i])
+	}
+	return makeFullBox("stss", b.version, b.flags, data)
+}
+
 type StscBox struct {
 	*Box
 	version uint8
@@ -710,6 +1373,28 @@ func (b *StscBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *StscBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint32(data, b.first_chunk[i])
+		data = putUint32(data, b.samples_per_chunk[i])
+		data = putUint32(data, b.sample_description_index[i])
+	}
+	return makeFullBox("stsc", b.version, b.flags, data)
+}
+
+// addChunk appends a chunk with the given sample count and description,
+// starting a new entry only when those differ from the previous chunk.
+func (b *StscBox) addChunk(chunk_id, samples, sdi uint32) {
+	if n := len(b.first_chunk); n > 0 && b.samples_per_chunk[n-1] == samples && b.sample_description_index[n-1] == sdi {
+		return
+	}
+	b.first_chunk = append(b.first_chunk, chunk_id)
+	b.samples_per_chunk = append(b.samples_per_chunk, samples)
+	b.sample_description_index = append(b.sample_description_index, sdi)
+	b.entry_count++
+}
+
 type StszBox struct {
 	*Box
 	version uint8
@@ -734,6 +1419,17 @@ func (b *StszBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *StszBox) encode() []byte {
+	data := putUint32(nil, b.sample_size)
+	data = putUint32(data, b.sample_count)
+	if b.sample_size == uint32(0) {
+		for i := 0; i < int(b.sample_count); i++ {
+			data = putUint32(data, b.entry_size[i])
+		}
+	}
+	return makeFullBox("stsz", b.version, b.flags, data)
+}
+
 type StcoBox struct {
 	*Box
 	version uint8
@@ -754,6 +1450,42 @@ func (b *StcoBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *StcoBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint32(data, b.chunk_offset[i])
+	}
+	return makeFullBox("stco", b.version, b.flags, data)
+}
+
+type Co64Box struct {
+	*Box
+	version uint8
+	flags [3]byte
+	entry_count uint32
+	chunk_offset []uint64
+}
+
+func (b *Co64Box) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	b.version = data[0]
+	b.flags = [3]byte{ data[1], data[2], data[3] }
+	b.entry_count = binary.BigEndian.Uint32(data[4:8])
+	for i := 0; i < int(b.entry_count); i++ {
+		chunk := binary.BigEndian.Uint64(data[(8+8*i):(16+8*i)])
+		b.chunk_offset = append(b.chunk_offset, chunk)
+	}
+	return nil
+}
+
+func (b *Co64Box) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint64(data, b.chunk_offset[i])
+	}
+	return makeFullBox("co64", b.version, b.flags, data)
+}
+
 type CttsBox struct {
 	*Box
 	version uint8
@@ -777,20 +1509,45 @@ func (b *CttsBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *CttsBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	for i := 0; i < int(b.entry_count); i++ {
+		data = putUint32(data, b.sample_count[i])
+		data = putUint32(data, b.sample_offset[i])
+	}
+	return makeFullBox("ctts", b.version, b.flags, data)
+}
+
+// addSample appends a sample with the given composition offset, extending
+// the last entry when it has the same offset.
+func (b *CttsBox) addSample(offset uint32) {
+	if n := len(b.sample_offset); n > 0 && b.sample_offset[n-1] == offset {
+		b.sample_count[n-1]++
+		return
+	}
+	b.sample_count = append(b.sample_count, 1)
+	b.sample_offset = append(b.sample_offset, offset)
+	b.entry_count++
+}
+
 type DinfBox struct {
 	*Box
 	dref *DrefBox
 }
 
 func (b *DinfBox) parse() (err os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "dref":
 			b.dref = &DrefBox{ Box:subBox }
 			err = b.dref.parse()
+			b.children = append(b.children, b.dref)
 		default:
-			fmt.Printf("Unhandled Dinf Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -799,6 +1556,14 @@ func (b *DinfBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *DinfBox) encode() []byte {
+	var known []BoxInt
+	if b.dref != nil {
+		known = append(known, b.dref)
+	}
+	return makeBox("dinf", encodeChildren(b.Box, known))
+}
+
 type DrefBox struct {
 	*Box
 	version uint8
@@ -813,24 +1578,33 @@ func (b *DrefBox) parse() (err os.Error) {
 	b.flags = [3]byte{ data[1], data[2], data[3] }
 	b.entry_count = binary.BigEndian.Uint32(data[4:8])
 	b.other_data = data[8:]
-	fmt.Println("dref box parsing not yet finished")
 	return nil
 }
 
+func (b *DrefBox) encode() []byte {
+	data := putUint32(nil, b.entry_count)
+	data = append(data, b.other_data...)
+	return makeFullBox("dref", b.version, b.flags, data)
+}
+
 type UdtaBox struct {
 	*Box
 	meta *MetaBox
 }
 
 func (b *UdtaBox) parse() (err os.Error) {
-	boxes := readSubBoxes(b.File(), b.Start(), b.Size())
-	for subBox := range boxes {
+	boxes, err := readSubBoxes(b.Box)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "meta":
 			b.meta = &MetaBox{ Box:subBox }
 			err = b.meta.parse()
+			b.children = append(b.children, b.meta)
 		default:
-			fmt.Printf("Unhandled Udta Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -839,6 +1613,14 @@ func (b *UdtaBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *UdtaBox) encode() []byte {
+	var known []BoxInt
+	if b.meta != nil {
+		known = append(known, b.meta)
+	}
+	return makeBox("udta", encodeChildren(b.Box, known))
+}
+
 type MetaBox struct {
 	*Box
 	version uint8
@@ -850,14 +1632,19 @@ func (b *MetaBox) parse() (err os.Error) {
 	data := b.ReadBoxData()
 	b.version = data[0]
 	b.flags = [3]byte{ data[1], data[2], data[3] }
-	boxes := readSubBoxes(b.File(), b.Start()+4, b.Size()-4)
-	for subBox := range boxes {
+	// Sub-boxes follow the version and flags
+	boxes, err := readBoxes(b.File(), b.Start() + b.HeaderSize() + 4, b.Size() - b.HeaderSize() - 4)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
 		switch subBox.Name() {
 		case "hdlr":
 			b.hdlr = &HdlrBox{ Box:subBox }
 			err = b.hdlr.parse()
+			b.children = append(b.children, b.hdlr)
 		default:
-			fmt.Printf("Unhandled Meta Sub-Box: %v \n", subBox.Name())
+			b.children = append(b.children, subBox)
 		}
 		if err != nil {
 			return err
@@ -866,6 +1653,14 @@ func (b *MetaBox) parse() (err os.Error) {
 	return nil
 }
 
+func (b *MetaBox) encode() []byte {
+	var known []BoxInt
+	if b.hdlr != nil {
+		known = append(known, b.hdlr)
+	}
+	return makeFullBox("meta", b.version, b.flags, encodeChildren(b.Box, known))
+}
+
 // An 8.8 Fixed Point Decimal notation
 type Fixed16 uint16
 
@@ -895,9 +1690,12 @@ func MakeFixed32(bytes []byte) (Fixed32, os.Error) {
 }
 
 type Chunk struct {
-	sample_description_index, start_sample, sample_count, offset uint32
+	sample_description_index, start_sample, sample_count uint32
+	offset uint64
 }
 
 type Sample struct {
-	size, offset, start_time, duration, cto uint32
+	size, duration, cto uint32
+	start_time, offset uint64
+	sync bool
 }
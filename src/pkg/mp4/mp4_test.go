@@ -0,0 +1,231 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteToRoundTrip(t *testing.T) {
+	data := fixture{}.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("Writing an untouched file changed its bytes")
+	}
+	// Every parsed box encodes to its original bytes
+	for _, box := range f.boxes {
+		if _, ok := box.(*Box); ok {
+			continue
+		}
+		start := box.Start()
+		if !bytes.Equal(box.encode(), data[start:start + box.Size()]) {
+			t.Errorf("%v encodes to different bytes", box.Name())
+		}
+	}
+}
+
+func TestWriteToReflectsChanges(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	f.moov.mvhd.duration = 1234
+	f.moov.traks[1].tkhd.volume = 0x80
+
+	written := openWritten(t, f)
+	defer closeTemp(written)
+	if written.moov.mvhd.duration != 1234 {
+		t.Errorf("mvhd duration is %v, want 1234", written.moov.mvhd.duration)
+	}
+	if volume := written.moov.traks[1].tkhd.volume; volume != 0x80 {
+		t.Errorf("tkhd volume is %v, want 0x80", volume)
+	}
+	for i, trak := range f.moov.traks {
+		checkSamples(t, written.moov.traks[i], trak, 0, len(trak.samples))
+	}
+}
+
+func TestLargeAndOpenBoxes(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	for _, o := range []fixture{ { large_mdat: true }, { open_mdat: true } } {
+		data := o.build()
+		f := openBytes(t, data)
+		defer closeTemp(f)
+		if f.mdat == nil || f.mdat.Start() + f.mdat.Size() != int64(len(data)) {
+			t.Fatalf("%+v: mdat does not reach the end of the file", o)
+		}
+		for i, trak := range plain.moov.traks {
+			checkSamples(t, f.moov.traks[i], trak, 0, len(trak.samples))
+		}
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%+v: writing changed the bytes", o)
+		}
+	}
+}
+
+func TestInvalidBoxSize(t *testing.T) {
+	data := fixture{}.build()
+	// A tkhd, inside the moov, and a box at the top level after the mdat
+	tkhd := bytes.Index(data, []byte("tkhd")) - 4
+	nested := append([]byte{}, data...)
+	copy(nested[tkhd:], tu32(4))
+	top := append(append([]byte{}, data...), tbox("free")...)
+	copy(top[len(data):], tu32(3))
+	for _, test := range []struct{ data []byte; name string; offset int }{ { nested, "tkhd", tkhd }, { top, "free", len(data) } } {
+		tmp, err := ioutil.TempFile("", "mp4_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.Write(test.data)
+		tmp.Close()
+		f, err := Open(tmp.Name())
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(tmp.Name())
+		if err == nil || !strings.Contains(err.String(), test.name) || !strings.Contains(err.String(), fmt.Sprint(test.offset)) {
+			t.Errorf("Opening a file with an invalid %v gave %v", test.name, err)
+		}
+	}
+}
+
+func TestMakeBoxHeader(t *testing.T) {
+	if h := makeBoxHeader("mdat", 100); !bytes.Equal(h, append(tu32(108), "mdat"...)) {
+		t.Errorf("Small header is % x", h)
+	}
+	n := int64(0xFFFFFFFF)
+	want := bytes.Join([][]byte{ tu32(1), []byte("mdat"), tu64(uint64(n + 16)) }, nil)
+	if h := makeBoxHeader("mdat", n); !bytes.Equal(h, want) {
+		t.Errorf("Large header is % x", h)
+	}
+}
+
+func TestCo64(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	data := fixture{ co64: true }.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+	for i, trak := range plain.moov.traks {
+		if f.moov.traks[i].mdia.minf.stbl.co64 == nil {
+			t.Fatal("No co64 parsed")
+		}
+		checkSamples(t, f.moov.traks[i], trak, 0, len(trak.samples))
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Writing changed the bytes")
+	}
+
+	// Offsets that fit go back to an stco
+	c, err := f.NewClip(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipped := openWritten(t, c)
+	defer closeTemp(clipped)
+	for _, trak := range clipped.moov.traks {
+		if stbl := trak.mdia.minf.stbl; stbl.stco == nil || stbl.co64 != nil {
+			t.Error("Clip kept a co64 for small offsets")
+		}
+	}
+}
+
+func TestEncodeHeadLarge(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	offsets := make([][]uint64, len(f.moov.traks))
+	for i, trak := range f.moov.traks {
+		offsets[i] = []uint64{ 0, 1 << 32 }
+		trak.mdia.minf.stbl.setChunkOffsets(offsets[i], false)
+	}
+	head := encodeHead(f.ftyp, f.moov, offsets, 1 << 33)
+
+	mdat := head[len(head) - int(LARGE_BOX_HEADER_SIZE):]
+	if !bytes.Equal(mdat, bytes.Join([][]byte{ tu32(1), []byte("mdat"), tu64(1 << 33 + 16) }, nil)) {
+		t.Errorf("mdat header is % x", mdat)
+	}
+	for _, trak := range f.moov.traks {
+		stbl := trak.mdia.minf.stbl
+		if stbl.co64 == nil || stbl.stco != nil {
+			t.Fatal("Large offsets are not in a co64")
+		}
+		if got := stbl.co64.chunk_offset; got[0] != uint64(len(head)) || got[1] != 1 << 32 + uint64(len(head)) {
+			t.Errorf("Chunk offsets are %v with a head of %v bytes", got, len(head))
+		}
+	}
+}
+
+func TestVersion1Headers(t *testing.T) {
+	plain := openFixture(t, fixture{})
+	defer closeTemp(plain)
+	data := fixture{ v1: true }.build()
+	f := openBytes(t, data)
+	defer closeTemp(f)
+
+	if f.moov.mvhd.version != 1 || f.moov.mvhd.duration != plain.moov.mvhd.duration {
+		t.Errorf("mvhd is version %v lasting %v", f.moov.mvhd.version, f.moov.mvhd.duration)
+	}
+	for i, trak := range f.moov.traks {
+		want := plain.moov.traks[i]
+		if trak.tkhd.version != 1 || trak.tkhd.duration != want.tkhd.duration || trak.tkhd.track_id != want.tkhd.track_id {
+			t.Errorf("Track %v tkhd is %+v", i, trak.tkhd)
+		}
+		if trak.mdia.mdhd.version != 1 || trak.mdia.mdhd.duration != want.mdia.mdhd.duration || trak.mdia.mdhd.timescale != want.mdia.mdhd.timescale {
+			t.Errorf("Track %v mdhd is %+v", i, trak.mdia.mdhd)
+		}
+		elst := trak.edts.elst
+		if elst.version != 1 || elst.segment_duration[0] != want.edts.elst.segment_duration[0] || elst.media_time[0] != want.edts.elst.media_time[0] {
+			t.Errorf("Track %v elst is %+v", i, elst)
+		}
+		checkSamples(t, trak, want, 0, len(want.samples))
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Writing changed the bytes")
+	}
+}
+
+func TestHeaderVersionUpgrade(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	trak := f.moov.traks[0]
+	trak.mdia.mdhd.duration = 1 << 32
+	trak.tkhd.duration = 1 << 33
+	trak.edts.elst.segment_duration[0] = 1 << 33
+	f.moov.mvhd.duration = 1 << 33
+
+	written := openWritten(t, f)
+	defer closeTemp(written)
+	got := written.moov.traks[0]
+	if got.mdia.mdhd.version != 1 || got.mdia.mdhd.duration != 1 << 32 {
+		t.Errorf("mdhd is version %v lasting %v", got.mdia.mdhd.version, got.mdia.mdhd.duration)
+	}
+	if got.tkhd.version != 1 || got.tkhd.duration != 1 << 33 {
+		t.Errorf("tkhd is version %v lasting %v", got.tkhd.version, got.tkhd.duration)
+	}
+	if elst := got.edts.elst; elst.version != 1 || elst.segment_duration[0] != 1 << 33 || elst.media_time[0] != 1024 {
+		t.Errorf("elst is %+v", elst)
+	}
+	if written.moov.mvhd.version != 1 || written.moov.mvhd.duration != 1 << 33 {
+		t.Errorf("mvhd is version %v lasting %v", written.moov.mvhd.version, written.moov.mvhd.duration)
+	}
+}
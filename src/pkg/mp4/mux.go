@@ -0,0 +1,820 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// More H.264 NAL unit types, see extract.go
+const (
+	AVC_NAL_SLICE = 1
+	AVC_NAL_SEI = 6
+	AVC_NAL_PPS = 8
+	AVC_NAL_AUD = 9
+	AVC_NAL_END_OF_SEQUENCE = 10
+	AVC_NAL_END_OF_STREAM = 11
+	AVC_NAL_FILLER = 12
+)
+
+// MUX_CHUNK_DURATION is the length in nanoseconds of the chunks into which a
+// Mux cuts each trak before interleaving them.
+const MUX_CHUNK_DURATION = 5e8
+
+// MUX_MOVIE_TIMESCALE is the timescale of the mvhd and tkhd written by a Mux.
+const MUX_MOVIE_TIMESCALE = 1000
+
+// A Mux builds a progressive MP4 from raw elementary streams, as written by
+// ExtractTrack: H.264 video in the Annex B byte stream format and AAC audio
+// in ADTS frames. The streams are scanned when they are added, and their
+// sample data read again as the MP4 is written.
+type Mux struct {
+	tracks []*muxTrack
+}
+
+// muxTrack is a trak being built from a raw stream.
+type muxTrack struct {
+	source io.ReaderAt
+	trak *TrakBox
+	data [][]dataRange // The ranges of source making up each sample
+	length_prefix bool // Whether each range is a NAL unit written behind its length
+}
+
+// avcSPS holds the fields of an H.264 sequence parameter set that a Mux
+// needs.
+type avcSPS struct {
+	profile uint8
+	chroma_format_idc, bit_depth_luma, bit_depth_chroma uint32
+	separate_colour_plane, frame_mbs_only bool
+	log2_max_frame_num, poc_type, log2_max_poc_lsb uint32
+	width, height uint32
+	num_units_in_tick, time_scale uint32
+}
+
+// avcSlice holds the leading fields of an H.264 slice header.
+type avcSlice struct {
+	idr, reference bool
+	first_mb, frame_num, poc_lsb uint32
+	field_pic, bottom_field bool
+}
+
+// AddH264 adds a video trak read from size bytes of an H.264 Annex B byte
+// stream. Its frame rate is frame_rate if that is not 0, and otherwise comes
+// from the timing information of the SPS, or is 25 frames per second if
+// there is none. The NAL units are grouped into access units, one per sample,
+// with the parameter sets moved to the avcC. Composition offsets are worked
+// out from the picture order counts of the slices, and an edit list added to
+// take out the delay they introduce.
+func (m *Mux) AddH264(r io.ReaderAt, size int64, frame_rate float64) (os.Error) {
+	nalus, err := scanAnnexB(r, size)
+	if err != nil {
+		return err
+	}
+
+	t := &muxTrack{ source: r, length_prefix: true }
+	var sps *avcSPS
+	var sps_nalus, pps_nalus [][]byte
+	var pocs []int
+	var idrs []bool
+	var current []dataRange
+	var first *avcSlice // First slice of the current access unit
+	pictures := 0 // Pictures in the current access unit; 2 for a field pair
+	prev_poc_msb, prev_poc_lsb := 0, 0
+	finish := func() {
+		if first != nil {
+			t.data = append(t.data, current)
+		}
+		current, first, pictures = nil, nil, 0
+	}
+
+	for _, nalu := range nalus {
+		header, err := readRange(r, nalu, 64)
+		if err != nil {
+			return err
+		}
+		nal_type := header[0] & 0x1F
+		switch nal_type {
+		case AVC_NAL_SLICE, AVC_NAL_IDR:
+			if sps == nil {
+				return os.NewError("H.264 slice found before the first SPS")
+			}
+			slice, err := parseAVCSlice(header, sps)
+			if err != nil {
+				return err
+			}
+			if slice.first_mb != 0 {
+				break
+			}
+			// The second field of a pair belongs to the same sample
+			if first != nil && !(pictures == 1 && slice.field_pic && first.field_pic &&
+				slice.frame_num == first.frame_num && slice.bottom_field != first.bottom_field) {
+				finish()
+			}
+			pictures++
+			if first != nil {
+				break
+			}
+			first = slice
+
+			poc := len(pocs)
+			if sps.poc_type == 0 {
+				if slice.idr {
+					prev_poc_msb, prev_poc_lsb = 0, 0
+				}
+				max_lsb := 1 << sps.log2_max_poc_lsb
+				lsb, msb := int(slice.poc_lsb), prev_poc_msb
+				if lsb < prev_poc_lsb && prev_poc_lsb - lsb >= max_lsb / 2 {
+					msb += max_lsb
+				} else if lsb > prev_poc_lsb && lsb - prev_poc_lsb > max_lsb / 2 {
+					msb -= max_lsb
+				}
+				poc = msb + lsb
+				if slice.reference {
+					prev_poc_msb, prev_poc_lsb = msb, lsb
+				}
+			}
+			pocs = append(pocs, poc)
+			idrs = append(idrs, slice.idr)
+		case AVC_NAL_SEI, AVC_NAL_SPS, AVC_NAL_PPS, AVC_NAL_AUD, 14, 15, 16, 17, 18:
+			// These start a new access unit after a picture
+			if first != nil {
+				finish()
+			}
+		}
+
+		switch nal_type {
+		case AVC_NAL_SPS, AVC_NAL_PPS:
+			data, err := readRange(r, nalu, nalu.size)
+			if err != nil {
+				return err
+			}
+			if nal_type == AVC_NAL_SPS {
+				if sps, err = parseAVCSPS(data); err != nil {
+					return err
+				}
+				sps_nalus = addParameterSet(sps_nalus, data)
+			} else
+			{
+				pps_nalus = addParameterSet(pps_nalus, data)
+			}
+		case AVC_NAL_AUD, AVC_NAL_END_OF_SEQUENCE, AVC_NAL_END_OF_STREAM, AVC_NAL_FILLER:
+			// Dropped
+		default:
+			current = append(current, nalu)
+		}
+	}
+	finish()
+	if len(t.data) == 0 {
+		return os.NewError("No H.264 pictures found")
+	}
+	if len(pps_nalus) == 0 {
+		return os.NewError("No H.264 PPS found")
+	}
+
+	timescale, duration := uint32(90000), uint32(3600)
+	if frame_rate > 0 {
+		duration = uint32(90000 / frame_rate + 0.5)
+	} else if sps.time_scale > 0 && sps.num_units_in_tick > 0 {
+		timescale, duration = sps.time_scale, 2 * sps.num_units_in_tick
+	}
+
+	// Pictures are shown in order of their picture order count, which
+	// restarts at every IDR picture
+	shown := make([]int, len(pocs))
+	for start := 0; start < len(pocs); {
+		end := start + 1
+		for end < len(pocs) && !idrs[end] {
+			end++
+		}
+		order := make([]int, end - start)
+		for i := range order {
+			order[i] = start + i
+		}
+		sort.Sort(&byPOC{ order, pocs })
+		for rank, i := range order {
+			shown[i] = start + rank
+		}
+		start = end
+	}
+	delay := 0
+	for i, s := range shown {
+		if i - s > delay {
+			delay = i - s
+		}
+	}
+
+	samples := make([]Sample, len(t.data))
+	for i, ranges := range t.data {
+		size := uint32(0)
+		for _, r := range ranges {
+			size += 4 + uint32(r.size)
+		}
+		samples[i] = Sample{
+			size: size,
+			duration: duration,
+			cto: uint32(shown[i] - i + delay) * duration,
+			start_time: uint64(i) * uint64(duration),
+			sync: idrs[i],
+		}
+	}
+
+	first_sps := sps_nalus[0]
+	sps, _ = parseAVCSPS(first_sps)
+	avcc := &AvccBox{
+		Box: newBox("avcC"),
+		configuration_version: 1,
+		profile: first_sps[1],
+		profile_compatibility: first_sps[2],
+		level: first_sps[3],
+		length_size: 4,
+		sps: sps_nalus,
+		pps: pps_nalus,
+	}
+	switch sps.profile {
+	case 100, 110, 122, 144:
+		avcc.ext = []byte{
+			0xFC | byte(sps.chroma_format_idc),
+			0xF8 | byte(sps.bit_depth_luma - 8),
+			0xF8 | byte(sps.bit_depth_chroma - 8),
+			0, // No SPS extensions
+		}
+	}
+	entry := &VisualSampleEntry{
+		Box: newBox("avc1"),
+		data_reference_index: 1,
+		pre_defined: make([]byte, 16),
+		width: uint16(sps.width),
+		height: uint16(sps.height),
+		horizresolution: 72 << 16,
+		vertresolution: 72 << 16,
+		frame_count: 1,
+		depth: 0x18,
+		pre_defined2: 0xFFFF,
+		avcc: avcc,
+	}
+	m.addTrak(t, "vide", timescale, entry, samples, int64(delay) * int64(duration))
+	t.trak.tkhd.width = Fixed32(sps.width << 16)
+	t.trak.tkhd.height = Fixed32(sps.height << 16)
+	return nil
+}
+
+// AddAAC adds an audio trak read from size bytes of ADTS frames, each of
+// which becomes a sample.
+func (m *Mux) AddAAC(r io.ReaderAt, size int64) (os.Error) {
+	t := &muxTrack{ source: r }
+	var samples []Sample
+	header := make([]byte, 10)
+	pos := int64(0)
+	// Skip an ID3v2 tag, which some encoders put in front of the frames
+	if _, err := r.ReadAt(header, 0); err == nil && string(header[0:3]) == "ID3" {
+		pos = 10 + (int64(header[6] & 0x7F) << 21 | int64(header[7] & 0x7F) << 14 | int64(header[8] & 0x7F) << 7 | int64(header[9] & 0x7F))
+	}
+
+	var object_type, sampling_index, channels byte
+	max_frame := int64(0)
+	for pos < size {
+		if _, err := r.ReadAt(header[:7], pos); err != nil {
+			return os.NewError(fmt.Sprintf("Truncated ADTS header at offset %v", pos))
+		}
+		// Sync word, and layer 0
+		if header[0] != 0xFF || header[1] & 0xF6 != 0xF0 {
+			return os.NewError(fmt.Sprintf("No ADTS frame at offset %v", pos))
+		}
+		header_size := int64(ADTS_HEADER_SIZE)
+		if header[1] & 0x01 == 0 {
+			header_size += 2 // CRC
+		}
+		length := int64(header[3] & 0x03) << 11 | int64(header[4]) << 3 | int64(header[5]) >> 5
+		if length <= header_size || pos + length > size {
+			return os.NewError(fmt.Sprintf("Invalid ADTS frame length at offset %v", pos))
+		}
+		if header[6] & 0x03 != 0 {
+			return os.NewError("ADTS frames with more than one raw data block are not supported")
+		}
+		if len(samples) == 0 {
+			object_type = header[2] >> 6 + 1
+			sampling_index = header[2] >> 2 & 0xF
+			channels = header[2] & 0x01 << 2 | header[3] >> 6
+			if int(sampling_index) >= len(aacSampleRates) {
+				return os.NewError("Invalid ADTS sampling frequency index")
+			}
+		}
+		samples = append(samples, Sample{
+			size: uint32(length - header_size),
+			duration: 1024,
+			start_time: uint64(len(samples)) * 1024,
+			sync: true,
+		})
+		t.data = append(t.data, []dataRange{ { pos + header_size, length - header_size } })
+		if length - header_size > max_frame {
+			max_frame = length - header_size
+		}
+		pos += length
+	}
+	if len(samples) == 0 {
+		return os.NewError("No ADTS frames found")
+	}
+
+	sample_rate := aacSampleRates[sampling_index]
+	// The bitrates are the average and the most in any one second
+	total, peak := int64(0), int64(0)
+	second := int64(0)
+	for i, sample := range samples {
+		total += int64(sample.size)
+		second += int64(sample.size)
+		if i >= sample_rate / 1024 {
+			second -= int64(samples[i - sample_rate / 1024].size)
+		}
+		if second > peak {
+			peak = second
+		}
+	}
+	avg := total * 8 * int64(sample_rate) / (int64(len(samples)) * 1024)
+
+	// AudioSpecificConfig with a GASpecificConfig of zeros
+	config := []byte{ object_type << 3 | sampling_index >> 1, sampling_index << 7 | channels << 3 }
+	decoder_config := []byte{ 0x40, 0x05 << 2 | 0x01 } // MPEG-4 audio stream
+	decoder_config = append(decoder_config, byte(max_frame >> 16), byte(max_frame >> 8), byte(max_frame))
+	decoder_config = putUint32(decoder_config, uint32(peak * 8))
+	decoder_config = putUint32(decoder_config, uint32(avg))
+	decoder_config = append(decoder_config, makeDescriptor(DECODER_SPECIFIC_INFO_TAG, config)...)
+	track_id := uint16(len(m.tracks) + 1)
+	es := append([]byte{ byte(track_id >> 8), byte(track_id), 0 }, makeDescriptor(DECODER_CONFIG_DESCRIPTOR_TAG, decoder_config)...)
+	es = append(es, makeDescriptor(SL_CONFIG_DESCRIPTOR_TAG, []byte{ 0x02 })...)
+	esds := &EsdsBox{
+		Box: newBox("esds"),
+		descriptor: makeDescriptor(ES_DESCRIPTOR_TAG, es),
+		es_id: track_id,
+		object_type_indication: 0x40,
+		stream_type: 0x05,
+		buffer_size_db: uint32(max_frame),
+		max_bitrate: uint32(peak * 8),
+		avg_bitrate: uint32(avg),
+		decoder_specific_info: config,
+	}
+
+	channel_count := uint16(channels)
+	if channel_count == 0 {
+		// Given by a program config element in the stream
+		channel_count = 2
+	}
+	rate := Fixed32(0)
+	if sample_rate <= 0xFFFF {
+		rate = Fixed32(sample_rate << 16)
+	}
+	entry := &AudioSampleEntry{
+		Box: newBox("mp4a"),
+		data_reference_index: 1,
+		reserved: make([]byte, 6),
+		channelcount: channel_count,
+		samplesize: 16,
+		pre_defined: make([]byte, 4),
+		samplerate: rate,
+		esds: esds,
+	}
+	m.addTrak(t, "soun", uint32(sample_rate), entry, samples, 0)
+	return nil
+}
+
+// addTrak builds the trak of t from its sample entry and samples, cut into
+// chunks of MUX_CHUNK_DURATION, and adds it to the Mux. media_time is the
+// start of the trak's single edit, if it is not 0.
+func (m *Mux) addTrak(t *muxTrack, handler string, timescale uint32, entry BoxInt, samples []Sample, media_time int64) {
+	stbl := &StblBox{
+		Box: newBox("stbl"),
+		stsd: &StsdBox{ Box: newBox("stsd"), entry_count: 1, entries: []BoxInt{ entry } },
+		stts: &SttsBox{ Box: newBox("stts") },
+		stsc: &StscBox{ Box: newBox("stsc") },
+		stsz: &StszBox{ Box: newBox("stsz"), sample_count: uint32(len(samples)) },
+	}
+	ctts := &CttsBox{ Box: newBox("ctts") }
+	stss := &StssBox{ Box: newBox("stss") }
+	var chunks []Chunk
+	chunk_end := int64(0)
+	duration := uint64(0)
+	for i, sample := range samples {
+		stbl.stts.addSample(sample.duration)
+		ctts.addSample(sample.cto)
+		if sample.sync {
+			stss.sample_number = append(stss.sample_number, uint32(i + 1))
+			stss.entry_count++
+		}
+		stbl.stsz.entry_size = append(stbl.stsz.entry_size, sample.size)
+
+		if start := fromTimescale(sample.start_time, timescale); i == 0 || start >= chunk_end {
+			chunks = append(chunks, Chunk{ sample_description_index: 1, start_sample: uint32(i + 1) })
+			chunk_end = start + MUX_CHUNK_DURATION
+		}
+		chunks[len(chunks)-1].sample_count++
+		duration += uint64(sample.duration)
+	}
+	for i, chunk := range chunks {
+		stbl.stsc.addChunk(uint32(i + 1), chunk.sample_count, 1)
+	}
+	if ctts.entry_count > 1 || ctts.sample_offset[0] != 0 {
+		stbl.ctts = ctts
+	}
+	if int(stss.entry_count) < len(samples) {
+		stbl.stss = stss
+	}
+
+	track_id := uint32(len(m.tracks) + 1)
+	tkhd := &TkhdBox{
+		Box: newBox("tkhd"),
+		flags: [3]byte{ 0, 0, 0x03 }, // Enabled, in the movie
+		track_id: track_id,
+		duration: duration * MUX_MOVIE_TIMESCALE / uint64(timescale),
+		matrix: unityMatrix(),
+	}
+	minf := &MinfBox{
+		Box: newBox("minf"),
+		dinf: &DinfBox{
+			Box: newBox("dinf"),
+			// A single url entry flagged as in this file
+			dref: &DrefBox{ Box: newBox("dref"), entry_count: 1, other_data: makeFullBox("url ", 0, [3]byte{ 0, 0, 1 }, nil) },
+		},
+		stbl: stbl,
+	}
+	track_name := "VideoHandler"
+	if handler == "soun" {
+		tkhd.alternate_group = 1
+		tkhd.volume = 0x0100
+		minf.smhd = &SmhdBox{ Box: newBox("smhd") }
+		track_name = "SoundHandler"
+	} else
+	{
+		minf.vmhd = &VmhdBox{ Box: newBox("vmhd"), flags: [3]byte{ 0, 0, 1 } }
+	}
+	t.trak = &TrakBox{
+		Box: newBox("trak"),
+		tkhd: tkhd,
+		mdia: &MdiaBox{
+			Box: newBox("mdia"),
+			mdhd: &MdhdBox{
+				Box: newBox("mdhd"),
+				timescale: timescale,
+				duration: duration,
+				language: 0x55C4, // und
+			},
+			hdlr: &HdlrBox{ Box: newBox("hdlr"), handler_type: handler, track_name: track_name + "\x00" },
+			minf: minf,
+		},
+		chunks: chunks,
+		samples: samples,
+	}
+	if media_time > 0 {
+		t.trak.edts = &EdtsBox{
+			Box: newBox("edts"),
+			elst: &ElstBox{
+				Box: newBox("elst"),
+				entry_count: 1,
+				segment_duration: []uint64{ tkhd.duration },
+				media_time: []int64{ media_time },
+				media_rate_integer: []uint16{ 1 },
+				media_rate_fraction: []uint16{ 0 },
+			},
+		}
+	}
+	m.tracks = append(m.tracks, t)
+}
+
+// WriteTo writes the traks to w as a progressive MP4. See Layout.
+func (m *Mux) WriteTo(w io.Writer) (n int64, err os.Error) {
+	ls, err := m.layOut()
+	if err != nil {
+		return 0, err
+	}
+	return ls.WriteTo(w)
+}
+
+// layOut lays out the MP4: an ftyp and moov, then an mdat holding the chunks
+// of all traks in order of time.
+func (m *Mux) layOut() (layouts, os.Error) {
+	if len(m.tracks) == 0 {
+		return nil, os.NewError("No streams to mux")
+	}
+	ftyp := &FtypBox{
+		Box: newBox("ftyp"),
+		major_brand: "isom",
+		minor_version: "\x00\x00\x02\x00",
+		compatible_brands: []string{ "isom", "iso2", "avc1", "mp41" },
+	}
+	// The matrix and pre_defined fields, ahead of next_track_id
+	mvhd_data := append(make([]byte, 10), unityMatrix()...)
+	mvhd := &MvhdBox{
+		Box: newBox("mvhd"),
+		timescale: MUX_MOVIE_TIMESCALE,
+		next_track_id: uint32(len(m.tracks) + 1),
+		rate: 0x00010000,
+		volume: 0x0100,
+		other_data: append(mvhd_data, make([]byte, 24)...),
+	}
+	moov := &MoovBox{ Box: newBox("moov"), mvhd: mvhd }
+
+	var chunks []*chunkData
+	offsets := make([][]uint64, len(m.tracks))
+	for i, t := range m.tracks {
+		moov.traks = append(moov.traks, t.trak)
+		if t.trak.tkhd.duration > mvhd.duration {
+			mvhd.duration = t.trak.tkhd.duration
+		}
+		timescale := t.trak.mdia.mdhd.timescale
+		for j, chunk := range t.trak.chunks {
+			start := fromTimescale(t.trak.samples[chunk.start_sample - 1].start_time, timescale)
+			chunks = append(chunks, &chunkData{ trak: i, index: j, offset: start })
+		}
+		offsets[i] = make([]uint64, len(t.trak.chunks))
+	}
+	// Interleave the chunks by their start times, earlier traks first
+	sort.Sort(chunksByTime(chunks))
+
+	ls := layouts{ nil }
+	data_size := int64(0)
+	for _, c := range chunks {
+		t := m.tracks[c.trak]
+		chunk := t.trak.chunks[c.index]
+		offsets[c.trak][c.index] = uint64(data_size)
+		var l *layout
+		first := int(chunk.start_sample) - 1
+		for i := first; i < first + int(chunk.sample_count); i++ {
+			for _, r := range t.data[i] {
+				if t.length_prefix || l == nil {
+					l = &layout{ file: t.source }
+					if t.length_prefix {
+						l.head = putUint32(nil, uint32(r.size))
+					}
+					ls = append(ls, l)
+				}
+				l.addRange(r.offset, r.size)
+			}
+			data_size += int64(t.trak.samples[i].size)
+		}
+	}
+	ls[0] = &layout{ head: encodeHead(ftyp, moov, offsets, data_size) }
+	return ls, nil
+}
+
+// unityMatrix returns the identity transformation matrix of tkhd and mvhd.
+func unityMatrix() ([]byte) {
+	matrix := putUint32(nil, 0x00010000)
+	matrix = append(matrix, make([]byte, 12)...)
+	matrix = putUint32(matrix, 0x00010000)
+	matrix = append(matrix, make([]byte, 12)...)
+	return putUint32(matrix, 0x40000000)
+}
+
+// chunksByTime sorts chunks by their start times, held in offset, then by
+// trak.
+type chunksByTime []*chunkData
+
+func (c chunksByTime) Len() int { return len(c) }
+func (c chunksByTime) Less(i, j int) bool {
+	if c[i].offset != c[j].offset {
+		return c[i].offset < c[j].offset
+	}
+	return c[i].trak < c[j].trak
+}
+func (c chunksByTime) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+// byPOC sorts the indexes of pictures by their picture order counts.
+type byPOC struct {
+	order, pocs []int
+}
+
+func (p *byPOC) Len() int { return len(p.order) }
+func (p *byPOC) Less(i, j int) bool { return p.pocs[p.order[i]] < p.pocs[p.order[j]] }
+func (p *byPOC) Swap(i, j int) { p.order[i], p.order[j] = p.order[j], p.order[i] }
+
+// scanAnnexB returns the NAL units of an Annex B byte stream, found between
+// its start codes.
+func scanAnnexB(r io.ReaderAt, size int64) ([]dataRange, os.Error) {
+	var nalus []dataRange
+	buf := make([]byte, 1 << 16)
+	zeros, start := 0, int64(-1)
+	for pos := int64(0); pos < size; {
+		n := len(buf)
+		if int64(n) > size - pos {
+			n = int(size - pos)
+		}
+		if _, err := r.ReadAt(buf[:n], pos); err != nil {
+			return nil, err
+		}
+		for i, b := range buf[:n] {
+			switch {
+			case b == 0:
+				zeros++
+			case b == 1 && zeros >= 2:
+				at := pos + int64(i)
+				// The zeros before the start code are not part of the NAL
+				// unit before it
+				if end := at - int64(zeros); start >= 0 && end > start {
+					nalus = append(nalus, dataRange{ start, end - start })
+				}
+				start = at + 1
+				zeros = 0
+			default:
+				zeros = 0
+			}
+		}
+		pos += int64(n)
+	}
+	if start < 0 {
+		return nil, os.NewError("No Annex B start code found")
+	}
+	if end := size - int64(zeros); end > start {
+		nalus = append(nalus, dataRange{ start, end - start })
+	}
+	return nalus, nil
+}
+
+// readRange reads up to max bytes from the start of the range.
+func readRange(r io.ReaderAt, d dataRange, max int64) ([]byte, os.Error) {
+	if d.size < max {
+		max = d.size
+	}
+	data := make([]byte, max)
+	if _, err := r.ReadAt(data, d.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// addParameterSet adds nalu to sets unless it is already there.
+func addParameterSet(sets [][]byte, nalu []byte) ([][]byte) {
+	for _, set := range sets {
+		if string(set) == string(nalu) {
+			return sets
+		}
+	}
+	return append(sets, nalu)
+}
+
+// unescapeRBSP removes the emulation prevention bytes from the payload of a
+// NAL unit.
+func unescapeRBSP(data []byte) ([]byte) {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else
+		{
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// parseAVCSPS parses an H.264 sequence parameter set NAL unit.
+func parseAVCSPS(nalu []byte) (*avcSPS, os.Error) {
+	if len(nalu) < 4 {
+		return nil, os.NewError("H.264 SPS too short")
+	}
+	sps := &avcSPS{ profile: nalu[1], chroma_format_idc: 1, bit_depth_luma: 8, bit_depth_chroma: 8 }
+	r := &bitReader{ data: unescapeRBSP(nalu[4:]) }
+	r.readUE() // seq_parameter_set_id
+	switch sps.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.chroma_format_idc = r.readUE()
+		if sps.chroma_format_idc == 3 {
+			sps.separate_colour_plane = r.read(1) == 1
+		}
+		sps.bit_depth_luma = r.readUE() + 8
+		sps.bit_depth_chroma = r.readUE() + 8
+		r.read(1) // qpprime_y_zero_transform_bypass_flag
+		if r.read(1) == 1 {
+			lists := 8
+			if sps.chroma_format_idc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.read(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.readSE() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	sps.log2_max_frame_num = r.readUE() + 4
+	sps.poc_type = r.readUE()
+	switch sps.poc_type {
+	case 0:
+		sps.log2_max_poc_lsb = r.readUE() + 4
+	case 1:
+		r.read(1) // delta_pic_order_always_zero_flag
+		r.readSE() // offset_for_non_ref_pic
+		r.readSE() // offset_for_top_to_bottom_field
+		for i := r.readUE(); i > 0 && r.err == nil; i-- {
+			r.readSE() // offset_for_ref_frame
+		}
+	}
+	r.readUE() // max_num_ref_frames
+	r.read(1) // gaps_in_frame_num_value_allowed_flag
+	width_mbs := r.readUE() + 1
+	height_map_units := r.readUE() + 1
+	sps.frame_mbs_only = r.read(1) == 1
+	if !sps.frame_mbs_only {
+		r.read(1) // mb_adaptive_frame_field_flag
+	}
+	r.read(1) // direct_8x8_inference_flag
+	crop_left, crop_right, crop_top, crop_bottom := uint32(0), uint32(0), uint32(0), uint32(0)
+	if r.read(1) == 1 {
+		crop_left, crop_right, crop_top, crop_bottom = r.readUE(), r.readUE(), r.readUE(), r.readUE()
+	}
+	// Cropping is in units of chroma samples
+	crop_x, crop_y := uint32(1), uint32(1)
+	if !sps.separate_colour_plane && (sps.chroma_format_idc == 1 || sps.chroma_format_idc == 2) {
+		crop_x = 2
+	}
+	if !sps.separate_colour_plane && sps.chroma_format_idc == 1 {
+		crop_y = 2
+	}
+	frame_height := height_map_units
+	if !sps.frame_mbs_only {
+		frame_height *= 2
+		crop_y *= 2
+	}
+	sps.width = width_mbs * 16 - crop_x * (crop_left + crop_right)
+	sps.height = frame_height * 16 - crop_y * (crop_top + crop_bottom)
+
+	if r.read(1) == 1 {
+		// VUI parameters, up to the timing information
+		if r.read(1) == 1 {
+			if r.read(8) == 255 {
+				r.read(32) // sar_width and sar_height
+			}
+		}
+		if r.read(1) == 1 {
+			r.read(1) // overscan_appropriate_flag
+		}
+		if r.read(1) == 1 {
+			r.read(4) // video_format and video_full_range_flag
+			if r.read(1) == 1 {
+				r.read(24) // colour_primaries, transfer and matrix
+			}
+		}
+		if r.read(1) == 1 {
+			r.readUE() // chroma_sample_loc_type_top_field
+			r.readUE() // chroma_sample_loc_type_bottom_field
+		}
+		if r.read(1) == 1 {
+			sps.num_units_in_tick = r.read(32)
+			sps.time_scale = r.read(32)
+		}
+	}
+	if r.err != nil {
+		return nil, os.NewError("H.264 SPS truncated")
+	}
+	return sps, nil
+}
+
+// parseAVCSlice parses the start of the header of an H.264 slice NAL unit,
+// up to the picture order count.
+func parseAVCSlice(nalu []byte, sps *avcSPS) (*avcSlice, os.Error) {
+	s := &avcSlice{
+		idr: nalu[0] & 0x1F == AVC_NAL_IDR,
+		reference: nalu[0] >> 5 & 0x03 != 0,
+	}
+	r := &bitReader{ data: unescapeRBSP(nalu[1:]) }
+	s.first_mb = r.readUE()
+	r.readUE() // slice_type
+	r.readUE() // pic_parameter_set_id
+	if sps.separate_colour_plane {
+		r.read(2) // colour_plane_id
+	}
+	s.frame_num = r.read(int(sps.log2_max_frame_num))
+	if !sps.frame_mbs_only {
+		s.field_pic = r.read(1) == 1
+		if s.field_pic {
+			s.bottom_field = r.read(1) == 1
+		}
+	}
+	if s.idr {
+		r.readUE() // idr_pic_id
+	}
+	if sps.poc_type == 0 {
+		s.poc_lsb = r.read(int(sps.log2_max_poc_lsb))
+	}
+	if r.err != nil {
+		return nil, os.NewError("H.264 slice header truncated")
+	}
+	return s, nil
+}
@@ -0,0 +1,364 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// byteReader reads a byte slice as an io.ReaderAt.
+type byteReader []byte
+
+func (b byteReader) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off >= int64(len(b)) {
+		return 0, os.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = os.EOF
+	}
+	return n, err
+}
+
+// bitWriter writes the bit fields of H.264 parameter sets and slice headers.
+type bitWriter struct {
+	data []byte
+	n uint
+}
+
+func (w *bitWriter) write(v uint32, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n % 8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v >> uint(i) & 1) << (7 - w.n % 8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) writeUE(v uint32) {
+	v++
+	bits := 0
+	for x := v; x > 1; x >>= 1 {
+		bits++
+	}
+	w.write(0, bits)
+	w.write(v, bits + 1)
+}
+
+// nalu returns a NAL unit with the given header byte, holding the bits
+// written followed by payload, with emulation prevention bytes inserted.
+func (w *bitWriter) nalu(header byte, payload ...byte) ([]byte) {
+	out := []byte{ header }
+	zeros := 0
+	for _, b := range append(w.data, payload...) {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else
+		{
+			zeros = 0
+		}
+	}
+	return out
+}
+
+var (
+	// Baseline profile, level 3, 640x360 at 25 frames per second, with
+	// 6-bit picture order counts
+	testMuxSPS = func() ([]byte) {
+		w := new(bitWriter)
+		w.write(66, 8) // profile_idc
+		w.write(0, 8) // Constraint flags
+		w.write(30, 8) // level_idc
+		w.writeUE(0) // seq_parameter_set_id
+		w.writeUE(0) // log2_max_frame_num_minus4
+		w.writeUE(0) // pic_order_cnt_type
+		w.writeUE(2) // log2_max_pic_order_cnt_lsb_minus4
+		w.writeUE(2) // max_num_ref_frames
+		w.write(0, 1) // gaps_in_frame_num_value_allowed_flag
+		w.writeUE(39) // pic_width_in_mbs_minus1
+		w.writeUE(22) // pic_height_in_map_units_minus1
+		w.write(1, 1) // frame_mbs_only_flag
+		w.write(1, 1) // direct_8x8_inference_flag
+		w.write(1, 1) // frame_cropping_flag
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(4)
+		w.write(1, 1) // vui_parameters_present_flag
+		w.write(0, 4) // No aspect ratio, overscan, video signal or chroma location
+		w.write(1, 1) // timing_info_present_flag
+		w.write(1, 32) // num_units_in_tick
+		w.write(50, 32) // time_scale
+		w.write(1, 1) // rbsp_stop_one_bit
+		return w.nalu(0x67)
+	}()
+	testMuxPPS = []byte{ 0x68, 0xCE, 0x38, 0x80 }
+
+	// Two GOPs of an I, P, B, B pattern, in decode order: the index in
+	// display order of each picture of a GOP
+	testMuxOrder = []int{ 0, 3, 1, 2, 6, 4, 5, 9, 7, 8 }
+)
+
+// testMuxSlice returns picture i of a GOP, in decode order: the slice header
+// followed by some bytes of picture data.
+func testMuxSlice(i int) ([]byte) {
+	w := new(bitWriter)
+	w.writeUE(0) // first_mb_in_slice
+	header := byte(0x41) // Reference non-IDR slice
+	slice_type := uint32(0) // P
+	switch {
+	case i == 0:
+		header, slice_type = 0x65, 2 // IDR, I
+	case testMuxOrder[i] % 3 != 0:
+		header, slice_type = 0x01, 1 // Non-reference B
+	}
+	w.writeUE(slice_type)
+	w.writeUE(0) // pic_parameter_set_id
+	w.write(uint32(i), 4) // frame_num
+	if i == 0 {
+		w.writeUE(0) // idr_pic_id
+	}
+	w.write(uint32(testMuxOrder[i] * 2), 6) // pic_order_cnt_lsb
+	return w.nalu(header, byte(i), 0, 0, 1, 0xAA)
+}
+
+// testH264 returns an Annex B stream of two GOPs, with the parameter sets
+// ahead of each IDR picture, and the pictures in decode order.
+func testH264() (stream []byte, pictures [][]byte) {
+	for gop := 0; gop < 2; gop++ {
+		for i := range testMuxOrder {
+			if i == 0 {
+				stream = append(append(stream, ANNEXB_START_CODE...), testMuxSPS...)
+				stream = append(append(stream, ANNEXB_START_CODE...), testMuxPPS...)
+			}
+			slice := testMuxSlice(i)
+			stream = append(append(stream, ANNEXB_START_CODE...), slice...)
+			pictures = append(pictures, slice)
+		}
+	}
+	return stream, pictures
+}
+
+// testADTS returns a stream of ADTS frames of AAC LC at 48 kHz in stereo,
+// with a CRC on the frames whose index is a multiple of crc if it is not 0,
+// and the raw frames.
+func testADTS(count, crc int) (stream []byte, frames [][]byte) {
+	for i := 0; i < count; i++ {
+		frame := bytes.Repeat([]byte{ byte(i) }, 10 + i % 4)
+		header := []byte{ 0xFF, 0xF1, 0x4C, 0x80, 0, 0x1F, 0xFC }
+		if crc != 0 && i % crc == 0 {
+			header[1] = 0xF0
+			header = append(header, 0x12, 0x34)
+		}
+		n := len(header) + len(frame)
+		header[3] |= byte(n >> 11)
+		header[4] = byte(n >> 3)
+		header[5] |= byte(n << 5)
+		stream = append(append(stream, header...), frame...)
+		frames = append(frames, frame)
+	}
+	return stream, frames
+}
+
+func TestParseAVCSPS(t *testing.T) {
+	sps, err := parseAVCSPS(testMuxSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.profile != 66 || sps.width != 640 || sps.height != 360 || sps.poc_type != 0 || sps.log2_max_poc_lsb != 6 ||
+		sps.log2_max_frame_num != 4 || !sps.frame_mbs_only || sps.num_units_in_tick != 1 || sps.time_scale != 50 {
+		t.Errorf("SPS is %+v", sps)
+	}
+	// The 32-bit num_units_in_tick needs emulation prevention
+	if !bytes.Contains(testMuxSPS, []byte{ 0, 0, 3 }) {
+		t.Error("SPS has no emulation prevention byte")
+	}
+	if _, err = parseAVCSPS(testMuxSPS[:8]); err == nil {
+		t.Error("Parsed a truncated SPS")
+	}
+}
+
+func TestMuxH264(t *testing.T) {
+	stream, pictures := testH264()
+	m := new(Mux)
+	if err := m.AddH264(byteReader(stream), int64(len(stream)), 0); err != nil {
+		t.Fatal(err)
+	}
+	f := openWritten(t, m)
+	defer closeTemp(f)
+	if len(f.moov.traks) != 1 {
+		t.Fatalf("%v traks", len(f.moov.traks))
+	}
+	trak := f.moov.traks[0]
+	if trak.Codec() != "avc1.42001e" || trak.Width() != 640 || trak.Height() != 360 || trak.mdia.mdhd.timescale != 50 {
+		t.Errorf("Trak is %v %vx%v at timescale %v", trak.Codec(), trak.Width(), trak.Height(), trak.mdia.mdhd.timescale)
+	}
+	avcc := trak.sampleEntry().(*VisualSampleEntry).AVCConfig()
+	if len(avcc.SPS()) != 1 || !bytes.Equal(avcc.SPS()[0], testMuxSPS) || len(avcc.PPS()) != 1 || !bytes.Equal(avcc.PPS()[0], testMuxPPS) {
+		t.Error("avcC does not hold the parameter sets")
+	}
+
+	// Each picture is a sample, shown in the order of its picture order
+	// count, one frame late, which the edit list takes out
+	if len(trak.samples) != len(pictures) {
+		t.Fatalf("%v samples, want %v", len(trak.samples), len(pictures))
+	}
+	for i, sample := range trak.samples {
+		n := i % len(testMuxOrder)
+		cto := uint32(testMuxOrder[n] - n + 1) * 2
+		if sample.duration != 2 || sample.start_time != uint64(i * 2) || sample.cto != cto || sample.sync != (n == 0) {
+			t.Errorf("Sample %v is %+v, want cto %v", i, sample, cto)
+		}
+		want := append(putUint32(nil, uint32(len(pictures[i]))), pictures[i]...)
+		if data := f.ReadBytesAt(int64(sample.size), int64(sample.offset)); !bytes.Equal(data, want) {
+			t.Errorf("Sample %v is % x, want % x", i, data, want)
+		}
+	}
+	if trak.mediaTime() != 2 {
+		t.Errorf("Edit list starts at %v", trak.mediaTime())
+	}
+
+	// Extracting gives back the stream
+	buf := new(bytes.Buffer)
+	if err := f.ExtractTrack(1, buf); err != nil || !bytes.Equal(buf.Bytes(), stream) {
+		t.Errorf("Extracted %v bytes of %v, %v", buf.Len(), len(stream), err)
+	}
+}
+
+func TestMuxH264AccessUnits(t *testing.T) {
+	// Access unit delimiters are dropped, and SEI starts an access unit
+	aud := []byte{ AVC_NAL_AUD, 0xF0 }
+	sei := []byte{ AVC_NAL_SEI, 5, 1, 0xAA, 0x80 }
+	var stream []byte
+	for _, nalu := range [][]byte{ aud, testMuxSPS, testMuxPPS, sei, testMuxSlice(0), aud, testMuxSlice(1), aud, sei, testMuxSlice(2) } {
+		stream = append(append(stream, 0, 0, 1), nalu...)
+	}
+	m := new(Mux)
+	if err := m.AddH264(byteReader(stream), int64(len(stream)), 30); err != nil {
+		t.Fatal(err)
+	}
+	f := openWritten(t, m)
+	defer closeTemp(f)
+	trak := f.moov.traks[0]
+	if len(trak.samples) != 3 || trak.mdia.mdhd.timescale != 90000 || trak.samples[0].duration != 3000 {
+		t.Fatalf("%v samples of duration %v at timescale %v", len(trak.samples), trak.samples[0].duration, trak.mdia.mdhd.timescale)
+	}
+	for i, nalus := range [][][]byte{ { sei, testMuxSlice(0) }, { testMuxSlice(1) }, { sei, testMuxSlice(2) } } {
+		var want []byte
+		for _, nalu := range nalus {
+			want = append(append(want, putUint32(nil, uint32(len(nalu)))...), nalu...)
+		}
+		sample := trak.samples[i]
+		if data := f.ReadBytesAt(int64(sample.size), int64(sample.offset)); !bytes.Equal(data, want) {
+			t.Errorf("Sample %v is % x, want % x", i, data, want)
+		}
+	}
+}
+
+func TestMuxAAC(t *testing.T) {
+	stream, frames := testADTS(100, 3)
+	// An ID3v2 tag in front is skipped
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05"), 1, 2, 3, 4, 5)
+	stream = append(id3, stream...)
+	m := new(Mux)
+	if err := m.AddAAC(byteReader(stream), int64(len(stream))); err != nil {
+		t.Fatal(err)
+	}
+	f := openWritten(t, m)
+	defer closeTemp(f)
+	trak := f.moov.traks[0]
+	entry := trak.sampleEntry().(*AudioSampleEntry)
+	if trak.Codec() != "mp4a.40.2" || entry.SampleRate() != 48000 || entry.ChannelCount() != 2 || trak.mdia.mdhd.timescale != 48000 {
+		t.Errorf("Trak is %v at %v Hz with %v channels", trak.Codec(), entry.SampleRate(), entry.ChannelCount())
+	}
+	if asc := entry.ESDescriptor().DecoderSpecificInfo(); !bytes.Equal(asc, []byte{ 0x11, 0x90 }) {
+		t.Errorf("AudioSpecificConfig is % x", asc)
+	}
+	if len(trak.samples) != len(frames) {
+		t.Fatalf("%v samples, want %v", len(trak.samples), len(frames))
+	}
+	for i, sample := range trak.samples {
+		data := f.ReadBytesAt(int64(sample.size), int64(sample.offset))
+		if !sample.sync || sample.duration != 1024 || !bytes.Equal(data, frames[i]) {
+			t.Errorf("Sample %v is %+v, % x", i, sample, data)
+		}
+	}
+}
+
+func TestMuxInterleaved(t *testing.T) {
+	video, _ := testH264()
+	audio, _ := testADTS(60, 0)
+	m := new(Mux)
+	if err := m.AddH264(byteReader(video), int64(len(video)), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddAAC(byteReader(audio), int64(len(audio))); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	f := openBytes(t, buf.Bytes())
+	defer closeTemp(f)
+	if len(f.moov.traks) != 2 || f.moov.traks[1].tkhd.track_id != 2 || f.moov.mvhd.next_track_id != 3 {
+		t.Fatalf("%v traks", len(f.moov.traks))
+	}
+
+	// Chunks of at least half a second are laid out in order of time
+	var starts []int64
+	var offsets []uint64
+	for _, trak := range f.moov.traks {
+		for j, chunk := range trak.chunks {
+			start := fromTimescale(trak.samples[chunk.start_sample - 1].start_time, trak.mdia.mdhd.timescale)
+			if j > 0 && start - starts[len(starts)-1] < MUX_CHUNK_DURATION {
+				t.Errorf("Chunk %v of trak %v starts at %v", j, trak.tkhd.track_id, start)
+			}
+			starts = append(starts, start)
+			offsets = append(offsets, chunk.offset)
+		}
+	}
+	if len(starts) != 5 {
+		t.Errorf("%v chunks", len(starts))
+	}
+	for i := range starts {
+		for j := range starts {
+			if starts[i] < starts[j] && offsets[i] > offsets[j] {
+				t.Errorf("Chunk at %v is written after the chunk at %v", starts[i], starts[j])
+			}
+		}
+	}
+
+	// The moov written is parsed back to the same bytes
+	if !bytes.Equal(f.moov.encode(), f.ReadBytesAt(f.moov.Size(), f.moov.Start())) {
+		t.Error("moov encodes to different bytes")
+	}
+}
+
+func TestMuxErrors(t *testing.T) {
+	m := new(Mux)
+	if _, err := m.WriteTo(new(bytes.Buffer)); err == nil {
+		t.Error("Wrote a Mux with no streams")
+	}
+	for _, stream := range [][]byte{
+		{ 1, 2, 3 }, // No start code
+		append([]byte{ 0, 0, 1 }, testMuxSlice(0)...), // No SPS
+		append(append([]byte{ 0, 0, 1 }, testMuxSPS...), 0, 0, 1, 0x68, 0xCE), // No pictures
+	} {
+		if err := m.AddH264(byteReader(stream), int64(len(stream)), 0); err == nil {
+			t.Errorf("Added H.264 stream % x", stream)
+		}
+	}
+	stream, _ := testADTS(3, 0)
+	for _, bad := range [][]byte{ stream[:len(stream)-1], { 0xFF, 0xF1 }, append([]byte{ 0 }, stream...), {} } {
+		if err := m.AddAAC(byteReader(bad), int64(len(bad))); err == nil {
+			t.Errorf("Added ADTS stream % x", bad)
+		}
+	}
+}
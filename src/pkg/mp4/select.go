@@ -0,0 +1,68 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// WriteTracks writes f to w as a progressive MP4 holding only the traks with
+// the given track IDs. See SelectTracks and NewDefragment.
+func (f *File) WriteTracks(track_ids []uint32, w io.Writer) (os.Error) {
+	if err := f.SelectTracks(track_ids); err != nil {
+		return err
+	}
+	return f.Defragment(w)
+}
+
+// SelectTracks keeps only the traks of f with the given track IDs, in their
+// original order. The others are dropped from the moov, along with their
+// trex in a fragmented file's mvex, and mvhd's next_track_id is set past
+// the largest ID kept. Track IDs are not changed, so that references
+// between the traks kept still hold.
+//
+// The data of the dropped traks is still in the file and is written by
+// WriteTo, but not by the writers that lay out a new mdat from the samples,
+// such as NewDefragment, NewClip and the fragmenters.
+func (f *File) SelectTracks(track_ids []uint32) (os.Error) {
+	if len(track_ids) == 0 {
+		return os.NewError("No tracks selected")
+	}
+	for _, id := range track_ids {
+		if f.moov.trak(id) == nil {
+			return os.NewError(fmt.Sprintf("No track with ID %v", id))
+		}
+	}
+	selected := func(id uint32) (bool) {
+		for _, selected_id := range track_ids {
+			if selected_id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	var traks []*TrakBox
+	next_track_id := uint32(1)
+	for _, trak := range f.moov.traks {
+		if id := trak.tkhd.track_id; selected(id) {
+			traks = append(traks, trak)
+			if id >= next_track_id {
+				next_track_id = id + 1
+			}
+		}
+	}
+	f.moov.traks = traks
+	f.moov.mvhd.next_track_id = next_track_id
+
+	if f.moov.mvex != nil {
+		var trexs []*TrexBox
+		for _, trex := range f.moov.mvex.trexs {
+			if selected(trex.track_id) {
+				trexs = append(trexs, trex)
+			}
+		}
+		f.moov.mvex.trexs = trexs
+	}
+	return nil
+}
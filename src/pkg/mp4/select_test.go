@@ -0,0 +1,60 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTracks(t *testing.T) {
+	for _, o := range []fixture{ {}, { frag: true } } {
+		f := openFixture(t, o)
+		defer closeTemp(f)
+		audio := f.moov.traks[1]
+		buf := new(bytes.Buffer)
+		if err := f.WriteTracks([]uint32{ 2 }, buf); err != nil {
+			t.Fatal(err)
+		}
+		g := openBytes(t, buf.Bytes())
+		defer closeTemp(g)
+
+		// Only the audio is left, in the moov and the mdat
+		if len(g.moov.traks) != 1 || g.moov.traks[0].tkhd.track_id != 2 || g.moov.mvhd.next_track_id != 3 {
+			t.Fatalf("%+v: %v traks, next track ID %v", o, len(g.moov.traks), g.moov.mvhd.next_track_id)
+		}
+		checkSamples(t, g.moov.traks[0], audio, 0, fixtureAudioSamples)
+		size := int64(0)
+		for i := 0; i < fixtureAudioSamples; i++ {
+			size += int64(len(audioSample(i)))
+		}
+		if g.mdat.Size() - g.mdat.HeaderSize() != size {
+			t.Errorf("%+v: mdat holds %v bytes, audio is %v", o, g.mdat.Size() - g.mdat.HeaderSize(), size)
+		}
+	}
+}
+
+func TestSelectTracks(t *testing.T) {
+	f := openFixture(t, fixture{ frag: true })
+	defer closeTemp(f)
+	if err := f.SelectTracks([]uint32{ 1 }); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.moov.traks) != 1 || f.moov.traks[0].tkhd.track_id != 1 || f.moov.mvhd.next_track_id != 2 {
+		t.Errorf("%v traks, next track ID %v", len(f.moov.traks), f.moov.mvhd.next_track_id)
+	}
+	if trexs := f.moov.mvex.trexs; len(trexs) != 1 || trexs[0].track_id != 1 {
+		t.Errorf("trexs are %+v", trexs)
+	}
+
+	// The moov written is that of the selection
+	g := openBytes(t, append(f.ftyp.encode(), f.moov.encode()...))
+	defer closeTemp(g)
+	if len(g.moov.traks) != 1 || len(g.moov.mvex.trexs) != 1 {
+		t.Errorf("Written moov has %v traks and %v trexs", len(g.moov.traks), len(g.moov.mvex.trexs))
+	}
+
+	for _, ids := range [][]uint32{ nil, { 2 }, { 1, 3 } } {
+		if err := f.SelectTracks(ids); err == nil {
+			t.Errorf("Selected tracks %v", ids)
+		}
+	}
+}
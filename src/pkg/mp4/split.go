@@ -0,0 +1,178 @@
+package mp4
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Split cuts f into parts, each a self-contained progressive MP4 with its
+// own sample tables and durations. Parts start at sync samples of the first
+// track that has samples which are not, and every sample goes to the part
+// in which it starts. A part lasts at most every nanoseconds, if every is
+// not 0, ending at the last sync sample within that of its start, unless
+// the sync samples are further apart. It holds at most max_size bytes, if
+// max_size is not 0, and Split fails if a part cannot be cut that small.
+func (f *File) Split(every, max_size int64) (parts []*Clip, err os.Error) {
+	if every <= 0 && max_size <= 0 {
+		return nil, os.NewError("Split needs a duration or a size")
+	}
+	cuts, last := f.cutPoints()
+	if len(cuts) == 0 {
+		return nil, os.NewError("File contains no samples")
+	}
+	// The part ending at cuts[i] ends at the end of the file if i is past the
+	// last cut point
+	cut := func(i int) (int64) {
+		if i >= len(cuts) {
+			return 0
+		}
+		return cuts[i]
+	}
+
+	for start := 0; start < len(cuts); {
+		end := len(cuts)
+		if every > 0 {
+			// Take in the following cut points while the part stays within
+			// every
+			end = start + 1
+			for end < len(cuts) {
+				next := last
+				if end + 1 < len(cuts) {
+					next = cuts[end + 1]
+				}
+				if next - cuts[start] > every {
+					break
+				}
+				end++
+			}
+		}
+
+		part, err := f.part(cuts[start], cut(end))
+		if err != nil {
+			return nil, err
+		}
+		if max_size > 0 && part.Size() > max_size {
+			// Find the last cut point that keeps the part small enough
+			n := sort.Search(end - start - 1, func(i int) bool {
+				p, err := f.part(cuts[start], cut(start + i + 1))
+				return err != nil || p.Size() > max_size
+			})
+			if n == 0 {
+				return nil, os.NewError(fmt.Sprintf("The part starting at %vs cannot be cut under %v bytes", float64(cuts[start]) / 1e9, max_size))
+			}
+			end = start + n
+			if part, err = f.part(cuts[start], cut(end)); err != nil {
+				return nil, err
+			}
+		}
+		parts = append(parts, part)
+		start = end
+	}
+	return parts, nil
+}
+
+// cutPoints returns the times in nanoseconds at which the parts of a Split
+// may start: those of the sync samples of the first track that has samples
+// which are not, or of all the samples of the first track if every sample is
+// a sync sample. last is the time at which that track's samples end.
+func (f *File) cutPoints() (cuts []int64, last int64) {
+	var ref *TrakBox
+	for _, trak := range f.moov.traks {
+		if ref == nil && len(trak.samples) > 0 {
+			ref = trak
+		}
+		if !trak.allSync() {
+			ref = trak
+			break
+		}
+	}
+	if ref == nil {
+		return nil, 0
+	}
+	timescale := ref.mdia.mdhd.timescale
+	for i, sample := range ref.samples {
+		if sample.sync || i == 0 {
+			cuts = append(cuts, fromTimescale(sample.start_time, timescale))
+		}
+	}
+	end := ref.samples[len(ref.samples)-1]
+	return cuts, fromTimescale(end.start_time + uint64(end.duration), timescale)
+}
+
+// part prepares the part of f holding the samples of every trak that start
+// from start up to end, given in nanoseconds, in an mdat of their chunks. An
+// end of 0 runs through to the end of f.
+func (f *File) part(start, end int64) (c *Clip, err os.Error) {
+	mvhd := *f.moov.mvhd
+	mvhd.duration = 0
+	moov := &MoovBox{ Box: newBox("moov"), mvhd: &mvhd }
+
+	var chunks []*chunkData
+	for i, trak := range f.moov.traks {
+		first, last := trak.samplesFrom(start), len(trak.samples)
+		if end > 0 {
+			last = trak.samplesFrom(end)
+		}
+		clipped := trak.clip(first, last, mvhd.timescale)
+		if clipped.tkhd.duration > mvhd.duration {
+			mvhd.duration = clipped.tkhd.duration
+		}
+		moov.traks = append(moov.traks, clipped)
+
+		// The chunks as trimmed by clip
+		index := 0
+		from, to := trak.chunkRange(first, last)
+		for _, chunk := range trak.chunks[from:to] {
+			chunk_first := int(chunk.start_sample) - 1
+			chunk_last := chunk_first + int(chunk.sample_count)
+			if chunk_first < first {
+				chunk_first = first
+			}
+			if chunk_last > last {
+				chunk_last = last
+			}
+			if chunk_first >= chunk_last {
+				continue
+			}
+			size := int64(0)
+			for _, sample := range trak.samples[chunk_first:chunk_last] {
+				size += int64(sample.size)
+			}
+			offset := int64(trak.samples[chunk_first].offset)
+			chunks = append(chunks, &chunkData{ trak: i, index: index, offset: offset, size: size })
+			index++
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, os.NewError("Part contains no samples")
+	}
+
+	offsets := make([][]uint64, len(moov.traks))
+	for i, trak := range moov.traks {
+		offsets[i] = trak.mdia.minf.stbl.chunkOffsets()
+	}
+	sort.Sort(chunksByOffset(chunks))
+
+	c = &Clip{ layout{ file: f } }
+	data_size := int64(0)
+	for _, chunk := range chunks {
+		offsets[chunk.trak][chunk.index] = uint64(data_size)
+		c.addRange(chunk.offset, chunk.size)
+		data_size += chunk.size
+	}
+	c.layOut(f.ftyp, moov, offsets)
+	return c, nil
+}
+
+// samplesFrom returns the index of the first sample of the trak starting at
+// or after ns nanoseconds, or len(t.samples) if there is none. It is the
+// sample being decoded at that time, found by sampleAt, or the one after it.
+func (t *TrakBox) samplesFrom(ns int64) (int) {
+	timescale := t.mdia.mdhd.timescale
+	i := t.sampleAt(toTimescale(ns, timescale))
+	if i < len(t.samples) && fromTimescale(t.samples[i].start_time, timescale) < ns {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,100 @@
+package mp4
+
+import (
+	"testing"
+)
+
+// checkParts fails unless the parts hold every sample of f in turn, and
+// returns the parts' files, which the caller closes.
+func checkParts(t *testing.T, f *File, parts []*Clip) (files []*File) {
+	first := make([]int, len(f.moov.traks))
+	for _, part := range parts {
+		p := openWritten(t, part)
+		files = append(files, p)
+		if len(p.moov.traks) != len(f.moov.traks) {
+			t.Fatalf("Part has %v traks", len(p.moov.traks))
+		}
+		for i, trak := range p.moov.traks {
+			checkSamples(t, trak, f.moov.traks[i], first[i], len(trak.samples))
+			first[i] += len(trak.samples)
+		}
+	}
+	for i, trak := range f.moov.traks {
+		if first[i] != len(trak.samples) {
+			t.Errorf("Parts hold %v samples of track %v, which has %v", first[i], i + 1, len(trak.samples))
+		}
+	}
+	return files
+}
+
+func TestSplitDuration(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	// Keyframes come every second; parts last at most the duration, or a
+	// second if it is shorter
+	for _, test := range []struct{ every int64; parts int }{ { 1e9, 3 }, { 1.5e9, 3 }, { 2e9, 2 }, { 2.5e9, 2 }, { 3e9, 1 }, { 1e10, 1 }, { 5e8, 3 } } {
+		parts, err := f.Split(test.every, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != test.parts {
+			t.Errorf("Split(%v) made %v parts, want %v", test.every, len(parts), test.parts)
+		}
+		video, audio := f.moov.traks[0], f.moov.traks[1]
+		first_video, first_audio := 0, 0
+		for i, p := range checkParts(t, f, parts) {
+			if !p.moov.traks[0].samples[0].sync {
+				t.Errorf("Split(%v) part %v starts with %+v", test.every, i, p.moov.traks[0].samples[0])
+			}
+			if d := fromTimescale(p.moov.traks[0].mdia.mdhd.duration, fixtureVideoTimescale); d > test.every && d > 1e9 {
+				t.Errorf("Split(%v) part %v lasts %v", test.every, i, d)
+			}
+			// Audio samples go to the part in which they start
+			start := fromTimescale(video.samples[first_video].start_time, fixtureVideoTimescale)
+			if fromTimescale(audio.samples[first_audio].start_time, fixtureAudioTimescale) < start ||
+				first_audio > 0 && fromTimescale(audio.samples[first_audio-1].start_time, fixtureAudioTimescale) >= start {
+				t.Errorf("Split(%v) part %v starting at %v starts with audio sample %v", test.every, i, start, first_audio)
+			}
+			first_video += len(p.moov.traks[0].samples)
+			first_audio += len(p.moov.traks[1].samples)
+			closeTemp(p)
+		}
+	}
+}
+
+func TestSplitSize(t *testing.T) {
+	f := openFixture(t, fixture{ co64: true })
+	defer closeTemp(f)
+	gops, err := f.Split(1e9, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two of the first seconds, but not all three
+	max_size := gops[0].Size() + gops[1].Size()
+	parts, err := f.Split(0, max_size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Errorf("%v parts", len(parts))
+	}
+	for i, part := range parts {
+		if part.Size() > max_size {
+			t.Errorf("Part %v is %v bytes, more than %v", i, part.Size(), max_size)
+		}
+	}
+	for _, p := range checkParts(t, f, parts) {
+		closeTemp(p)
+	}
+
+	// Both limits at once
+	if parts, err = f.Split(1e9, max_size); err != nil || len(parts) != 3 {
+		t.Errorf("Split by duration and size made %v parts, %v", len(parts), err)
+	}
+	if _, err = f.Split(0, gops[0].Size() / 2); err == nil {
+		t.Error("Split a keyframe interval under half its size")
+	}
+	if _, err = f.Split(0, 0); err == nil {
+		t.Error("Split with no limit")
+	}
+}
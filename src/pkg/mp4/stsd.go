@@ -0,0 +1,274 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// Sample entry types of video and audio tracks. Entries of other types are
+// kept as plain boxes.
+var (
+	visualSampleEntries = []string{
+		"avc1", "avc2", "avc3", "avc4", "hvc1", "hev1", "dvh1", "dvhe",
+		"av01", "vp08", "vp09", "mp4v", "s263", "encv",
+	}
+	audioSampleEntries = []string{
+		"mp4a", "ac-3", "ec-3", "Opus", "fLaC", "alac", "samr", "sawb",
+		"twos", "sowt", "lpcm", "ipcm", "enca",
+	}
+)
+
+// newSampleEntry returns the sample entry type for an stsd entry box.
+func newSampleEntry(box *Box) (BoxInt) {
+	for _, name := range visualSampleEntries {
+		if box.Name() == name {
+			return &VisualSampleEntry{ Box: box }
+		}
+	}
+	for _, name := range audioSampleEntries {
+		if box.Name() == name {
+			return &AudioSampleEntry{ Box: box }
+		}
+	}
+	return box
+}
+
+// readSampleEntryChildren reads the boxes that follow the first n bytes of
+// a sample entry.
+func readSampleEntryChildren(b *Box, n int64) (boxes []*Box, err os.Error) {
+	return readBoxes(b.File(), b.Start() + b.HeaderSize() + n, b.Size() - b.HeaderSize() - n)
+}
+
+// A VisualSampleEntry describes the coding of a video track.
+type VisualSampleEntry struct {
+	*Box
+	data_reference_index uint16
+	pre_defined []byte // 16 bytes; QuickTime keeps version, vendor and quality here
+	width, height uint16
+	horizresolution, vertresolution Fixed32
+	frame_count uint16
+	compressorname string
+	depth uint16
+	pre_defined2 uint16
+	avcc *AvccBox
+	hvcc *HvccBox
+	av1c *Av1cBox
+	vpcc *VpccBox
+	esds *EsdsBox
+}
+
+func (b *VisualSampleEntry) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 78 {
+		return os.NewError("Visual sample entry too short: " + b.Name())
+	}
+	// Skip 6 bytes for reserved space
+	b.data_reference_index = binary.BigEndian.Uint16(data[6:8])
+	b.pre_defined = data[8:24]
+	b.width = binary.BigEndian.Uint16(data[24:26])
+	b.height = binary.BigEndian.Uint16(data[26:28])
+	b.horizresolution, err = MakeFixed32(data[28:32])
+	if err != nil {
+		return err
+	}
+	b.vertresolution, err = MakeFixed32(data[32:36])
+	if err != nil {
+		return err
+	}
+	// Skip 4 bytes for reserved space (uint32)
+	b.frame_count = binary.BigEndian.Uint16(data[40:42])
+	// compressorname is a Pascal string padded to 32 bytes
+	n := int(data[42])
+	if n > 31 {
+		n = 31
+	}
+	b.compressorname = string(data[43:43+n])
+	b.depth = binary.BigEndian.Uint16(data[74:76])
+	b.pre_defined2 = binary.BigEndian.Uint16(data[76:78])
+
+	boxes, err := readSampleEntryChildren(b.Box, 78)
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		switch subBox.Name() {
+		case "avcC":
+			b.avcc = &AvccBox{ Box:subBox }
+			err = b.avcc.parse()
+			b.children = append(b.children, b.avcc)
+		case "hvcC":
+			b.hvcc = &HvccBox{ Box:subBox }
+			err = b.hvcc.parse()
+			b.children = append(b.children, b.hvcc)
+		case "av1C":
+			b.av1c = &Av1cBox{ Box:subBox }
+			err = b.av1c.parse()
+			b.children = append(b.children, b.av1c)
+		case "vpcC":
+			b.vpcc = &VpccBox{ Box:subBox }
+			err = b.vpcc.parse()
+			b.children = append(b.children, b.vpcc)
+		case "esds":
+			b.esds = &EsdsBox{ Box:subBox }
+			err = b.esds.parse()
+			b.children = append(b.children, b.esds)
+		default:
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *VisualSampleEntry) encode() []byte {
+	data := make([]byte, 6, 78)
+	data = putUint16(data, b.data_reference_index)
+	data = append(data, b.pre_defined...)
+	data = putUint16(data, b.width)
+	data = putUint16(data, b.height)
+	data = putUint32(data, uint32(b.horizresolution))
+	data = putUint32(data, uint32(b.vertresolution))
+	data = putUint32(data, 0)
+	data = putUint16(data, b.frame_count)
+	name := make([]byte, 32)
+	name[0] = byte(copy(name[1:], b.compressorname))
+	data = append(data, name...)
+	data = putUint16(data, b.depth)
+	data = putUint16(data, b.pre_defined2)
+	var known []BoxInt
+	if b.avcc != nil {
+		known = append(known, b.avcc)
+	}
+	if b.hvcc != nil {
+		known = append(known, b.hvcc)
+	}
+	if b.av1c != nil {
+		known = append(known, b.av1c)
+	}
+	if b.vpcc != nil {
+		known = append(known, b.vpcc)
+	}
+	if b.esds != nil {
+		known = append(known, b.esds)
+	}
+	return makeBox(b.Name(), append(data, encodeChildren(b.Box, known)...))
+}
+
+// Width returns the width of the video in pixels.
+func (b *VisualSampleEntry) Width() (int) { return int(b.width) }
+
+// Height returns the height of the video in pixels.
+func (b *VisualSampleEntry) Height() (int) { return int(b.height) }
+
+// Depth returns the colour depth of the video in bits.
+func (b *VisualSampleEntry) Depth() (int) { return int(b.depth) }
+
+// CompressorName returns the informative name of the encoder, if any.
+func (b *VisualSampleEntry) CompressorName() (string) { return b.compressorname }
+
+// AVCConfig returns the H.264 decoder configuration, or nil.
+func (b *VisualSampleEntry) AVCConfig() (*AvccBox) { return b.avcc }
+
+// HEVCConfig returns the H.265 decoder configuration, or nil.
+func (b *VisualSampleEntry) HEVCConfig() (*HvccBox) { return b.hvcc }
+
+// AV1Config returns the AV1 decoder configuration, or nil.
+func (b *VisualSampleEntry) AV1Config() (*Av1cBox) { return b.av1c }
+
+// VPConfig returns the VP8/VP9 decoder configuration, or nil.
+func (b *VisualSampleEntry) VPConfig() (*VpccBox) { return b.vpcc }
+
+// ESDescriptor returns the MPEG-4 Part 2 elementary stream descriptor, or nil.
+func (b *VisualSampleEntry) ESDescriptor() (*EsdsBox) { return b.esds }
+
+// An AudioSampleEntry describes the coding of an audio track.
+type AudioSampleEntry struct {
+	*Box
+	data_reference_index uint16
+	version uint16 // QuickTime sound description version
+	reserved []byte // 6 bytes; QuickTime keeps revision and vendor here
+	channelcount, samplesize uint16
+	pre_defined []byte // 4 bytes; QuickTime keeps compression ID and packet size here
+	samplerate Fixed32
+	extension []byte // Extra fields of QuickTime version 1 and 2 descriptions
+	esds *EsdsBox
+}
+
+func (b *AudioSampleEntry) parse() (err os.Error) {
+	data := b.ReadBoxData()
+	if len(data) < 28 {
+		return os.NewError("Audio sample entry too short: " + b.Name())
+	}
+	// Skip 6 bytes for reserved space
+	b.data_reference_index = binary.BigEndian.Uint16(data[6:8])
+	b.version = binary.BigEndian.Uint16(data[8:10])
+	b.reserved = data[10:16]
+	b.channelcount = binary.BigEndian.Uint16(data[16:18])
+	b.samplesize = binary.BigEndian.Uint16(data[18:20])
+	b.pre_defined = data[20:24]
+	b.samplerate, err = MakeFixed32(data[24:28])
+	if err != nil {
+		return err
+	}
+	n := 28
+	switch b.version {
+	case 1:
+		n += 16
+	case 2:
+		n += 36
+	}
+	if len(data) < n {
+		return os.NewError("Audio sample entry too short: " + b.Name())
+	}
+	b.extension = data[28:n]
+
+	boxes, err := readSampleEntryChildren(b.Box, int64(n))
+	if err != nil {
+		return err
+	}
+	for _, subBox := range boxes {
+		switch subBox.Name() {
+		case "esds":
+			b.esds = &EsdsBox{ Box:subBox }
+			err = b.esds.parse()
+			b.children = append(b.children, b.esds)
+		default:
+			b.children = append(b.children, subBox)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *AudioSampleEntry) encode() []byte {
+	data := make([]byte, 6, 28)
+	data = putUint16(data, b.data_reference_index)
+	data = putUint16(data, b.version)
+	data = append(data, b.reserved...)
+	data = putUint16(data, b.channelcount)
+	data = putUint16(data, b.samplesize)
+	data = append(data, b.pre_defined...)
+	data = putUint32(data, uint32(b.samplerate))
+	data = append(data, b.extension...)
+	var known []BoxInt
+	if b.esds != nil {
+		known = append(known, b.esds)
+	}
+	return makeBox(b.Name(), append(data, encodeChildren(b.Box, known)...))
+}
+
+// ChannelCount returns the number of audio channels.
+func (b *AudioSampleEntry) ChannelCount() (int) { return int(b.channelcount) }
+
+// SampleSize returns the size of an audio sample in bits.
+func (b *AudioSampleEntry) SampleSize() (int) { return int(b.samplesize) }
+
+// SampleRate returns the audio sample rate in Hz.
+func (b *AudioSampleEntry) SampleRate() (int) { return int(uint32(b.samplerate) >> 16) }
+
+// ESDescriptor returns the MPEG-4 elementary stream descriptor, or nil.
+func (b *AudioSampleEntry) ESDescriptor() (*EsdsBox) { return b.esds }
@@ -0,0 +1,69 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSampleEntries(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	video, audio := f.moov.traks[0], f.moov.traks[1]
+
+	if video.Format() != "avc1" || video.Width() != 640 || video.Height() != 360 {
+		t.Errorf("Video is %v %vx%v", video.Format(), video.Width(), video.Height())
+	}
+	visual, ok := video.SampleEntries()[0].(*VisualSampleEntry)
+	if !ok {
+		t.Fatal("avc1 is not a VisualSampleEntry")
+	}
+	if visual.Depth() != 24 || visual.AVCConfig() == nil || visual.data_reference_index != 1 {
+		t.Errorf("avc1 is %+v", visual)
+	}
+
+	if audio.Format() != "mp4a" || audio.Width() != 0 {
+		t.Errorf("Audio is %v %vx%v", audio.Format(), audio.Width(), audio.Height())
+	}
+	sound, ok := audio.SampleEntries()[0].(*AudioSampleEntry)
+	if !ok {
+		t.Fatal("mp4a is not an AudioSampleEntry")
+	}
+	if sound.ChannelCount() != 2 || sound.SampleSize() != 16 || sound.SampleRate() != 44100 || sound.ESDescriptor() == nil {
+		t.Errorf("mp4a is %+v", sound)
+	}
+}
+
+func TestSampleEntryRoundTrip(t *testing.T) {
+	// A QuickTime version 1 sound description with its 16 extra bytes
+	qt := tbox("sowt", make([]byte, 6), tu16(1), tu16(1), make([]byte, 6), tu16(1), tu16(16),
+		make([]byte, 4), tu32(fixtureAudioTimescale << 16),
+		tu32(1024), tu32(2), tu32(4), tu32(2),
+		tbox("wave", []byte("opaque")))
+	unknown := tbox("xyzw", []byte("unknown entry"))
+
+	for _, entry := range [][]byte{ qt, unknown } {
+		data := fixture{ audio_entry: entry }.build()
+		f := openBytes(t, data)
+		defer closeTemp(f)
+		if got := f.moov.traks[1].mdia.minf.stbl.stsd.encode(); !bytes.Contains(got, entry) {
+			t.Errorf("%s entry encodes to % x", entry[4:8], got)
+		}
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: writing changed the bytes", entry[4:8])
+		}
+	}
+
+	f := openBytes(t, fixture{ audio_entry: qt }.build())
+	defer closeTemp(f)
+	sound, ok := f.moov.traks[1].sampleEntry().(*AudioSampleEntry)
+	if !ok {
+		t.Fatal("sowt is not an AudioSampleEntry")
+	}
+	if sound.version != 1 || len(sound.extension) != 16 || sound.SampleRate() != 44100 || sound.ChannelCount() != 1 {
+		t.Errorf("sowt is %+v", sound)
+	}
+}
@@ -0,0 +1,179 @@
+package mp4
+
+import (
+	"fmt"
+	"os"
+)
+
+// A Track gives access to the samples of one of a File's traks, as found in
+// its sample tables and those of any movie fragments.
+type Track struct {
+	*TrakBox
+	file *File
+}
+
+// Tracks returns the tracks of the movie.
+func (f *File) Tracks() ([]*Track) {
+	tracks := make([]*Track, len(f.moov.traks))
+	for i, trak := range f.moov.traks {
+		tracks[i] = &Track{ trak, f }
+	}
+	return tracks
+}
+
+// Track returns the track with the given track ID, or nil.
+func (f *File) Track(track_id uint32) (*Track) {
+	if trak := f.moov.trak(track_id); trak != nil {
+		return &Track{ trak, f }
+	}
+	return nil
+}
+
+// ID returns the track ID from tkhd.
+func (t *Track) ID() (uint32) {
+	return t.tkhd.track_id
+}
+
+// Timescale returns the number of units per second of the track's sample
+// times and durations.
+func (t *Track) Timescale() (uint32) {
+	return t.mdia.mdhd.timescale
+}
+
+// SampleCount returns the number of samples in the track.
+func (t *Track) SampleCount() (int) {
+	return len(t.samples)
+}
+
+// Samples returns an iterator over the track's samples in decode order,
+// positioned before the first:
+//
+//	for it := track.Samples(); it.Next(); {
+//		sample := it.Sample()
+//		...
+//	}
+func (t *Track) Samples() (*SampleIterator) {
+	return &SampleIterator{ track: t, index: -1 }
+}
+
+// A SampleIterator steps through the samples of a Track by index. It holds
+// no resources, so it may be dropped at any point.
+type SampleIterator struct {
+	track *Track
+	index int
+}
+
+// Next moves to the next sample, and reports whether there is one.
+func (it *SampleIterator) Next() (bool) {
+	if it.index < len(it.track.samples) {
+		it.index++
+	}
+	return it.index < len(it.track.samples)
+}
+
+// Seek positions the iterator before sample i, so that Next moves to it.
+// Seeking to SyncSampleBefore of a time starts playback there.
+func (it *SampleIterator) Seek(i int) {
+	if i < 0 {
+		i = 0
+	}
+	if i > len(it.track.samples) {
+		i = len(it.track.samples)
+	}
+	it.index = i - 1
+}
+
+// Index returns the index of the current sample, counting from 0.
+func (it *SampleIterator) Index() (int) {
+	return it.index
+}
+
+// Sample returns the current sample.
+func (it *SampleIterator) Sample() (Sample) {
+	return it.track.samples[it.index]
+}
+
+// Data reads the data of the current sample.
+func (it *SampleIterator) Data() ([]byte, os.Error) {
+	return it.track.ReadSample(it.index)
+}
+
+// Sample returns sample i of the track, counting from 0.
+func (t *Track) Sample(i int) (Sample, os.Error) {
+	if i < 0 || i >= len(t.samples) {
+		return Sample{}, os.NewError(fmt.Sprintf("No sample %v in track %v", i, t.ID()))
+	}
+	return t.samples[i], nil
+}
+
+// SampleAtTime returns the index of the sample being decoded ns nanoseconds
+// into the track, or SampleCount() if that is past its last sample. The
+// sample is found by a binary search of the stts runs.
+func (t *Track) SampleAtTime(ns int64) (int) {
+	if ns < 0 {
+		ns = 0
+	}
+	return t.sampleAt(toTimescale(ns, t.Timescale()))
+}
+
+// SyncSampleBefore returns the index of the closest sync sample decoded at or
+// before ns nanoseconds into the track, where playback can start when
+// seeking to that time. It is 0 if there is none, and found by binary
+// searches of the stts runs and the stss.
+func (t *Track) SyncSampleBefore(ns int64) (int) {
+	i := t.SampleAtTime(ns)
+	if i >= len(t.samples) {
+		i = len(t.samples) - 1
+	}
+	if i <= 0 {
+		return 0
+	}
+	return t.syncSampleBefore(i)
+}
+
+// ReadSample returns the data of sample i of the track, counting from 0.
+func (t *Track) ReadSample(i int) ([]byte, os.Error) {
+	sample, err := t.Sample(i)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, sample.size)
+	if _, err = t.file.ReadAt(data, int64(sample.offset)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Offset returns the position of the sample's data in the file.
+func (s Sample) Offset() (int64) {
+	return int64(s.offset)
+}
+
+// Size returns the length in bytes of the sample's data.
+func (s Sample) Size() (uint32) {
+	return s.size
+}
+
+// DecodeTime returns the time at which the sample is decoded, in the
+// timescale of its track.
+func (s Sample) DecodeTime() (uint64) {
+	return s.start_time
+}
+
+// CompositionOffset returns the difference between the time at which the
+// sample is shown and the time at which it is decoded, in the timescale of
+// its track. It is negative only in version 1 ctts boxes.
+func (s Sample) CompositionOffset() (int32) {
+	return int32(s.cto)
+}
+
+// Duration returns the length of the sample in the timescale of its track.
+func (s Sample) Duration() (uint32) {
+	return s.duration
+}
+
+// Sync reports whether the sample is a sync sample, such as a keyframe, from
+// which decoding can start.
+func (s Sample) Sync() (bool) {
+	return s.sync
+}
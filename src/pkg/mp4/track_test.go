@@ -0,0 +1,80 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTracks(t *testing.T) {
+	for _, o := range []fixture{ {}, { frag: true } } {
+		f := openFixture(t, o)
+		defer closeTemp(f)
+		tracks := f.Tracks()
+		if len(tracks) != 2 || f.Track(2) == nil || f.Track(2).ID() != 2 || f.Track(3) != nil {
+			t.Fatalf("%+v: %v tracks", o, len(tracks))
+		}
+		video, audio := tracks[0], tracks[1]
+		if video.Timescale() != fixtureVideoTimescale || video.SampleCount() != fixtureVideoSamples ||
+			audio.Timescale() != fixtureAudioTimescale || audio.SampleCount() != fixtureAudioSamples {
+			t.Errorf("%+v: tracks are %v/%v and %v/%v", o, video.Timescale(), video.SampleCount(), audio.Timescale(), audio.SampleCount())
+		}
+
+		n := 0
+		for it := video.Samples(); it.Next(); n++ {
+			s := it.Sample()
+			if it.Index() != n || s.Size() != uint32(len(videoSample(n))) || s.DecodeTime() != uint64(n * fixtureVideoDelta) ||
+				s.Duration() != fixtureVideoDelta || s.CompositionOffset() != int32(videoCTO(n)) || s.Sync() != videoSync(n) {
+				t.Fatalf("%+v: sample %v is %+v", o, n, s)
+			}
+			data, err := it.Data()
+			if err != nil || !bytes.Equal(data, videoSample(n)) {
+				t.Fatalf("%+v: sample %v data is % x, %v", o, n, data, err)
+			}
+			if data, _ = video.ReadSample(n); !bytes.Equal(data, f.ReadBytesAt(int64(s.Size()), s.Offset())) {
+				t.Fatalf("%+v: sample %v is not at its offset", o, n)
+			}
+		}
+		if n != fixtureVideoSamples {
+			t.Errorf("%+v: iterated over %v samples", o, n)
+		}
+	}
+}
+
+func TestSampleIteratorSeek(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	video := f.Track(1)
+
+	// Stopping early leaves nothing behind, and a new iterator starts over
+	it := video.Samples()
+	for it.Next() && it.Index() < 10 {
+	}
+	if it = video.Samples(); !it.Next() || it.Index() != 0 {
+		t.Errorf("New iterator is at %v", it.Index())
+	}
+
+	// Seeking to the keyframe before 1.5s
+	it.Seek(video.SyncSampleBefore(15e8))
+	if !it.Next() || it.Index() != 25 || !it.Sample().Sync() {
+		t.Errorf("Seek to 1.5s gave sample %v", it.Index())
+	}
+	it.Seek(-1)
+	if !it.Next() || it.Index() != 0 {
+		t.Errorf("Seek before the start gave sample %v", it.Index())
+	}
+	it.Seek(fixtureVideoSamples - 1)
+	if !it.Next() || it.Next() || it.Next() {
+		t.Error("Iterator did not end after the last sample")
+	}
+	it.Seek(1000)
+	if it.Next() {
+		t.Errorf("Seek past the end gave sample %v", it.Index())
+	}
+
+	if _, err := video.Sample(fixtureVideoSamples); err == nil {
+		t.Error("Got a sample past the end")
+	}
+	if _, err := video.ReadSample(-1); err == nil {
+		t.Error("Read sample -1")
+	}
+}
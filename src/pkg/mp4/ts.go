@@ -0,0 +1,293 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// MPEG-2 transport stream constants
+const (
+	TS_PACKET_SIZE = 188
+	TS_SYNC_BYTE = 0x47
+	TS_PAT_PID = 0x0000
+	TS_PMT_PID = 0x1000
+	TS_FIRST_ES_PID = 0x0100
+	TS_CLOCK = 90000 // PTS and DTS are in 90kHz units
+	TS_DELAY = 63000 // Lead of the PCR over the first DTS, 0.7s
+	TS_PSI_INTERVAL = 1e8 // Longest time between repeats of the PAT and PMT, in nanoseconds
+)
+
+// Stream types carried in the PMT
+const (
+	TS_STREAM_AAC = 0x0F
+	TS_STREAM_H264 = 0x1B
+	TS_STREAM_H265 = 0x24
+)
+
+// tsStream is one trak carried in a transport stream.
+type tsStream struct {
+	trak *TrakBox
+	pid uint16
+	stream_type, stream_id byte
+	convert func(sample []byte) ([]byte, os.Error)
+	next int // Index of the next sample to write
+	cc byte // Continuity counter
+}
+
+// tsWriter writes 188 byte transport stream packets to w.
+type tsWriter struct {
+	w io.Writer
+	streams []*tsStream
+	pcr *tsStream // The stream whose packets carry the PCR
+	psi_cc [2]byte // Continuity counters of the PAT and PMT
+	psi_time int64 // Decode time at which they were last written
+}
+
+// WriteTS remuxes f into an MPEG-2 transport stream written to w. H.264 and
+// H.265 video is carried as an Annex B byte stream and AAC audio as ADTS
+// frames, in PES packets timed by the samples' decode and composition times.
+// Traks in other formats are left out. The PAT and PMT are repeated about
+// every 100ms, as players joining the stream need them, and before every
+// video keyframe.
+func (f *File) WriteTS(w io.Writer) (os.Error) {
+	tw := &tsWriter{ w: w }
+	video, audio := byte(0xE0), byte(0xC0)
+	for _, trak := range f.moov.traks {
+		s := &tsStream{ trak: trak, pid: uint16(TS_FIRST_ES_PID + len(tw.streams)) }
+		switch trak.Format() {
+		case "avc1", "avc3":
+			s.stream_type = TS_STREAM_H264
+		case "hvc1", "hev1":
+			s.stream_type = TS_STREAM_H265
+		case "mp4a":
+			s.stream_type = TS_STREAM_AAC
+		default:
+			continue
+		}
+		var err os.Error
+		if s.convert, err = trak.elementaryStream(); err != nil {
+			return err
+		}
+		if s.stream_type == TS_STREAM_AAC {
+			s.stream_id = audio
+			audio++
+		} else
+		{
+			s.stream_id = video
+			video++
+			if tw.pcr == nil {
+				tw.pcr = s
+			}
+		}
+		tw.streams = append(tw.streams, s)
+	}
+	if len(tw.streams) == 0 {
+		return os.NewError("File contains no tracks that can be carried in a transport stream")
+	}
+	if tw.pcr == nil {
+		tw.pcr = tw.streams[0]
+	}
+
+	if err := tw.writePSI(); err != nil {
+		return err
+	}
+	// Write the samples of all streams in decode order
+	for {
+		var s *tsStream
+		var dts int64
+		for _, candidate := range tw.streams {
+			if candidate.next >= len(candidate.trak.samples) {
+				continue
+			}
+			t := fromTimescale(candidate.trak.samples[candidate.next].start_time, candidate.trak.mdia.mdhd.timescale)
+			if s == nil || t < dts {
+				s, dts = candidate, t
+			}
+		}
+		if s == nil {
+			break
+		}
+		sample := s.trak.samples[s.next]
+		s.next++
+		keyframe := s.next > 1 && s == tw.pcr && sample.sync && s.stream_type != TS_STREAM_AAC
+		if keyframe || dts - tw.psi_time >= TS_PSI_INTERVAL {
+			if err := tw.writePSI(); err != nil {
+				return err
+			}
+			tw.psi_time = dts
+		}
+		data := f.ReadBytesAt(int64(sample.size), int64(sample.offset))
+		if data == nil {
+			return os.NewError("Sample data could not be read")
+		}
+		data, err := s.convert(data)
+		if err != nil {
+			return err
+		}
+		if err = tw.writePES(s, sample, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePSI writes the PAT and the PMT, each in a packet of its own.
+func (tw *tsWriter) writePSI() (os.Error) {
+	// The single program is number 1
+	pat := []byte{ 0, 1, 0xE0 | TS_PMT_PID >> 8, TS_PMT_PID & 0xFF }
+	if err := tw.writeSection(TS_PAT_PID, &tw.psi_cc[0], 0x00, 1, pat); err != nil {
+		return err
+	}
+
+	pmt := []byte{ 0xE0 | byte(tw.pcr.pid >> 8), byte(tw.pcr.pid), 0xF0, 0 }
+	for _, s := range tw.streams {
+		pmt = append(pmt, s.stream_type, 0xE0 | byte(s.pid >> 8), byte(s.pid), 0xF0, 0)
+	}
+	return tw.writeSection(TS_PMT_PID, &tw.psi_cc[1], 0x02, 1, pmt)
+}
+
+// writeSection writes a PSI section of the given table, with id as its
+// transport stream or program number, in a single packet.
+func (tw *tsWriter) writeSection(pid uint16, cc *byte, table_id byte, id uint16, data []byte) (os.Error) {
+	// Section length counts the rest of the header, the data and the CRC
+	length := 5 + len(data) + 4
+	section := []byte{
+		table_id, 0xB0 | byte(length >> 8), byte(length),
+		byte(id >> 8), byte(id),
+		0xC1, // Version 0, current
+		0, 0, // Section 0 of 0
+	}
+	section = append(section, data...)
+	section = putUint32(section, crc32MPEG(section))
+
+	packet := tsHeader(pid, true, *cc)
+	*cc = (*cc + 1) & 0xF
+	packet = append(packet, 0) // Pointer field
+	packet = append(packet, section...)
+	if len(packet) > TS_PACKET_SIZE {
+		return os.NewError(fmt.Sprintf("PSI table 0x%02x does not fit in a packet", table_id))
+	}
+	for len(packet) < TS_PACKET_SIZE {
+		packet = append(packet, 0xFF)
+	}
+	_, err := tw.w.Write(packet)
+	return err
+}
+
+// writePES writes a sample of the stream as a PES packet, split across as
+// many transport stream packets as it needs.
+func (tw *tsWriter) writePES(s *tsStream, sample Sample, data []byte) (os.Error) {
+	timescale := s.trak.mdia.mdhd.timescale
+	dts := int64(sample.start_time) * TS_CLOCK / int64(timescale) + TS_DELAY
+	// Version 1 ctts offsets may be negative
+	pts := dts + int64(int32(sample.cto)) * TS_CLOCK / int64(timescale)
+
+	header := []byte{ 0, 0, 1, s.stream_id, 0, 0, 0x84 } // Data aligned
+	if pts != dts {
+		header = append(header, 0xC0, 10)
+		header = putTimestamp(header, 0x3, pts)
+		header = putTimestamp(header, 0x1, dts)
+	} else
+	{
+		header = append(header, 0x80, 5)
+		header = putTimestamp(header, 0x2, pts)
+	}
+	// Video PES packets may be unbounded, marked by a length of 0
+	if length := len(header) - 6 + len(data); length <= 0xFFFF {
+		header[4], header[5] = byte(length >> 8), byte(length)
+	} else if s.stream_type == TS_STREAM_AAC {
+		return os.NewError("Audio sample too large for a PES packet")
+	}
+	pes := append(header, data...)
+
+	for first := true; len(pes) > 0; first = false {
+		packet := tsHeader(s.pid, first, s.cc)
+		s.cc = (s.cc + 1) & 0xF
+
+		var adaptation []byte
+		if first && s == tw.pcr {
+			pcr := (dts - TS_DELAY) & 0x1FFFFFFFF
+			adaptation = []byte{ 0x10,
+				byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1),
+				byte(pcr << 7) | 0x7E, 0 }
+		}
+		if first && sample.sync && s.stream_type != TS_STREAM_AAC {
+			if adaptation == nil {
+				adaptation = []byte{ 0 }
+			}
+			adaptation[0] |= 0x40 // Random access indicator
+		}
+		// Stuff the adaptation field so the payload fills the packet
+		room := TS_PACKET_SIZE - len(packet)
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if len(pes) < room {
+			if adaptation == nil {
+				// A lone length byte of 0 is a single byte of stuffing
+				adaptation = []byte{}
+				room--
+				if len(pes) < room {
+					adaptation = append(adaptation, 0)
+					room--
+				}
+			}
+			for len(pes) < room {
+				adaptation = append(adaptation, 0xFF)
+				room--
+			}
+		}
+		if adaptation != nil {
+			packet[3] |= 0x20
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, pes[:room]...)
+		pes = pes[room:]
+		if _, err := tw.w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tsHeader returns the 4 byte header of a transport stream packet carrying
+// a payload, with start set on the first packet of a PES packet or section.
+func tsHeader(pid uint16, start bool, cc byte) ([]byte) {
+	header := []byte{ TS_SYNC_BYTE, byte(pid >> 8) & 0x1F, byte(pid), 0x10 | cc }
+	if start {
+		header[1] |= 0x40
+	}
+	return header
+}
+
+// putTimestamp appends a 33 bit PTS or DTS, behind the given 4 bit prefix, in
+// the 5 byte form of the PES header.
+func putTimestamp(data []byte, prefix byte, t int64) ([]byte) {
+	t &= 0x1FFFFFFFF
+	return append(data,
+		prefix << 4 | byte(t >> 29) & 0x0E | 1,
+		byte(t >> 22),
+		byte(t >> 14) | 1,
+		byte(t >> 7),
+		byte(t << 1) | 1)
+}
+
+// crc32MPEG returns the CRC-32 of PSI sections: polynomial 0x04C11DB7, not
+// reflected, starting from all ones.
+func crc32MPEG(data []byte) (uint32) {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc & 0x80000000 != 0 {
+				crc = crc << 1 ^ 0x04C11DB7
+			} else
+			{
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,160 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRC32MPEG(t *testing.T) {
+	if crc := crc32MPEG([]byte("123456789")); crc != 0x0376E6E7 {
+		t.Errorf("CRC of the check string is %08x", crc)
+	}
+	// A section followed by its CRC checks to 0
+	section := []byte{ 0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00 }
+	if crc := crc32MPEG(putUint32(section, crc32MPEG(section))); crc != 0 {
+		t.Errorf("CRC of a section with its CRC is %08x", crc)
+	}
+}
+
+func TestPutTimestamp(t *testing.T) {
+	tests := []struct {
+		prefix byte
+		t int64
+		want []byte
+	}{
+		{ 0x2, 0, []byte{ 0x21, 0x00, 0x01, 0x00, 0x01 } },
+		{ 0x3, 63000, []byte{ 0x31, 0x00, 0x03, 0xEC, 0x31 } },
+		{ 0x1, 0x1FFFFFFFF, []byte{ 0x1F, 0xFF, 0xFF, 0xFF, 0xFF } },
+		{ 0x2, 0x200000000, []byte{ 0x21, 0x00, 0x01, 0x00, 0x01 } }, // Wraps at 33 bits
+	}
+	for _, test := range tests {
+		if got := putTimestamp(nil, test.prefix, test.t); !bytes.Equal(got, test.want) {
+			t.Errorf("putTimestamp(%x, %v) = % x, want % x", test.prefix, test.t, got, test.want)
+		}
+	}
+}
+
+// tsPacket is a transport stream packet split into its parts.
+type tsPacket struct {
+	pid uint16
+	start bool
+	cc byte
+	adaptation, payload []byte
+}
+
+// tsPackets splits a transport stream into packets.
+func tsPackets(t *testing.T, data []byte) (packets []tsPacket) {
+	if len(data) % TS_PACKET_SIZE != 0 {
+		t.Fatalf("Stream of %v bytes is not whole packets", len(data))
+	}
+	for ; len(data) > 0; data = data[TS_PACKET_SIZE:] {
+		p := data[:TS_PACKET_SIZE]
+		if p[0] != TS_SYNC_BYTE {
+			t.Fatalf("Packet %v has no sync byte", len(packets))
+		}
+		packet := tsPacket{ pid: uint16(p[1] & 0x1F) << 8 | uint16(p[2]), start: p[1] & 0x40 != 0, cc: p[3] & 0xF }
+		rest := p[4:]
+		if p[3] & 0x20 != 0 {
+			packet.adaptation, rest = rest[1:1+rest[0]], rest[1+rest[0]:]
+		}
+		if p[3] & 0x10 != 0 {
+			packet.payload = rest
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// pesTime returns the PTS of a PES packet.
+func pesTime(pes []byte) (int64) {
+	p := pes[9:14]
+	return int64(p[0] & 0x0E) << 29 | int64(p[1]) << 22 | int64(p[2] >> 1) << 15 | int64(p[3]) << 7 | int64(p[4] >> 1)
+}
+
+func TestWriteTS(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	buf := new(bytes.Buffer)
+	if err := f.WriteTS(buf); err != nil {
+		t.Fatal(err)
+	}
+	packets := tsPackets(t, buf.Bytes())
+
+	// The PAT maps program 1 to the PMT, and the PMT lists H.264 video
+	// carrying the PCR and AAC audio
+	pat := []byte{ 0, 0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0x2A, 0xB1, 0x04, 0xB2 }
+	if p := packets[0]; p.pid != TS_PAT_PID || !p.start || !bytes.Equal(p.payload[:len(pat)], pat) {
+		t.Errorf("PAT is % x", p.payload[:len(pat)])
+	}
+	pmt := []byte{ 0, 0x02, 0xB0, 0x17, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00,
+		TS_STREAM_H264, 0xE1, 0x00, 0xF0, 0x00, TS_STREAM_AAC, 0xE1, 0x01, 0xF0, 0x00 }
+	p := packets[1]
+	if p.pid != TS_PMT_PID || !bytes.Equal(p.payload[:len(pmt)], pmt) {
+		t.Errorf("PMT is % x", p.payload[:len(pmt)])
+	}
+	if crc32MPEG(p.payload[1:len(pmt)+4]) != 0 {
+		t.Error("PMT CRC does not check")
+	}
+	for _, b := range p.payload[len(pmt)+4:] {
+		if b != 0xFF {
+			t.Fatal("PMT is not followed by stuffing")
+		}
+	}
+
+	// Every sample starts a PES packet, and continuity counters count the
+	// packets of each PID
+	cc := make(map[uint16]byte)
+	starts := make(map[uint16]int)
+	for i, p := range packets {
+		if last, ok := cc[p.pid]; ok && p.cc != (last + 1) & 0xF {
+			t.Fatalf("Packet %v on PID %x has continuity counter %v after %v", i, p.pid, p.cc, last)
+		}
+		cc[p.pid] = p.cc
+		if p.start {
+			starts[p.pid]++
+		}
+		if p.start && p.pid == TS_FIRST_ES_PID && len(p.adaptation) < 7 {
+			t.Errorf("Video PES packet %v carries no PCR", starts[p.pid])
+		}
+	}
+	if starts[TS_FIRST_ES_PID] != fixtureVideoSamples || starts[TS_FIRST_ES_PID + 1] != fixtureAudioSamples {
+		t.Errorf("%v video and %v audio PES packets", starts[TS_FIRST_ES_PID], starts[TS_FIRST_ES_PID + 1])
+	}
+}
+
+func TestWriteTSAudioPSI(t *testing.T) {
+	f := openFixture(t, fixture{})
+	defer closeTemp(f)
+	f.moov.traks = f.moov.traks[1:]
+	buf := new(bytes.Buffer)
+	if err := f.WriteTS(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The PAT comes about every 100ms, the PMT after it, though audio
+	// has no keyframes
+	frame := int64(fixtureAudioDelta) * TS_CLOCK / fixtureAudioTimescale
+	pats := 0
+	last := int64(-1)
+	packets := tsPackets(t, buf.Bytes())
+	for i, p := range packets {
+		switch {
+		case p.pid == TS_PAT_PID:
+			pats++
+			if packets[i+1].pid != TS_PMT_PID {
+				t.Errorf("PAT %v is not followed by the PMT", pats)
+			}
+			last = -1
+		case p.pid == TS_FIRST_ES_PID && p.start:
+			pts := pesTime(p.payload)
+			if last < 0 {
+				last = pts
+			} else if pts - last > TS_CLOCK / 10 + frame {
+				t.Fatalf("No PAT between PTS %v and %v", last, pts)
+			}
+		}
+	}
+	if pats < 25 {
+		t.Errorf("%v PATs in 3 seconds", pats)
+	}
+}